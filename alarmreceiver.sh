@@ -1,6 +1,7 @@
 #!/bin/bash
 # SmogPing Alarm Receiver Script
-# This script is called when alarm thresholds are exceeded
+# This script is called when a metric enters an alarm state, stays in alarm
+# (every alarm_rate seconds) and when it recovers
 
 # Command line arguments
 HOST_NAME="$1"
@@ -11,14 +12,23 @@ PACKET_LOSS="$5"
 JITTER_MS="$6"
 ALARM_REASONS="$7"
 TIMESTAMP="$8"
+ALARM_EVENT="$9"          # trigger, repeat or resolve
+ALARM_METRIC="${10}"      # ping, loss or jitter
+ALARM_STATE="${11}"       # OK, WARNING or CRITICAL
+PREVIOUS_STATE="${12}"
+ALARM_DURATION="${13}"    # Seconds since the metric left OK
 
 # Environment variables are also available:
 # SMOGPING_HOST, SMOGPING_IP, SMOGPING_ORG, SMOGPING_RTT, 
 # SMOGPING_LOSS, SMOGPING_JITTER, SMOGPING_REASONS, SMOGPING_TIMESTAMP
 # SMOGPING_ALARM_PING, SMOGPING_ALARM_LOSS, SMOGPING_ALARM_JITTER
+# SMOGPING_WARN_PING, SMOGPING_WARN_LOSS, SMOGPING_WARN_JITTER
+# SMOGPING_EVENT, SMOGPING_METRIC, SMOGPING_STATE, SMOGPING_PREVIOUS_STATE, SMOGPING_DURATION
+# SMOGPING_AF (address family 4 or 6, 0 if the host has none)
 
 # Log the alarm
-echo "$(date): ALARM for $HOST_NAME ($HOST_IP) in $ORGANIZATION"
+echo "$(date): ALARM $ALARM_EVENT for $HOST_NAME ($HOST_IP) in $ORGANIZATION"
+echo "  $ALARM_METRIC: $PREVIOUS_STATE -> $ALARM_STATE (${ALARM_DURATION}s in alarm)"
 echo "  RTT: ${RTT_MS}ms, Loss: ${PACKET_LOSS}%, Jitter: ${JITTER_MS}ms"
 echo "  Reasons: $ALARM_REASONS"
 echo "  Timestamp: $TIMESTAMP"
@@ -26,7 +36,7 @@ echo "  Timestamp: $TIMESTAMP"
 # Example actions you can implement:
 
 # 1. Log to syslog
-logger -t smogping "ALARM: $HOST_NAME ($HOST_IP) - $ALARM_REASONS"
+logger -t smogping "ALARM $ALARM_EVENT: $HOST_NAME ($HOST_IP) $ALARM_METRIC $ALARM_STATE - $ALARM_REASONS"
 
 # 2. Send email (requires mail command)
 # TRACEROUTE_EMAIL=$(traceroute -m 10 $HOST_IP 2>/dev/null || echo "Traceroute failed or not available")
@@ -58,7 +68,7 @@ logger -t smogping "ALARM: $HOST_NAME ($HOST_IP) - $ALARM_REASONS"
 
 # 4. Write to alarm log file
 ALARM_LOG="/var/log/smogping-alarms.log"
-echo "$(date -Iseconds) ALARM $HOST_NAME $HOST_IP $ORGANIZATION RTT=${RTT_MS}ms LOSS=${PACKET_LOSS}% JITTER=${JITTER_MS}ms REASONS=\"$ALARM_REASONS\"" >> "$ALARM_LOG"
+echo "$(date -Iseconds) ALARM $ALARM_EVENT $ALARM_METRIC $ALARM_STATE $HOST_NAME $HOST_IP $ORGANIZATION RTT=${RTT_MS}ms LOSS=${PACKET_LOSS}% JITTER=${JITTER_MS}ms REASONS=\"$ALARM_REASONS\"" >> "$ALARM_LOG"
 
 # 5. Send SNMP trap (requires snmptrap command)
 # snmptrap -v2c -c public localhost '' 1.3.6.1.4.1.12345.1 \
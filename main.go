@@ -5,21 +5,38 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"container/heap"
 	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"log/syslog"
+	"maps"
 	"math"
+	"math/rand/v2"
 	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -27,8 +44,12 @@ import (
 	"github.com/fsnotify/fsnotify"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
 	"github.com/influxdata/influxdb-client-go/v2/api/write"
-	probing "github.com/prometheus-community/pro-bing"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 // Object pools for memory efficiency
@@ -38,12 +59,6 @@ var (
 			return &PingResult{}
 		},
 	}
-
-	rttSlicePool = sync.Pool{
-		New: func() interface{} {
-			return make([]time.Duration, 0, 10) // Pre-allocate for typical ping count
-		},
-	}
 )
 
 // Config represents the main configuration structure
@@ -54,14 +69,55 @@ type Config struct {
 	InfluxBucket       string `toml:"influx_bucket"`
 	InfluxBatchSize    int    `toml:"influx_batch_size"`
 	InfluxBatchTime    int    `toml:"influx_batch_time"`
+	InfluxSpoolDir     string `toml:"influx_spool_dir"`    // Directory for batches that failed to write, "none" disables
+	InfluxSpoolMaxMB   int    `toml:"influx_spool_max_mb"` // Spool size limit, oldest batches are dropped first
 	DataPointPings     int    `toml:"data_point_pings"`
 	DataPointTime      int    `toml:"data_point_time"`
 	PingTimeout        int    `toml:"ping_timeout"`
 	PingSource         string `toml:"ping_source"`
+	AlignDataPoints    bool   `toml:"align_data_points"` // Start data points on multiples of data_point_time since the epoch
 	DNSRefresh         int    `toml:"dns_refresh"`
 	AlarmRate          int    `toml:"alarm_rate"`
 	AlarmReceiver      string `toml:"alarm_receiver"`
+	AlarmPing          int    `toml:"alarm_ping"`   // Default alarmping for hosts and organizations that do not set it
+	AlarmLoss          int    `toml:"alarm_loss"`   // Default alarmloss for hosts and organizations that do not set it
+	AlarmJitter        int    `toml:"alarm_jitter"` // Default alarmjitter for hosts and organizations that do not set it
 	MaxConcurrentPings int    `toml:"max_concurrent_pings"`
+	MetricsListen      string `toml:"metrics_listen"` // Prometheus exporter address, e.g. ":9108"
+	// RTT distribution fields
+	RTTStats       []string `toml:"rtt_stats"`       // Extra statistics: min, max, median
+	RTTPercentiles []int    `toml:"rtt_percentiles"` // Stored as rtt_pNN fields
+	RTTSamples     bool     `toml:"rtt_samples"`     // Store sorted samples as rtt_1 .. rtt_N
+	// Alarm webhook settings
+	AlarmWebhook        string            `toml:"alarm_webhook"`
+	AlarmWebhookTimeout int               `toml:"alarm_webhook_timeout"`
+	AlarmWebhookRetries int               `toml:"alarm_webhook_retries"`
+	AlarmWebhookBackoff int               `toml:"alarm_webhook_backoff"`
+	AlarmWebhookHeaders map[string]string `toml:"alarm_webhook_headers"`
+}
+
+// ProfileList names the profiles a host takes the settings it does not set from
+type ProfileList []string
+
+// UnmarshalTOML accepts a single profile name as well as a list of names
+func (p *ProfileList) UnmarshalTOML(data interface{}) error {
+	switch value := data.(type) {
+	case string:
+		*p = ProfileList{value}
+	case []interface{}:
+		names := make(ProfileList, 0, len(value))
+		for _, item := range value {
+			name, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("profile must be a name or a list of names, got %v", item)
+			}
+			names = append(names, name)
+		}
+		*p = names
+	default:
+		return fmt.Errorf("profile must be a name or a list of names, got %v", data)
+	}
+	return nil
 }
 
 // Host represents a target host to ping
@@ -72,11 +128,63 @@ type Host struct {
 	AlarmLoss     int    `toml:"alarmloss"`
 	AlarmJitter   int    `toml:"alarmjitter"`
 	AlarmReceiver string `toml:"alarmreceiver"`
+	AlarmWebhook  string `toml:"alarmwebhook"`
 	PingSource    string `toml:"pingsource"`
+	WarnPing      int    `toml:"warnping"`
+	WarnLoss      int    `toml:"warnloss"`
+	WarnJitter    int    `toml:"warnjitter"`
+	ClearPing     int    `toml:"clearping"`
+	ClearLoss     int    `toml:"clearloss"`
+	ClearJitter   int    `toml:"clearjitter"`
+	AlarmCount    int    `toml:"alarmcount"`   // Breaching data points needed to raise an alarm (M)
+	AlarmWindow   int    `toml:"alarmwindow"`  // Recent data points considered (N)
+	Probe         string `toml:"probe"`        // Probe type: icmp (default), tcp, http or dns
+	Port          int    `toml:"port"`         // Destination port for tcp and dns probes
+	URL           string `toml:"url"`          // Request URL for http probes
+	Method        string `toml:"method"`       // Request method for http probes, GET by default
+	ExpectStatus  int    `toml:"expectstatus"` // Expected HTTP status code, 200 by default
+	ExpectBody    string `toml:"expectbody"`   // Optional regex the HTTP response body must match
+	Query         string `toml:"query"`        // Name to look up for dns probes
+	QueryType     string `toml:"querytype"`    // DNS record type, A by default
+	Transport     string `toml:"transport"`    // DNS transport: udp (default) or tcp
+	ExpectRcode   string `toml:"expectrcode"`  // Expected DNS response code, NOERROR by default
+	ExpectAnswer  string `toml:"expectanswer"` // Optional value one of the DNS answer records must contain
+	Family        string `toml:"family"`       // Address family: ipv4, ipv6 or both, any (IPv4 preferred) by default
+	Expand        bool   `toml:"expand"`       // Probe every address of the DNS name as its own target
+	BackendsDown  int    `toml:"backendsdown"` // Expanded hosts: raise an alarm when this many addresses are down
+	// Sampling overrides, 0 uses the organization setting or data_point_pings, data_point_time and ping_timeout
+	DataPointPings int `toml:"datapointpings"`
+	DataPointTime  int `toml:"datapointtime"`
+	PingTimeout    int `toml:"pingtimeout"`
+	// Profiles the host takes the settings it does not set from, a later profile wins over an earlier one
+	Profile ProfileList `toml:"profile"`
+	// User tags added to InfluxDB tags, Prometheus labels and alarms, merged with profile and organization tags
+	Tags map[string]string `toml:"tags"`
 	// DNS resolution fields (not in TOML)
 	ResolvedIP   string    `toml:"-"` // Current resolved IP address
 	LastDNSCheck time.Time `toml:"-"` // Last time DNS was checked
 	IsDNSName    bool      `toml:"-"` // True if IP field contains a DNS name
+	// AddressFamily is the family (4 or 6) the target is resolved and probed with, 0 for any.
+	// Hosts with family "both" are monitored as one target per family.
+	AddressFamily int `toml:"-"`
+	// Backend is the address probed by a target expanded from a host with expand set, "" otherwise
+	Backend string `toml:"-"`
+	// Location of the host in the targets files, like organizations.Name.hosts[2] in SourceField
+	SourceFile  string `toml:"-"`
+	SourceField string `toml:"-"`
+	// Settings the host ends up with and where each comes from, recorded before inheritance
+	Settings []EffectiveSetting `toml:"-"`
+	// Keys the targets file sets for the host or profile, so a setting given as 0, "" or false
+	// still overrides its profiles. nil for hosts not read from a targets file.
+	DefinedKeys map[string]bool `toml:"-"`
+}
+
+// EffectiveSetting is a setting a host ends up with and where it comes from: host, profile,
+// organization or global
+type EffectiveSetting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Origin string `json:"origin"`
 }
 
 // DNSCache represents a DNS resolution cache entry
@@ -94,15 +202,42 @@ type DNSResolver struct {
 	resolver *net.Resolver
 }
 
+// HostDefaults holds the settings an organization passes on to hosts that do not set them
+type HostDefaults struct {
+	AlarmPing     int    `toml:"alarmping"`
+	AlarmLoss     int    `toml:"alarmloss"`
+	AlarmJitter   int    `toml:"alarmjitter"`
+	AlarmReceiver string `toml:"alarmreceiver"`
+	PingSource    string `toml:"pingsource"`
+}
+
 // Organization represents a group of hosts
 type Organization struct {
-	Hosts []Host `toml:"hosts"`
+	Hosts        []Host       `toml:"hosts"`
+	Defaults     HostDefaults `toml:"defaults"`     // Defaults for hosts of this organization, over the config.toml defaults
+	AlarmCount   int          `toml:"alarmcount"`   // Default alarmcount for hosts of this organization
+	AlarmWindow  int          `toml:"alarmwindow"`  // Default alarmwindow for hosts of this organization
+	Family       string       `toml:"family"`       // Default address family for hosts of this organization
+	BackendsDown int          `toml:"backendsdown"` // Default backendsdown for expanded hosts of this organization
+	// Default sampling for hosts of this organization
+	DataPointPings int `toml:"datapointpings"`
+	DataPointTime  int `toml:"datapointtime"`
+	PingTimeout    int `toml:"pingtimeout"`
+	// Tags of all hosts of this organization, a host tag with the same name wins
+	Tags map[string]string `toml:"tags"`
 }
 
 // TargetsConfig represents the targets configuration structure
 type TargetsConfig struct {
 	Include       []string                `toml:"include"`
+	Profiles      map[string]Host         `toml:"profiles"` // Named host settings, the main file's profiles are used by included files too
 	Organizations map[string]Organization `toml:"organizations"`
+	// Files are the targets files loaded, the main file first, and IncludePatterns the glob
+	// patterns of their includes, used to watch for files that newly match
+	Files           []string `toml:"-"`
+	IncludePatterns []string `toml:"-"`
+	// Included files that are missing or failed to load, watched so fixing them reloads the targets
+	FailedFiles []string `toml:"-"`
 }
 
 // PingResult represents the result of a ping operation
@@ -113,6 +248,10 @@ type PingResult struct {
 	Jitter     time.Duration
 	Timestamp  time.Time
 	OrgName    string
+	PreviousIP string          // Resolved IP before a DNS change during this data point
+	RTTs       []time.Duration // Successful ping RTTs sorted ascending, only valid while the result is being stored
+	HTTPPhases HTTPPhases      // Average HTTP phase timings of the successful pings, http probes only
+	Dropped    int             // Probes of the data point not sent because the probe queue was full
 }
 
 // TargetInfo represents a target with its organization context
@@ -121,6 +260,43 @@ type TargetInfo struct {
 	OrgName string
 }
 
+// AlarmState is the alarm level of a single host metric
+type AlarmState string
+
+const (
+	AlarmStateOK       AlarmState = "OK"
+	AlarmStateWarning  AlarmState = "WARNING"
+	AlarmStateCritical AlarmState = "CRITICAL"
+)
+
+// Alarm event types passed to alarm receivers
+const (
+	AlarmEventTrigger = "trigger" // Metric entered or changed alarm state
+	AlarmEventRepeat  = "repeat"  // Metric still in alarm after alarm_rate seconds
+	AlarmEventResolve = "resolve" // Metric returned to OK
+)
+
+// MetricAlarm tracks the alarm state of one metric of a host
+type MetricAlarm struct {
+	State      AlarmState
+	Since      time.Time // When the metric left the OK state
+	LastNotify time.Time // Last time the alarm receiver was called
+	History    []float64 // Values of the most recent data points, oldest first
+}
+
+// Maximum number of data points kept in a metric's alarm history
+const maxAlarmWindow = 60
+
+// AlarmEvent describes an alarm notification for one metric of a host
+type AlarmEvent struct {
+	Type          string // trigger, repeat or resolve
+	Metric        string // ping, loss or jitter
+	State         AlarmState
+	PreviousState AlarmState
+	Duration      time.Duration // Time spent outside the OK state
+	Reason        string
+}
+
 // TOML Validation Error Types
 type TOMLValidationError struct {
 	File    string
@@ -155,10 +331,17 @@ func (e *TOMLParseError) Error() string {
 	return fmt.Sprintf("TOML parse error in %s: %s", e.File, e.Message)
 }
 
+// ConfigWarning is a validation warning, about a field when Field is set
+type ConfigWarning struct {
+	File    string // File the field is set in, the validated file when empty
+	Field   string
+	Message string
+}
+
 // ConfigValidator handles configuration validation
 type ConfigValidator struct {
 	errors   []error
-	warnings []string
+	warnings []ConfigWarning
 }
 
 func (cv *ConfigValidator) AddError(err error) {
@@ -166,7 +349,12 @@ func (cv *ConfigValidator) AddError(err error) {
 }
 
 func (cv *ConfigValidator) AddWarning(msg string) {
-	cv.warnings = append(cv.warnings, msg)
+	cv.warnings = append(cv.warnings, ConfigWarning{Message: msg})
+}
+
+// AddFieldWarning adds a warning about a field set in file
+func (cv *ConfigValidator) AddFieldWarning(file, field, msg string) {
+	cv.warnings = append(cv.warnings, ConfigWarning{File: file, Field: field, Message: msg})
 }
 
 func (cv *ConfigValidator) HasErrors() bool {
@@ -177,52 +365,83 @@ func (cv *ConfigValidator) GetErrors() []error {
 	return cv.errors
 }
 
-func (cv *ConfigValidator) GetWarnings() []string {
+func (cv *ConfigValidator) GetWarnings() []ConfigWarning {
 	return cv.warnings
 }
 
-// PingJob represents a ping job for the worker pool
-type PingJob struct {
-	OrgName string
-	Host    Host
+// CheckIssue is an error or warning found by the check subcommand
+type CheckIssue struct {
+	File    string      `json:"file,omitempty"`
+	Line    int         `json:"line,omitempty"`
+	Field   string      `json:"field,omitempty"`
+	Value   interface{} `json:"value,omitempty"`
+	Message string      `json:"message"`
+}
+
+// CheckHost is a host of the check report with its effective settings
+type CheckHost struct {
+	File         string             `json:"file,omitempty"`
+	Line         int                `json:"line,omitempty"`
+	Organization string             `json:"organization"`
+	Name         string             `json:"name"`
+	Settings     []EffectiveSetting `json:"settings"`
 }
 
-// PingWorker represents a worker that processes ping jobs
-type PingWorker struct {
-	id       int
-	app      *SmogPing
-	jobQueue <-chan PingJob
-	quit     chan bool
+// CheckReport collects every error and warning of the check subcommand
+type CheckReport struct {
+	Valid    bool         `json:"valid"`
+	Files    []string     `json:"files"`
+	Targets  int          `json:"targets"`
+	Errors   []CheckIssue `json:"errors"`
+	Warnings []CheckIssue `json:"warnings"`
+	Hosts    []CheckHost  `json:"hosts"`
+	// Key lines of each file, scanned on first use
+	keyLines map[string]map[string]int
 }
 
-// PingWorkerPool manages a pool of ping workers
-type PingWorkerPool struct {
-	workers    []*PingWorker
-	jobQueue   chan PingJob
-	resultChan chan *PingResult
-	quit       chan bool
-	wg         sync.WaitGroup
+// PingSchedule tracks the ping schedule of a single target and its data points in progress
+type PingSchedule struct {
+	OrgName        string
+	Host           Host
+	dataPointPings int
+	interval       time.Duration // Time between probes
+	align          bool          // Data points start on multiples of window since the epoch
+	window         time.Duration // Data point time
+	offset         time.Duration // Stagger offset of the first probe into an aligned window
+	windowStart    time.Time     // Start of the aligned window of the next probe
+	next           time.Time     // Due time of the next probe, owned by the scheduler
+	heapIndex      int           // Position in the scheduler heap, -1 when not queued
+	mu             sync.Mutex    // Protects the fields below
+	dataPoint      int           // Data point the next probe belongs to
+	index          int           // Position of the next probe within its data point
+	pending        map[int]*pendingDataPoint
+	resolvedPoint  int // Newest finished data point, whose address Host.ResolvedIP holds
+	stopped        bool
 }
 
 // SmogPing represents the main application
 type SmogPing struct {
-	config      Config
-	targets     TargetsConfig
-	influxWrite api.WriteAPI
-	wg          sync.WaitGroup
-	ctx         context.Context
-	cancel      context.CancelFunc
-	// Worker pool components (replacing semaphore)
-	workerPool *PingWorkerPool
+	config    Config
+	configMux sync.RWMutex // Protects config during live reloads of config.toml
+	targets   TargetsConfig
+	sinks     []Sink // Output sinks receiving every data point
+	wg        sync.WaitGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+	// Probe scheduler with its bounded worker pool
+	scheduler *Scheduler
+	// Shared ICMP sockets of all icmp targets
+	icmpEngine *ICMPEngine
+	// Ping schedule registry
+	schedules    map[string]*PingSchedule // Running schedules keyed by targetKey
+	schedulesMux sync.Mutex               // Protects schedules
 	// DNS resolution components
 	dnsResolver *DNSResolver
-	// Batching components
-	batchMutex  sync.Mutex
-	batchPoints []*write.Point
-	lastFlush   time.Time
 	// Alarm components
-	lastAlarms map[string]time.Time // Track last alarm time per host
-	alarmMutex sync.RWMutex         // Protect alarm tracking
+	alarmStates     map[string]map[string]*MetricAlarm // Alarm state per host and metric
+	backendGroups   map[string]*BackendGroup           // Roll-up alarm state per expanded host
+	alarmMutex      sync.RWMutex                       // Protect alarm tracking
+	webhookNotifier *WebhookNotifier                   // Delivers alarm events to webhooks
 	// CLI flags
 	verbose     bool   // Verbose output
 	debug       bool   // Debug output
@@ -233,14 +452,22 @@ type SmogPing struct {
 	// Syslog writer
 	syslogWriter *syslog.Writer // Syslog writer for structured logging
 	// File watching
-	watcher    *fsnotify.Watcher // File system watcher
-	targetsMux sync.RWMutex      // Protects targets during reload
-	reloadChan chan bool         // Channel to signal configuration reload
+	watcher          *fsnotify.Watcher // File system watcher
+	targetsMux       sync.RWMutex      // Protects targets during reload
+	reloadChan       chan bool         // Channel to signal targets reload
+	configReloadChan chan bool         // Channel to signal config.toml reload
+	// Report of the check subcommand, validation collects every error instead of stopping at the first
+	check *CheckReport
 }
 
 func main() {
 	app := &SmogPing{}
 
+	// The check subcommand validates the configuration without monitoring anything
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(app.runCheck(os.Args[2:], os.Stdout))
+	}
+
 	// Parse command line flags
 	app.parseFlags()
 
@@ -252,6 +479,9 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Fill in defaults for settings left at zero before validating them, as a reload does
+	applyConfigDefaults(&app.config)
+
 	// Load targets
 	if err := app.loadTargets(); err != nil {
 		log.Fatalf("Failed to load targets: %v", err)
@@ -266,23 +496,20 @@ func main() {
 	}
 
 	// Validate configuration sanity
-	if err := app.validateConfiguration(); err != nil {
+	if err := app.validateConfiguration(app.config); err != nil {
 		log.Fatalf("Configuration validation failed: %v", err)
 	}
 
-	// Setup InfluxDB
-	if err := app.setupInfluxDB(); err != nil {
-		log.Fatalf("Failed to setup InfluxDB: %v", err)
-	}
-
 	// Setup context for graceful shutdown
 	app.ctx, app.cancel = context.WithCancel(context.Background())
 
-	// Setup worker pool (replaces optimization components)
-	// app.setupWorkerPool() // Disabled - using individual ping schedules instead
+	// Setup the probe scheduler and its worker pool
+	app.scheduler = app.newScheduler()
 
-	// Setup batching
-	app.setupBatching()
+	// Setup output sinks (InfluxDB, Prometheus)
+	if err := app.setupSinks(); err != nil {
+		log.Fatalf("Failed to setup outputs: %v", err)
+	}
 
 	// Setup alarm system (unless disabled)
 	if !app.noAlarm {
@@ -299,7 +526,8 @@ func main() {
 	// Start DNS refresh monitoring
 	app.startDNSRefreshMonitoring()
 
-	// Start ping monitoring
+	// Start ping monitoring over the shared ICMP engine
+	app.icmpEngine = NewICMPEngine()
 	app.startPingMonitoring()
 
 	// Wait for interrupt signal
@@ -310,12 +538,12 @@ func main() {
 	log.Println("Shutting down...")
 	app.cancel()
 
-	// Stop worker pool
-	if app.workerPool != nil {
-		app.stopWorkerPool()
-	}
-
 	app.wg.Wait()
+	app.scheduler.Close()
+	app.icmpEngine.Close()
+
+	// Flush and close outputs once no more data points are produced
+	app.closeSinks()
 	log.Println("Shutdown complete")
 
 	// Close file watcher
@@ -344,7 +572,8 @@ func (sp *SmogPing) parseFlags() {
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "SmogPing - Network monitoring with InfluxDB storage\n\n")
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s check [check options]   Validate the configuration and exit\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nDefault configuration files:\n")
@@ -368,6 +597,78 @@ func (sp *SmogPing) parseFlags() {
 	}
 }
 
+// runCheck runs the check subcommand. It loads config.toml and the targets files with their includes
+// like startup does, without DNS lookups, outputs or probes, and prints every error and warning it
+// finds to stdout. It returns the exit code, 1 if there are errors. Warnings do not fail the check.
+func (sp *SmogPing) runCheck(args []string, stdout io.Writer) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	jsonOutput := false
+	flags.BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+	flags.BoolVar(&sp.verbose, "verbose", false, "Enable verbose output")
+	flags.BoolVar(&sp.verbose, "v", false, "Enable verbose output (short)")
+	flags.BoolVar(&sp.debug, "debug", false, "Enable debug output")
+	flags.BoolVar(&sp.debug, "d", false, "Enable debug output (short)")
+	flags.StringVar(&sp.configFile, "config", "config.toml", "Path to configuration file")
+	flags.StringVar(&sp.configFile, "c", "config.toml", "Path to configuration file (short)")
+	flags.StringVar(&sp.targetsFile, "targets", "targets.toml", "Path to targets file")
+	flags.StringVar(&sp.targetsFile, "t", "targets.toml", "Path to targets file (short)")
+
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s check [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Validates the configuration and targets files without monitoring anything.\n")
+		fmt.Fprintf(os.Stderr, "Exits with status 1 if there are errors, warnings do not fail the check.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	// Log output goes to stderr, the report to stdout
+	if sp.debug {
+		log.SetFlags(log.LstdFlags | log.Lshortfile)
+		sp.verbose = true // Debug implies verbose
+	}
+
+	sp.check = &CheckReport{}
+
+	// Targets are checked even if config.toml has errors
+	if err := sp.loadAndValidateConfigFile(sp.configFile, &sp.config, true); err != nil {
+		sp.check.addError(sp.configFile, err)
+	}
+	applyConfigDefaults(&sp.config)
+
+	if err := sp.loadTargetsFiles(&sp.targets); err != nil {
+		sp.check.addError(sp.targetsFile, err)
+	} else if err := sp.validateCompleteTargets(&sp.targets); err != nil {
+		sp.check.addError(sp.targetsFile, err)
+	}
+
+	// The capacity check needs valid settings
+	if len(sp.check.Errors) == 0 {
+		if err := sp.validateConfiguration(sp.config); err != nil {
+			sp.check.addError(sp.configFile, err)
+		}
+	}
+
+	targets := 0
+	for _, org := range sp.targets.Organizations {
+		targets += len(org.Hosts)
+	}
+	sp.check.addHosts(sp.targets)
+	sp.check.finish(append([]string{sp.configFile}, sp.targets.Files...), targets)
+
+	if jsonOutput {
+		sp.check.printJSON(stdout)
+	} else {
+		sp.check.printText(stdout)
+	}
+
+	if !sp.check.Valid {
+		return 1
+	}
+	return 0
+}
+
 // setupSyslog initializes syslog writer for structured logging
 func (sp *SmogPing) setupSyslog() {
 	var err error
@@ -562,6 +863,420 @@ func (sp *SmogPing) getFileContext(filename string, lineNum int) string {
 	return context.String()
 }
 
+// addError adds an error to the check report. Validation and parse errors carry their file, field
+// and line, other errors are reported against file.
+func (r *CheckReport) addError(file string, err error) {
+	issue := CheckIssue{File: file, Message: err.Error()}
+
+	var validationErr *TOMLValidationError
+	var parseErr *TOMLParseError
+	switch {
+	case errors.As(err, &validationErr):
+		issue = CheckIssue{
+			File: validationErr.File, Line: validationErr.Line, Field: validationErr.Field,
+			Value: validationErr.Value, Message: validationErr.Message}
+		if issue.Line == 0 {
+			issue.Line = r.fieldLine(issue.File, issue.Field, issue.Value)
+		}
+	case errors.As(err, &parseErr):
+		issue = CheckIssue{File: parseErr.File, Line: parseErr.Line, Message: parseErr.Message}
+	}
+
+	r.Errors = append(r.Errors, issue)
+}
+
+// addWarning adds a warning about file to the check report, and about a field of it when field is
+// not empty
+func (r *CheckReport) addWarning(file, field, message string) {
+	issue := CheckIssue{File: file, Field: field, Message: message}
+	if field != "" {
+		issue.Line = r.fieldLine(file, field, nil)
+	}
+	r.Warnings = append(r.Warnings, issue)
+}
+
+// addValidator adds the errors and warnings of a validator, those without a file are about file
+func (r *CheckReport) addValidator(file string, validator *ConfigValidator) {
+	for _, err := range validator.GetErrors() {
+		r.addError(file, err)
+	}
+	for _, warning := range validator.GetWarnings() {
+		r.addWarning(cmp.Or(warning.File, file), warning.Field, warning.Message)
+	}
+}
+
+// addHosts adds the hosts of targets with their effective settings to the check report
+func (r *CheckReport) addHosts(targets TargetsConfig) {
+	for orgName, org := range targets.Organizations {
+		for _, host := range org.Hosts {
+			if hostFamily(host) == familyBoth && host.AddressFamily == 6 {
+				continue // Second target of a dual-stack host
+			}
+			r.Hosts = append(r.Hosts, CheckHost{
+				File: host.SourceFile, Line: r.fieldLine(host.SourceFile, host.SourceField, nil),
+				Organization: orgName, Name: host.Name, Settings: host.Settings})
+		}
+	}
+}
+
+// fieldLine returns the line a validation error field is set on in file, or the line of the closest
+// table or array element around it, 0 if there is none
+func (r *CheckReport) fieldLine(file, field string, value interface{}) int {
+	if r.keyLines == nil {
+		r.keyLines = make(map[string]map[string]int)
+	}
+	lines, scanned := r.keyLines[file]
+	if !scanned {
+		if content, err := os.ReadFile(file); err == nil {
+			lines = tomlKeyLines(string(content))
+		}
+		r.keyLines[file] = lines
+	}
+
+	// Errors about table names, like organizations, carry the name as value
+	if name, ok := value.(string); ok && name != "" {
+		if line, exists := lines[field+"."+name]; exists {
+			return line
+		}
+	}
+
+	for key := field; key != ""; key = key[:max(strings.LastIndexAny(key, ".["), 0)] {
+		if line, exists := lines[key]; exists {
+			return line
+		}
+	}
+	return 0
+}
+
+// finish completes the check report, sorting the issues by file, in the order files are loaded, and line
+func (r *CheckReport) finish(files []string, targets int) {
+	r.Valid = len(r.Errors) == 0
+	r.Files = files
+	r.Targets = targets
+
+	rank := make(map[string]int)
+	for _, file := range files {
+		if _, exists := rank[file]; !exists {
+			rank[file] = len(rank)
+		}
+	}
+	for _, issue := range slices.Concat(r.Errors, r.Warnings) {
+		if _, exists := rank[issue.File]; !exists {
+			rank[issue.File] = len(rank)
+		}
+	}
+	byLocation := func(a, b CheckIssue) int {
+		if rank[a.File] != rank[b.File] {
+			return rank[a.File] - rank[b.File]
+		}
+		if a.Line != b.Line {
+			return a.Line - b.Line
+		}
+		return strings.Compare(a.Message, b.Message)
+	}
+	slices.SortStableFunc(r.Errors, byLocation)
+	slices.SortStableFunc(r.Warnings, byLocation)
+	slices.SortStableFunc(r.Hosts, func(a, b CheckHost) int {
+		if rank[a.File] != rank[b.File] {
+			return rank[a.File] - rank[b.File]
+		}
+		if a.Line != b.Line {
+			return a.Line - b.Line
+		}
+		return strings.Compare(a.Organization+"/"+a.Name, b.Organization+"/"+b.Name)
+	})
+
+	// Empty lists rather than null in JSON
+	if r.Errors == nil {
+		r.Errors = []CheckIssue{}
+	}
+	if r.Warnings == nil {
+		r.Warnings = []CheckIssue{}
+	}
+	if r.Hosts == nil {
+		r.Hosts = []CheckHost{}
+	}
+}
+
+// printText prints the effective settings of every host, then one line per error and warning, each
+// prefixed with file and line like compiler messages
+func (r *CheckReport) printText(w io.Writer) {
+	location := func(file string, line int) string {
+		if file != "" && line > 0 {
+			return fmt.Sprintf("%s:%d: ", file, line)
+		} else if file != "" {
+			return file + ": "
+		}
+		return ""
+	}
+	printIssue := func(severity string, issue CheckIssue) {
+		location := location(issue.File, issue.Line)
+		if issue.Field != "" && issue.Value != nil {
+			fmt.Fprintf(w, "%s%s: %s = %v - %s\n", location, severity, issue.Field, issue.Value, issue.Message)
+		} else if issue.Field != "" {
+			fmt.Fprintf(w, "%s%s: %s - %s\n", location, severity, issue.Field, issue.Message)
+		} else {
+			fmt.Fprintf(w, "%s%s: %s\n", location, severity, issue.Message)
+		}
+	}
+	for _, host := range r.Hosts {
+		fmt.Fprintf(w, "%ssettings: %s in %s: %s\n",
+			location(host.File, host.Line), host.Name, host.Organization, formatSettings(host.Settings))
+	}
+	for _, issue := range r.Errors {
+		printIssue("error", issue)
+	}
+	for _, issue := range r.Warnings {
+		printIssue("warning", issue)
+	}
+
+	if r.Valid {
+		fmt.Fprintf(w, "Configuration is valid (targets: %d, files: %d, warnings: %d)\n",
+			r.Targets, len(r.Files), len(r.Warnings))
+	} else {
+		fmt.Fprintf(w, "Configuration is invalid (errors: %d, warnings: %d)\n", len(r.Errors), len(r.Warnings))
+	}
+}
+
+// printJSON prints the check report as JSON
+func (r *CheckReport) printJSON(w io.Writer) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(r)
+}
+
+// tomlIndexPattern matches the array indexes of a key
+var tomlIndexPattern = regexp.MustCompile(`\[\d+\]`)
+
+// tomlKeyLines maps the keys of a TOML document to the lines they are set on. Keys are written like
+// validation error fields, "organizations.Local.hosts[2].alarmping" with the index of array elements,
+// and again without indexes like the undecoded keys toml reports. The scan only follows tables, keys,
+// arrays and inline tables, the document is expected to parse.
+func tomlKeyLines(content string) map[string]int {
+	s := &tomlKeyScanner{src: content, line: 1, lines: make(map[string]int), arrayTables: make(map[string]int)}
+
+	table := ""
+	for {
+		s.skip(true)
+		if s.pos >= len(s.src) {
+			return s.lines
+		}
+		start := s.pos
+		if s.src[s.pos] == '[' {
+			table = s.header()
+		} else {
+			s.keyValue(table)
+		}
+		if s.pos == start {
+			s.pos++ // Never stall on unexpected input
+		}
+	}
+}
+
+// tomlKeyScanner holds the position of tomlKeyLines in the document
+type tomlKeyScanner struct {
+	src         string
+	pos         int
+	line        int
+	lines       map[string]int
+	arrayTables map[string]int // Elements seen of each array of tables
+}
+
+// skip skips spaces and comments, and newlines if newlines is set
+func (s *tomlKeyScanner) skip(newlines bool) {
+	for s.pos < len(s.src) {
+		switch c := s.src[s.pos]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			s.pos++
+		case c == '#':
+			for s.pos < len(s.src) && s.src[s.pos] != '\n' {
+				s.pos++
+			}
+		case c == '\n' && newlines:
+			s.pos++
+			s.line++
+		default:
+			return
+		}
+	}
+}
+
+// record records the line of a key, keeping the first line of keys set more than once
+func (s *tomlKeyScanner) record(key string, line int) {
+	if _, exists := s.lines[key]; !exists {
+		s.lines[key] = line
+	}
+	plain := tomlIndexPattern.ReplaceAllString(key, "")
+	if _, exists := s.lines[plain]; !exists {
+		s.lines[plain] = line
+	}
+}
+
+// header reads a [table] or [[array of tables]] header and returns the key of the table
+func (s *tomlKeyScanner) header() string {
+	line := s.line
+	brackets := 1
+	if strings.HasPrefix(s.src[s.pos:], "[[") {
+		brackets = 2
+	}
+	s.pos += brackets
+
+	key := s.key()
+	if brackets == 2 {
+		index := s.arrayTables[key]
+		s.arrayTables[key]++
+		key = fmt.Sprintf("%s[%d]", key, index)
+	}
+	for i := 0; i < brackets && s.pos < len(s.src) && s.src[s.pos] == ']'; i++ {
+		s.pos++
+	}
+
+	s.record(key, line)
+	return key
+}
+
+// key reads a dotted key of bare and quoted parts
+func (s *tomlKeyScanner) key() string {
+	var parts []string
+	for {
+		s.skip(false)
+		parts = append(parts, s.keyPart())
+		s.skip(false)
+		if s.pos >= len(s.src) || s.src[s.pos] != '.' {
+			return strings.Join(parts, ".")
+		}
+		s.pos++
+	}
+}
+
+// keyPart reads a bare or quoted key
+func (s *tomlKeyScanner) keyPart() string {
+	start := s.pos
+	if s.pos < len(s.src) && (s.src[s.pos] == '"' || s.src[s.pos] == '\'') {
+		s.str()
+		part := s.src[start:s.pos]
+		if unquoted, err := strconv.Unquote(part); err == nil && part[0] == '"' {
+			return unquoted
+		}
+		return strings.Trim(part, `"'`)
+	}
+
+	for s.pos < len(s.src) {
+		c := s.src[s.pos]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			break
+		}
+		s.pos++
+	}
+	return s.src[start:s.pos]
+}
+
+// keyValue reads a key/value pair in table
+func (s *tomlKeyScanner) keyValue(table string) {
+	line := s.line
+	key := s.key()
+	if table != "" {
+		key = table + "." + key
+	}
+	s.record(key, line)
+
+	if s.pos < len(s.src) && s.src[s.pos] == '=' {
+		s.pos++
+	}
+	s.value(key)
+}
+
+// value reads the value of key, recording the elements of arrays and the keys of inline tables
+func (s *tomlKeyScanner) value(key string) {
+	s.skip(false)
+	if s.pos >= len(s.src) {
+		return
+	}
+
+	switch s.src[s.pos] {
+	case '[':
+		s.pos++
+		for i := 0; ; i++ {
+			s.skip(true)
+			if s.pos >= len(s.src) {
+				return
+			}
+			if s.src[s.pos] == ']' {
+				s.pos++
+				return
+			}
+			start := s.pos
+			element := fmt.Sprintf("%s[%d]", key, i)
+			s.record(element, s.line)
+			s.value(element)
+			s.skip(true)
+			if s.pos < len(s.src) && s.src[s.pos] == ',' {
+				s.pos++
+			} else if s.pos == start {
+				s.pos++
+			}
+		}
+	case '{':
+		s.pos++
+		for {
+			s.skip(true)
+			if s.pos >= len(s.src) {
+				return
+			}
+			if s.src[s.pos] == '}' {
+				s.pos++
+				return
+			}
+			start := s.pos
+			s.keyValue(key)
+			s.skip(true)
+			if s.pos < len(s.src) && s.src[s.pos] == ',' {
+				s.pos++
+			} else if s.pos == start {
+				s.pos++
+			}
+		}
+	case '"', '\'':
+		s.str()
+	default:
+		for s.pos < len(s.src) && !strings.ContainsRune(",]}\n#", rune(s.src[s.pos])) {
+			s.pos++
+		}
+	}
+}
+
+// str reads a basic or literal string, multi-line strings included
+func (s *tomlKeyScanner) str() {
+	quote := s.src[s.pos]
+	delimiter := string(quote)
+	if strings.HasPrefix(s.src[s.pos:], strings.Repeat(delimiter, 3)) {
+		delimiter = strings.Repeat(delimiter, 3)
+	}
+	s.pos += len(delimiter)
+
+	for s.pos < len(s.src) {
+		switch {
+		case s.src[s.pos] == '\\' && quote == '"':
+			if s.pos+1 < len(s.src) && s.src[s.pos+1] == '\n' {
+				s.line++
+			}
+			s.pos += 2
+			continue
+		case strings.HasPrefix(s.src[s.pos:], delimiter):
+			s.pos += len(delimiter)
+			// Multi-line strings may end with one or two quotes of their own
+			for len(delimiter) == 3 && s.pos < len(s.src) && s.src[s.pos] == quote {
+				s.pos++
+			}
+			return
+		case s.src[s.pos] == '\n':
+			s.line++
+		}
+		s.pos++
+	}
+	s.pos = len(s.src)
+}
+
 // validateTOMLStructure validates the TOML file structure and reports unknown fields
 func (sp *SmogPing) validateTOMLStructure(filename string, metadata toml.MetaData, isDefault bool) error {
 	validator := &ConfigValidator{}
@@ -579,13 +1294,19 @@ func (sp *SmogPing) validateTOMLStructure(filename string, metadata toml.MetaDat
 			})
 		} else {
 			// Override config warns about unknown fields but doesn't fail
-			validator.AddWarning(fmt.Sprintf("Unknown field '%s' in %s will be ignored", keyStr, filename))
+			validator.AddFieldWarning(filename, keyStr, fmt.Sprintf("Unknown field '%s' in %s will be ignored", keyStr, filename))
 		}
 	}
 
+	// A check reports every error and warning and carries on loading
+	if sp.check != nil {
+		sp.check.addValidator(filename, validator)
+		return nil
+	}
+
 	// Report warnings
 	for _, warning := range validator.GetWarnings() {
-		sp.verbosef("TOML Warning: %s", warning)
+		sp.verbosef("TOML Warning: %s", warning.Message)
 	}
 
 	// Return errors if any
@@ -601,12 +1322,8 @@ func (sp *SmogPing) validateConfigFields(filename string, config *Config, isDefa
 	validator := &ConfigValidator{}
 
 	// Required fields validation (for default config)
-	if isDefault {
-		if config.InfluxURL == "" {
-			validator.AddError(&TOMLValidationError{
-				File: filename, Field: "influx_url", Value: config.InfluxURL,
-				Message: "InfluxDB URL cannot be empty"})
-		}
+	// InfluxDB output is optional, an empty influx_url disables it
+	if isDefault && config.InfluxURL != "" {
 		if config.InfluxOrg == "" {
 			validator.AddError(&TOMLValidationError{
 				File: filename, Field: "influx_org", Value: config.InfluxOrg,
@@ -676,6 +1393,23 @@ func (sp *SmogPing) validateConfigFields(filename string, config *Config, isDefa
 			Message: "must be between 1 and 1000"})
 	}
 
+	// Validate default alarm thresholds
+	if config.AlarmPing < 0 || config.AlarmPing > 10000 {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: "alarm_ping", Value: config.AlarmPing,
+			Message: "alarm ping threshold must be between 0 and 10000 ms"})
+	}
+	if config.AlarmLoss < 0 || config.AlarmLoss > 100 {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: "alarm_loss", Value: config.AlarmLoss,
+			Message: "alarm loss threshold must be between 0 and 100 percent"})
+	}
+	if config.AlarmJitter < 0 || config.AlarmJitter > 10000 {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: "alarm_jitter", Value: config.AlarmJitter,
+			Message: "alarm jitter threshold must be between 0 and 10000 ms"})
+	}
+
 	// Validate ping_source (must be "default" or a valid IP address)
 	if config.PingSource != "" && config.PingSource != "default" {
 		if net.ParseIP(config.PingSource) == nil {
@@ -685,24 +1419,111 @@ func (sp *SmogPing) validateConfigFields(filename string, config *Config, isDefa
 		}
 	}
 
-	// Logical validations
-	if config.PingTimeout >= config.DataPointTime {
-		validator.AddWarning(fmt.Sprintf("ping_timeout (%d) should be less than data_point_time (%d)",
-			config.PingTimeout, config.DataPointTime))
+	// Validate InfluxDB spool settings
+	if config.InfluxSpoolMaxMB < 0 || config.InfluxSpoolMaxMB > 100000 {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: "influx_spool_max_mb", Value: config.InfluxSpoolMaxMB,
+			Message: "must be between 0 and 100000 (0 uses the default of 100)"})
 	}
 
-	// Report warnings
-	for _, warning := range validator.GetWarnings() {
-		sp.verbosef("Config Warning: %s", warning)
+	// Validate RTT distribution fields
+	seenStats := make(map[string]bool)
+	for _, stat := range config.RTTStats {
+		switch stat {
+		case "min", "max", "median":
+		default:
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: "rtt_stats", Value: stat,
+				Message: "must be one of 'min', 'max' or 'median'"})
+		}
+		if seenStats[stat] {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: "rtt_stats", Value: stat,
+				Message: "listed more than once"})
+		}
+		seenStats[stat] = true
+	}
+	seenPercentiles := make(map[int]bool)
+	for _, percentile := range config.RTTPercentiles {
+		if percentile < 1 || percentile > 99 {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: "rtt_percentiles", Value: percentile,
+				Message: "must be between 1 and 99"})
+		}
+		if seenPercentiles[percentile] {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: "rtt_percentiles", Value: percentile,
+				Message: "listed more than once"})
+		}
+		seenPercentiles[percentile] = true
 	}
 
-	// Return first error if any
-	if validator.HasErrors() {
-		return validator.GetErrors()[0]
+	// Validate Prometheus exporter listen address
+	if config.MetricsListen != "" && strings.ToLower(config.MetricsListen) != "none" {
+		if _, port, err := net.SplitHostPort(config.MetricsListen); err != nil || port == "" {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: "metrics_listen", Value: config.MetricsListen,
+				Message: "must be 'none' or a listen address such as ':9108' or '127.0.0.1:9108'"})
+		}
 	}
 
-	return nil
-}
+	// Validate alarm webhook settings
+	if config.AlarmWebhook != "" && strings.ToLower(config.AlarmWebhook) != "none" && !isValidURL(config.AlarmWebhook) {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: "alarm_webhook", Value: config.AlarmWebhook,
+			Message: "must be 'none' or a valid http(s) URL"})
+	}
+
+	if config.AlarmWebhookTimeout < 0 || config.AlarmWebhookTimeout > 300 {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: "alarm_webhook_timeout", Value: config.AlarmWebhookTimeout,
+			Message: "must be between 0 and 300 seconds"})
+	}
+
+	if config.AlarmWebhookRetries < 0 || config.AlarmWebhookRetries > 10 {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: "alarm_webhook_retries", Value: config.AlarmWebhookRetries,
+			Message: "must be between 0 and 10"})
+	}
+
+	if config.AlarmWebhookBackoff < 0 || config.AlarmWebhookBackoff > 300 {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: "alarm_webhook_backoff", Value: config.AlarmWebhookBackoff,
+			Message: "must be between 0 and 300 seconds"})
+	}
+
+	for name := range config.AlarmWebhookHeaders {
+		if name == "" || strings.ContainsAny(name, " :\r\n") {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: "alarm_webhook_headers", Value: name,
+				Message: "invalid HTTP header name"})
+		}
+	}
+
+	// Logical validations
+	if config.PingTimeout >= config.DataPointTime {
+		validator.AddFieldWarning(filename, "ping_timeout", fmt.Sprintf("ping_timeout (%d) should be less than data_point_time (%d)",
+			config.PingTimeout, config.DataPointTime))
+	}
+
+	// A check reports every error and warning and carries on loading
+	if sp.check != nil {
+		sp.check.addValidator(filename, validator)
+		return nil
+	}
+
+	// Report warnings
+	for _, warning := range validator.GetWarnings() {
+		sp.verbosef("Config Warning: %s", warning.Message)
+	}
+
+	// Return first error if any
+	if validator.HasErrors() {
+		return validator.GetErrors()[0]
+	}
+
+	return nil
+}
 
 // isValidURL validates URL format
 func isValidURL(urlStr string) bool {
@@ -727,47 +1548,13 @@ func isValidURL(urlStr string) bool {
 func (sp *SmogPing) loadTargets() error {
 	sp.debugf("Loading target configuration from: %s", sp.targetsFile)
 
-	// Load main targets file with validation
-	if err := sp.loadAndValidateTargetsFile(sp.targetsFile, &sp.targets, true); err != nil {
-		return fmt.Errorf("failed to load targets: %w", err)
-	}
-	sp.debugf("Loaded and validated %s", sp.targetsFile)
-
-	// Load included files with validation
-	for _, includeFile := range sp.targets.Include {
-		// Resolve relative paths based on the main targets file directory
-		resolvedIncludeFile := includeFile
-		if !filepath.IsAbs(includeFile) {
-			// Make relative paths relative to the main targets file directory
-			targetsDir := filepath.Dir(sp.targetsFile)
-			resolvedIncludeFile = filepath.Join(targetsDir, includeFile)
-		}
-
-		sp.debugf("Loading included file: %s (resolved from %s)", resolvedIncludeFile, includeFile)
-		var includedTargets TargetsConfig
-
-		if err := sp.loadAndValidateTargetsFile(resolvedIncludeFile, &includedTargets, false); err != nil {
-			sp.syslogWarning("Failed to load included file %s: %v", resolvedIncludeFile, err)
-			log.Printf("Warning: failed to load included file %s: %v", resolvedIncludeFile, err)
-			continue
-		}
-
-		// Merge organizations
-		for orgName, org := range includedTargets.Organizations {
-			if existingOrg, exists := sp.targets.Organizations[orgName]; exists {
-				// Merge hosts
-				existingOrg.Hosts = append(existingOrg.Hosts, org.Hosts...)
-				sp.targets.Organizations[orgName] = existingOrg
-				sp.debugf("Merged %d hosts into existing organization %s", len(org.Hosts), orgName)
-			} else {
-				sp.targets.Organizations[orgName] = org
-				sp.debugf("Added new organization %s with %d hosts", orgName, len(org.Hosts))
-			}
-		}
+	// Load main targets file and included files with validation
+	if err := sp.loadTargetsFiles(&sp.targets); err != nil {
+		return err
 	}
 
 	// Final validation of complete targets configuration
-	if err := sp.validateCompleteTargets(); err != nil {
+	if err := sp.validateCompleteTargets(&sp.targets); err != nil {
 		return fmt.Errorf("complete targets validation failed: %w", err)
 	}
 
@@ -804,8 +1591,120 @@ func (sp *SmogPing) loadTargets() error {
 	return nil
 }
 
+// loadTargetsFiles loads the main targets file and the files it includes, directly or through
+// included files, into targets. Startup and reload share it so both resolve includes alike.
+func (sp *SmogPing) loadTargetsFiles(targets *TargetsConfig) error {
+	if err := sp.loadAndValidateTargetsFile(sp.targetsFile, targets, nil, true); err != nil {
+		return fmt.Errorf("failed to load targets: %w", err)
+	}
+	sp.debugf("Loaded and validated %s", sp.targetsFile)
+
+	if targets.Organizations == nil {
+		targets.Organizations = make(map[string]Organization)
+	}
+	targets.Files = []string{sp.targetsFile}
+	targets.IncludePatterns = nil
+	targets.FailedFiles = nil
+
+	mainFile, _ := filepath.Abs(sp.targetsFile)
+	loaded := map[string]bool{mainFile: true}
+	sp.loadIncludes(sp.targetsFile, targets.Include, targets, loaded, []string{mainFile})
+	return nil
+}
+
+// loadIncludes loads the files included by a targets file and merges their organizations into
+// targets, following their includes in turn. chain holds the files including this one, an
+// include back into the chain is a cycle and skipped, as are files that are already loaded.
+func (sp *SmogPing) loadIncludes(filename string, includes []string, targets *TargetsConfig, loaded map[string]bool, chain []string) {
+	files, patterns := resolveIncludes(filename, includes)
+	targets.IncludePatterns = append(targets.IncludePatterns, patterns...)
+
+	for _, includeFile := range files {
+		absFile, _ := filepath.Abs(includeFile)
+		if slices.Contains(chain, absFile) {
+			if sp.check != nil {
+				sp.check.addWarning(filename, "include", fmt.Sprintf("Include cycle: %s includes %s, which is still being loaded, skipping", filename, includeFile))
+				continue
+			}
+			sp.syslogWarning("Include cycle: %s includes %s, which is still being loaded, skipping", filename, includeFile)
+			log.Printf("Warning: include cycle: %s includes %s, which is still being loaded, skipping", filename, includeFile)
+			continue
+		}
+		if loaded[absFile] {
+			sp.debugf("Skipping %s included by %s, already loaded", includeFile, filename)
+			continue
+		}
+		loaded[absFile] = true
+
+		sp.debugf("Loading included file: %s (included by %s)", includeFile, filename)
+		var includedTargets TargetsConfig
+		if err := sp.loadAndValidateTargetsFile(includeFile, &includedTargets, targets.Profiles, false); err != nil {
+			// Startup skips broken included files, a check fails on them
+			if sp.check != nil {
+				sp.check.addError(includeFile, err)
+				continue
+			}
+			sp.syslogWarning("Failed to load included file %s: %v", includeFile, err)
+			log.Printf("Warning: failed to load included file %s: %v", includeFile, err)
+			targets.FailedFiles = append(targets.FailedFiles, includeFile)
+			continue
+		}
+		targets.Files = append(targets.Files, includeFile)
+
+		// Merge organizations
+		for orgName, org := range includedTargets.Organizations {
+			if existingOrg, exists := targets.Organizations[orgName]; exists {
+				// Merge hosts
+				existingOrg.Hosts = append(existingOrg.Hosts, org.Hosts...)
+				targets.Organizations[orgName] = existingOrg
+				sp.debugf("Merged %d hosts into existing organization %s", len(org.Hosts), orgName)
+			} else {
+				targets.Organizations[orgName] = org
+				sp.debugf("Added new organization %s with %d hosts", orgName, len(org.Hosts))
+			}
+		}
+
+		sp.loadIncludes(includeFile, includedTargets.Include, targets, loaded, append(chain, absFile))
+	}
+}
+
+// resolveIncludes expands the include entries of a targets file to the files they name, in order.
+// Relative entries are relative to the including file. Glob patterns include the files they match
+// and directories their *.toml files, both sorted by name. The glob patterns, including those of
+// directories, are returned too so new matching files can be watched for.
+func resolveIncludes(filename string, includes []string) (files, patterns []string) {
+	for _, include := range includes {
+		path := include
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(filename), path)
+		}
+
+		pattern := ""
+		if strings.ContainsAny(path, "*?[") {
+			pattern = path
+		} else if info, err := os.Stat(path); err == nil && info.IsDir() {
+			pattern = filepath.Join(path, "*.toml")
+		}
+		if pattern == "" {
+			files = append(files, path) // Missing files are reported when they are loaded
+			continue
+		}
+
+		patterns = append(patterns, pattern)
+		matches, _ := filepath.Glob(pattern) // Patterns are validated with the targets file
+		sort.Strings(matches)
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && !info.IsDir() {
+				files = append(files, match)
+			}
+		}
+	}
+	return files, patterns
+}
+
 // loadAndValidateTargetsFile loads a TOML targets file with comprehensive validation
-func (sp *SmogPing) loadAndValidateTargetsFile(filename string, targets *TargetsConfig, isMain bool) error {
+// Included files are passed the profiles of the main targets file.
+func (sp *SmogPing) loadAndValidateTargetsFile(filename string, targets *TargetsConfig, mainProfiles map[string]Host, isMain bool) error {
 	// Check if file exists and is readable
 	if _, err := os.Stat(filename); err != nil {
 		if isMain {
@@ -830,15 +1729,95 @@ func (sp *SmogPing) loadAndValidateTargetsFile(filename string, targets *Targets
 		return err
 	}
 
+	// Remember where each host is set, for warnings found once all files are merged
+	for orgName, org := range targets.Organizations {
+		for i := range org.Hosts {
+			org.Hosts[i].SourceFile = filename
+			org.Hosts[i].SourceField = fmt.Sprintf("organizations.%s.hosts[%d]", orgName, i)
+		}
+	}
+	if err := recordDefinedKeys(filename, targets); err != nil {
+		return sp.enhanceTOMLError(filename, err)
+	}
+
+	// Profiles of this file and the main targets file
+	profiles := make(map[string]Host, len(mainProfiles)+len(targets.Profiles))
+	for name, profile := range mainProfiles {
+		profiles[name] = profile
+	}
+	for name, profile := range targets.Profiles {
+		if _, exists := mainProfiles[name]; exists {
+			err := &TOMLValidationError{
+				File: filename, Field: "profiles." + name, Value: name,
+				Message: "profile is already defined in the main targets file"}
+			if sp.check == nil {
+				return err
+			}
+			sp.check.addError(filename, err)
+			continue
+		}
+		profiles[name] = profile
+	}
+
 	// Validate targets content
-	if err := sp.validateTargetsContent(filename, targets, isMain); err != nil {
+	if err := sp.validateTargetsContent(filename, targets, profiles, isMain); err != nil {
 		return err
 	}
 
+	// Record where the settings of each host come from before they are inherited
+	config := sp.currentConfig()
+	for orgName, org := range targets.Organizations {
+		for i := range org.Hosts {
+			host := &org.Hosts[i]
+			host.Settings = effectiveSettings(*host, profiles, org.Defaults, config)
+			sp.verbosef("Effective settings of %s in %s: %s", host.Name, orgName, formatSettings(host.Settings))
+		}
+	}
+
+	// Profiles and organization settings apply to the hosts defined in the same file
+	applyProfiles(targets, profiles)
+	applyOrganizationSettings(targets)
+	expandAddressFamilies(targets)
+
 	sp.debugf("Successfully loaded and validated %s", filename)
 	return nil
 }
 
+// recordDefinedKeys stores the keys each host and profile of a targets file sets in DefinedKeys.
+// The file is decoded again as plain tables, as the metadata of toml does not tell the elements
+// of an inline array of hosts apart.
+func recordDefinedKeys(filename string, targets *TargetsConfig) error {
+	var raw struct {
+		Profiles      map[string]map[string]interface{} `toml:"profiles"`
+		Organizations map[string]struct {
+			Hosts []map[string]interface{} `toml:"hosts"`
+		} `toml:"organizations"`
+	}
+	if _, err := toml.DecodeFile(filename, &raw); err != nil {
+		return err
+	}
+
+	definedKeys := func(table map[string]interface{}) map[string]bool {
+		keys := make(map[string]bool, len(table))
+		for key := range table {
+			keys[key] = true
+		}
+		return keys
+	}
+	for name, profile := range targets.Profiles {
+		profile.DefinedKeys = definedKeys(raw.Profiles[name])
+		targets.Profiles[name] = profile
+	}
+	for orgName, org := range targets.Organizations {
+		for i := range org.Hosts {
+			if i < len(raw.Organizations[orgName].Hosts) {
+				org.Hosts[i].DefinedKeys = definedKeys(raw.Organizations[orgName].Hosts[i])
+			}
+		}
+	}
+	return nil
+}
+
 // validateTargetsTOMLStructure validates the targets TOML file structure
 func (sp *SmogPing) validateTargetsTOMLStructure(filename string, metadata toml.MetaData, isMain bool) error {
 	validator := &ConfigValidator{}
@@ -856,10 +1835,16 @@ func (sp *SmogPing) validateTargetsTOMLStructure(filename string, metadata toml.
 			})
 		} else {
 			// Include files warn about unknown fields
-			validator.AddWarning(fmt.Sprintf("Unknown field '%s' in %s will be ignored", keyStr, filename))
+			validator.AddFieldWarning(filename, keyStr, fmt.Sprintf("Unknown field '%s' in %s will be ignored", keyStr, filename))
 		}
 	}
 
+	// A check reports every error and warning and carries on loading
+	if sp.check != nil {
+		sp.check.addValidator(filename, validator)
+		return nil
+	}
+
 	// Report warnings
 	for _, warning := range validator.GetWarnings() {
 		sp.verbosef("Targets Warning: %s", warning)
@@ -874,50 +1859,71 @@ func (sp *SmogPing) validateTargetsTOMLStructure(filename string, metadata toml.
 }
 
 // validateTargetsContent validates the content of targets configuration
-func (sp *SmogPing) validateTargetsContent(filename string, targets *TargetsConfig, isMain bool) error {
+func (sp *SmogPing) validateTargetsContent(filename string, targets *TargetsConfig, profiles map[string]Host, isMain bool) error {
 	validator := &ConfigValidator{}
 
-	// Validate include files (only in main targets file)
-	if isMain {
-		for _, includeFile := range targets.Include {
-			if includeFile == "" {
-				validator.AddError(&TOMLValidationError{
-					File: filename, Field: "include", Value: includeFile,
-					Message: "include file path cannot be empty"})
-				continue
-			}
+	// Validate include entries, files, directories or glob patterns relative to this file
+	for _, includeFile := range targets.Include {
+		if includeFile == "" {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: "include", Value: includeFile,
+				Message: "include file path cannot be empty"})
+			continue
+		}
 
-			// Resolve relative paths for validation
-			resolvedIncludeFile := includeFile
-			if !filepath.IsAbs(includeFile) {
-				// Make relative paths relative to the main targets file directory
-				targetsDir := filepath.Dir(filename)
-				resolvedIncludeFile = filepath.Join(targetsDir, includeFile)
-			}
+		// Resolve relative paths for validation
+		resolvedIncludeFile := includeFile
+		if !filepath.IsAbs(includeFile) {
+			// Make relative paths relative to the directory of the including file
+			targetsDir := filepath.Dir(filename)
+			resolvedIncludeFile = filepath.Join(targetsDir, includeFile)
+		}
 
-			// Check if resolved include file path is reasonable
-			if !isValidFilePath(resolvedIncludeFile) {
-				validator.AddError(&TOMLValidationError{
-					File: filename, Field: "include", Value: includeFile,
-					Message: fmt.Sprintf("invalid include file path (resolved to: %s)", resolvedIncludeFile)})
-			}
+		if _, err := filepath.Match(resolvedIncludeFile, ""); err != nil {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: "include", Value: includeFile,
+				Message: fmt.Sprintf("invalid glob pattern: %v", err)})
+			continue
+		}
+
+		// Directories include their *.toml files
+		if info, err := os.Stat(resolvedIncludeFile); err == nil && info.IsDir() {
+			continue
+		}
+
+		// Check if resolved include file path is reasonable
+		if !isValidFilePath(resolvedIncludeFile) {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: "include", Value: includeFile,
+				Message: fmt.Sprintf("invalid include file path (resolved to: %s)", resolvedIncludeFile)})
 		}
 	}
 
 	// Validate organizations
-	if len(targets.Organizations) == 0 && isMain {
+	if len(targets.Organizations) == 0 && len(targets.Include) == 0 && isMain {
 		validator.AddError(&TOMLValidationError{
 			File: filename, Field: "organizations", Value: len(targets.Organizations),
-			Message: "at least one organization must be defined"})
+			Message: "at least one organization or include must be defined"})
+	}
+
+	// Validate the profiles defined in this file
+	for name, profile := range targets.Profiles {
+		sp.validateProfile(filename, name, profile, validator)
 	}
 
 	// Validate each organization
 	for orgName, org := range targets.Organizations {
-		if err := sp.validateOrganization(filename, orgName, org, validator); err != nil {
+		if err := sp.validateOrganization(filename, orgName, org, profiles, validator); err != nil {
 			return err
 		}
 	}
 
+	// A check reports every error and warning and carries on loading
+	if sp.check != nil {
+		sp.check.addValidator(filename, validator)
+		return nil
+	}
+
 	// Return first error if any
 	if validator.HasErrors() {
 		return validator.GetErrors()[0]
@@ -927,7 +1933,7 @@ func (sp *SmogPing) validateTargetsContent(filename string, targets *TargetsConf
 }
 
 // validateOrganization validates an individual organization configuration
-func (sp *SmogPing) validateOrganization(filename, orgName string, org Organization, validator *ConfigValidator) error {
+func (sp *SmogPing) validateOrganization(filename, orgName string, org Organization, profiles map[string]Host, validator *ConfigValidator) error {
 	// Organization name validation
 	if orgName == "" {
 		validator.AddError(&TOMLValidationError{
@@ -948,9 +1954,52 @@ func (sp *SmogPing) validateOrganization(filename, orgName string, org Organizat
 			Message: "organization name contains invalid characters"})
 	}
 
+	// Errors of the organization settings below, which hosts inherit
+	errorsBefore := len(validator.GetErrors())
+
+	// Organization-wide M-of-N alarm evaluation validation
+	sp.validateAlarmCountWindow(filename, "organizations."+orgName, org.AlarmCount, org.AlarmWindow, validator)
+
+	// Organization defaults validation
+	defaultsPrefix := "organizations." + orgName + ".defaults"
+	sp.validateAlarmThresholds(filename, defaultsPrefix, org.Defaults.AlarmPing, org.Defaults.AlarmLoss, org.Defaults.AlarmJitter, validator)
+	if len(org.Defaults.AlarmReceiver) > 500 {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: defaultsPrefix + ".alarmreceiver", Value: org.Defaults.AlarmReceiver,
+			Message: "alarm receiver too long (max 500 characters)"})
+	}
+	if org.Defaults.PingSource != "" && org.Defaults.PingSource != "default" && net.ParseIP(org.Defaults.PingSource) == nil {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: defaultsPrefix + ".pingsource", Value: org.Defaults.PingSource,
+			Message: "must be 'default' or a valid IP address"})
+	}
+
+	// Organization tags validation
+	sp.validateTags(filename, "organizations."+orgName, org.Tags, validator)
+
+	// Organization-wide sampling validation
+	sp.validateSampling(filename, "organizations."+orgName, org.DataPointPings, org.DataPointTime, org.PingTimeout, validator)
+
+	// Organization-wide roll-up alarm validation
+	if org.BackendsDown < 0 || org.BackendsDown > maxBackends {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: "organizations." + orgName + ".backendsdown", Value: org.BackendsDown,
+			Message: fmt.Sprintf("must be between 0 and %d addresses", maxBackends)})
+	}
+
+	// Organization-wide address family validation
+	if !isValidFamily(org.Family) {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: "organizations." + orgName + ".family", Value: org.Family,
+			Message: "must be 'ipv4', 'ipv6' or 'both'"})
+	}
+
+	// Settings hosts inherit are reported once when invalid, not again with every host
+	inheritedValid := len(validator.GetErrors()) == errorsBefore
+
 	// Hosts validation
 	if len(org.Hosts) == 0 {
-		validator.AddWarning(fmt.Sprintf("Organization '%s' has no hosts defined", orgName))
+		validator.AddFieldWarning(filename, "organizations."+orgName, fmt.Sprintf("Organization '%s' has no hosts defined", orgName))
 		return nil
 	}
 
@@ -964,7 +2013,34 @@ func (sp *SmogPing) validateOrganization(filename, orgName string, org Organizat
 	hostNames := make(map[string]bool)
 	hostIPs := make(map[string]bool)
 
+	config := sp.currentConfig()
 	for i, host := range org.Hosts {
+		// Validate hosts with the settings they take from their profiles
+		for _, name := range host.Profile {
+			if _, exists := profiles[name]; !exists {
+				validator.AddError(&TOMLValidationError{
+					File: filename, Field: fmt.Sprintf("organizations.%s.hosts[%d].profile", orgName, i), Value: name,
+					Message: "unknown profile"})
+			}
+		}
+		mergeProfiles(&host, profiles)
+
+		// Validate hosts with the family, alarmcount, alarmwindow and defaults they inherit from the
+		// organization and config.toml, so a host alarmcount is checked against the organization alarmwindow
+		if inheritedValid {
+			if host.Family == "" {
+				host.Family = org.Family
+			}
+			if host.AlarmCount == 0 {
+				host.AlarmCount = org.AlarmCount
+			}
+			if host.AlarmWindow == 0 {
+				host.AlarmWindow = org.AlarmWindow
+			}
+			inheritHostDefaults(&host, org.Defaults)
+			host.Tags = mergeTags(host.Tags, org.Tags)
+		}
+		host = hostWithDefaults(host, config)
 		if err := sp.validateHost(filename, orgName, i, host, validator); err != nil {
 			return err
 		}
@@ -979,8 +2055,9 @@ func (sp *SmogPing) validateOrganization(filename, orgName string, org Organizat
 
 		// Check for duplicate IPs within organization (warning only)
 		if hostIPs[host.IP] {
-			validator.AddWarning(fmt.Sprintf("Duplicate IP address '%s' for host '%s' in organization '%s'",
-				host.IP, host.Name, orgName))
+			validator.AddFieldWarning(filename, fmt.Sprintf("organizations.%s.hosts[%d].ip", orgName, i),
+				fmt.Sprintf("Duplicate IP address '%s' for host '%s' in organization '%s'",
+					host.IP, host.Name, orgName))
 		}
 		hostIPs[host.IP] = true
 	}
@@ -988,6 +2065,40 @@ func (sp *SmogPing) validateOrganization(filename, orgName string, org Organizat
 	return nil
 }
 
+// validateProfile validates a named profile, the settings it passes on are validated again
+// with every host that uses it
+func (sp *SmogPing) validateProfile(filename, name string, profile Host, validator *ConfigValidator) {
+	fieldPrefix := "profiles." + name
+
+	if !isValidName(name) {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: "profiles", Value: name,
+			Message: "profile name contains invalid characters"})
+	}
+
+	// Profiles hold settings only, not targets
+	if profile.Name != "" {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".name", Value: profile.Name,
+			Message: "cannot be set in a profile"})
+	}
+	if profile.IP != "" {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".ip", Value: profile.IP,
+			Message: "cannot be set in a profile"})
+	}
+	if len(profile.Profile) > 0 {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".profile", Value: strings.Join(profile.Profile, ", "),
+			Message: "profiles cannot use other profiles"})
+	}
+
+	sp.validateAlarmThresholds(filename, fieldPrefix, profile.AlarmPing, profile.AlarmLoss, profile.AlarmJitter, validator)
+	sp.validateAlarmCountWindow(filename, fieldPrefix, profile.AlarmCount, profile.AlarmWindow, validator)
+	sp.validateSampling(filename, fieldPrefix, profile.DataPointPings, profile.DataPointTime, profile.PingTimeout, validator)
+	sp.validateTags(filename, fieldPrefix, profile.Tags, validator)
+}
+
 // validateHost validates an individual host configuration
 func (sp *SmogPing) validateHost(filename, orgName string, index int, host Host, validator *ConfigValidator) error {
 	fieldPrefix := fmt.Sprintf("organizations.%s.hosts[%d]", orgName, index)
@@ -1032,23 +2143,69 @@ func (sp *SmogPing) validateHost(filename, orgName string, index int, host Host,
 	}
 
 	// Alarm threshold validation
-	if host.AlarmPing < 0 || host.AlarmPing > 10000 {
-		validator.AddError(&TOMLValidationError{
-			File: filename, Field: fieldPrefix + ".alarmping", Value: host.AlarmPing,
-			Message: "alarm ping threshold must be between 0 and 10000 ms"})
+	sp.validateAlarmThresholds(filename, fieldPrefix, host.AlarmPing, host.AlarmLoss, host.AlarmJitter, validator)
+
+	// Warning threshold validation (must stay below the alarm threshold when both are set)
+	warnThresholds := []struct {
+		field   string
+		warning int
+		alarm   int
+		max     int
+		unit    string
+	}{
+		{"warnping", host.WarnPing, host.AlarmPing, 10000, "ms"},
+		{"warnloss", host.WarnLoss, host.AlarmLoss, 100, "percent"},
+		{"warnjitter", host.WarnJitter, host.AlarmJitter, 10000, "ms"},
+	}
+	for _, threshold := range warnThresholds {
+		if threshold.warning < 0 || threshold.warning > threshold.max {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + "." + threshold.field, Value: threshold.warning,
+				Message: fmt.Sprintf("warning threshold must be between 0 and %d %s", threshold.max, threshold.unit)})
+		} else if threshold.warning > 0 && threshold.alarm > 0 && threshold.warning >= threshold.alarm {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + "." + threshold.field, Value: threshold.warning,
+				Message: fmt.Sprintf("warning threshold must be lower than the alarm threshold (%d)", threshold.alarm)})
+		}
 	}
 
-	if host.AlarmLoss < 0 || host.AlarmLoss > 100 {
-		validator.AddError(&TOMLValidationError{
-			File: filename, Field: fieldPrefix + ".alarmloss", Value: host.AlarmLoss,
-			Message: "alarm loss threshold must be between 0 and 100 percent"})
+	// Clear threshold validation (must not be above the lowest raise threshold)
+	clearThresholds := []struct {
+		field   string
+		clear   int
+		warning int
+		alarm   int
+		max     int
+		unit    string
+	}{
+		{"clearping", host.ClearPing, host.WarnPing, host.AlarmPing, 10000, "ms"},
+		{"clearloss", host.ClearLoss, host.WarnLoss, host.AlarmLoss, 100, "percent"},
+		{"clearjitter", host.ClearJitter, host.WarnJitter, host.AlarmJitter, 10000, "ms"},
+	}
+	for _, threshold := range clearThresholds {
+		lowest := threshold.alarm
+		if threshold.warning > 0 {
+			lowest = threshold.warning
+		}
+		if threshold.clear < 0 || threshold.clear > threshold.max {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + "." + threshold.field, Value: threshold.clear,
+				Message: fmt.Sprintf("clear threshold must be between 0 and %d %s", threshold.max, threshold.unit)})
+		} else if threshold.clear > 0 && lowest > 0 && threshold.clear > lowest {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + "." + threshold.field, Value: threshold.clear,
+				Message: fmt.Sprintf("clear threshold must not be above the lowest alarm threshold (%d)", lowest)})
+		}
 	}
 
-	if host.AlarmJitter < 0 || host.AlarmJitter > 10000 {
-		validator.AddError(&TOMLValidationError{
-			File: filename, Field: fieldPrefix + ".alarmjitter", Value: host.AlarmJitter,
-			Message: "alarm jitter threshold must be between 0 and 10000 ms"})
-	}
+	// M-of-N alarm evaluation validation
+	sp.validateAlarmCountWindow(filename, fieldPrefix, host.AlarmCount, host.AlarmWindow, validator)
+
+	// Sampling override validation
+	sp.validateSampling(filename, fieldPrefix, host.DataPointPings, host.DataPointTime, host.PingTimeout, validator)
+
+	// Tags validation, including the tags the host takes from its profiles and organization
+	sp.validateTags(filename, fieldPrefix, host.Tags, validator)
 
 	// Alarm receiver validation
 	if host.AlarmReceiver != "" && len(host.AlarmReceiver) > 500 {
@@ -1057,6 +2214,19 @@ func (sp *SmogPing) validateHost(filename, orgName string, index int, host Host,
 			Message: "alarm receiver too long (max 500 characters)"})
 	}
 
+	// Alarm webhook validation
+	if host.AlarmWebhook != "" && strings.ToLower(host.AlarmWebhook) != "none" {
+		if len(host.AlarmWebhook) > 500 {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + ".alarmwebhook", Value: host.AlarmWebhook,
+				Message: "alarm webhook too long (max 500 characters)"})
+		} else if !isValidURL(host.AlarmWebhook) {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + ".alarmwebhook", Value: host.AlarmWebhook,
+				Message: "must be 'none' or a valid http(s) URL"})
+		}
+	}
+
 	// Ping source validation (per-host ping source, optional)
 	if host.PingSource != "" && host.PingSource != "default" {
 		if net.ParseIP(host.PingSource) == nil {
@@ -1066,51 +2236,573 @@ func (sp *SmogPing) validateHost(filename, orgName string, index int, host Host,
 		}
 	}
 
-	return nil
-}
-
-// validateCompleteTargets performs final validation on the complete targets configuration
-func (sp *SmogPing) validateCompleteTargets() error {
-	validator := &ConfigValidator{}
-
-	// Check for empty configuration
-	if len(sp.targets.Organizations) == 0 {
-		validator.AddError(fmt.Errorf("no organizations defined"))
-	}
-
-	// Count total hosts and validate overall limits
-	totalHosts := 0
-	allHostNames := make(map[string]string) // hostname -> organization
-
-	for orgName, org := range sp.targets.Organizations {
-		totalHosts += len(org.Hosts)
-
-		// Check for duplicate host names across organizations
-		for _, host := range org.Hosts {
-			if existingOrg, exists := allHostNames[host.Name]; exists {
-				validator.AddWarning(fmt.Sprintf("Host name '%s' appears in both '%s' and '%s' organizations",
-					host.Name, existingOrg, orgName))
+	// Address family validation
+	if !isValidFamily(host.Family) {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".family", Value: host.Family,
+			Message: "must be 'ipv4', 'ipv6' or 'both'"})
+	} else if ipFamily(host.IP) != 0 && hostFamily(host) == familyBoth {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".family", Value: host.Family,
+			Message: "family 'both' requires a DNS name"})
+	} else if family := ipFamily(host.IP); family != 0 && host.Family != "" && hostFamily(host) != fmt.Sprintf("ipv%d", family) {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".family", Value: host.Family,
+			Message: fmt.Sprintf("does not match the IPv%d address %s", family, host.IP)})
+	} else if source := pingSourceFor(host, sp.currentConfig()); source != "" {
+		// The source address must be usable for the target's family
+		if message := sourceFamilyMismatch(source, host, declaredFamily(host)); message != "" {
+			field := ".pingsource"
+			if host.PingSource == "" || host.PingSource == "default" {
+				field = ".family"
 			}
-			allHostNames[host.Name] = orgName
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + field, Value: source,
+				Message: message})
 		}
 	}
 
-	// Total hosts validation
-	if totalHosts == 0 {
-		validator.AddError(fmt.Errorf("no hosts defined across all organizations"))
+	// Expanded host validation
+	if host.Expand && ipFamily(host.IP) != 0 {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".expand", Value: host.Expand,
+			Message: "expand requires a DNS name"})
 	}
-
-	if totalHosts > 10000 {
-		validator.AddError(fmt.Errorf("too many total hosts (%d), maximum 10000", totalHosts))
+	if host.BackendsDown < 0 || host.BackendsDown > maxBackends {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".backendsdown", Value: host.BackendsDown,
+			Message: fmt.Sprintf("must be between 0 and %d addresses", maxBackends)})
+	} else if host.BackendsDown > 0 && !host.Expand {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".backendsdown", Value: host.BackendsDown,
+			Message: "backendsdown is only valid for hosts with expand = true"})
 	}
 
-	// Performance validation
-	hostsPerSecond := float64(totalHosts) / float64(sp.config.DataPointTime)
+	// Probe type validation
+	probe := hostProbe(host)
+	switch probe {
+	case probeICMP, probeHTTP:
+		if host.Port != 0 {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + ".port", Value: host.Port,
+				Message: "port is only valid for tcp and dns probes"})
+		}
+	case probeTCP:
+		if host.Port < 1 || host.Port > 65535 {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + ".port", Value: host.Port,
+				Message: "tcp probes require a port between 1 and 65535"})
+		}
+	case probeDNS:
+		if host.Port < 0 || host.Port > 65535 {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + ".port", Value: host.Port,
+				Message: "must be between 1 and 65535, or 0 for port 53"})
+		}
+	default:
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".probe", Value: host.Probe,
+			Message: "must be 'icmp', 'tcp', 'http' or 'dns'"})
+	}
+
+	// HTTP probe validation
+	if probe == probeHTTP {
+		if !isValidURL(host.URL) {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + ".url", Value: host.URL,
+				Message: "http probes require a valid http(s) URL"})
+		}
+		if host.Method != "" && !httpProbeMethods[strings.ToUpper(host.Method)] {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + ".method", Value: host.Method,
+				Message: "must be one of GET, HEAD, POST or OPTIONS"})
+		}
+		if host.ExpectStatus != 0 && (host.ExpectStatus < 100 || host.ExpectStatus > 599) {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + ".expectstatus", Value: host.ExpectStatus,
+				Message: "must be an HTTP status code between 100 and 599"})
+		}
+		if _, err := regexp.Compile(host.ExpectBody); err != nil {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + ".expectbody", Value: host.ExpectBody,
+				Message: fmt.Sprintf("invalid regular expression: %v", err)})
+		}
+	} else if host.URL != "" || host.Method != "" || host.ExpectStatus != 0 || host.ExpectBody != "" {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".probe", Value: host.Probe,
+			Message: "url, method, expectstatus and expectbody are only valid for http probes"})
+	}
+
+	// DNS probe validation
+	if probe == probeDNS {
+		if _, err := dnsmessage.NewName(dnsQueryName(host.Query)); err != nil || host.Query == "" || len(host.Query) > 253 {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + ".query", Value: host.Query,
+				Message: "dns probes require a valid query name"})
+		}
+		if _, ok := dnsQueryTypes[dnsQueryType(host)]; !ok {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + ".querytype", Value: host.QueryType,
+				Message: "must be one of A, AAAA, CNAME, MX, NS, PTR, SOA, SRV or TXT"})
+		}
+		if transport := strings.ToLower(host.Transport); transport != "" && transport != "udp" && transport != "tcp" {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + ".transport", Value: host.Transport,
+				Message: "must be 'udp' or 'tcp'"})
+		}
+		if _, ok := dnsRcodes[dnsExpectRcode(host)]; !ok {
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: fieldPrefix + ".expectrcode", Value: host.ExpectRcode,
+				Message: "must be one of NOERROR, FORMERR, SERVFAIL, NXDOMAIN, NOTIMP or REFUSED"})
+		}
+	} else if host.Query != "" || host.QueryType != "" || host.Transport != "" || host.ExpectRcode != "" || host.ExpectAnswer != "" {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".probe", Value: host.Probe,
+			Message: "query, querytype, transport, expectrcode and expectanswer are only valid for dns probes"})
+	}
+
+	return nil
+}
+
+// validateAlarmCountWindow validates the alarmcount and alarmwindow settings of a host or organization
+func (sp *SmogPing) validateAlarmCountWindow(filename, fieldPrefix string, count, window int, validator *ConfigValidator) {
+	if count < 0 || count > maxAlarmWindow {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".alarmcount", Value: count,
+			Message: fmt.Sprintf("must be between 0 and %d data points", maxAlarmWindow)})
+	}
+
+	if window < 0 || window > maxAlarmWindow {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".alarmwindow", Value: window,
+			Message: fmt.Sprintf("must be between 0 and %d data points", maxAlarmWindow)})
+	} else if window > 0 && count > window {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".alarmcount", Value: count,
+			Message: fmt.Sprintf("cannot be larger than alarmwindow (%d)", window)})
+	}
+}
+
+// validateAlarmThresholds checks the alarm thresholds of a host or organization defaults table
+func (sp *SmogPing) validateAlarmThresholds(filename, fieldPrefix string, alarmPing, alarmLoss, alarmJitter int, validator *ConfigValidator) {
+	if alarmPing < 0 || alarmPing > 10000 {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".alarmping", Value: alarmPing,
+			Message: "alarm ping threshold must be between 0 and 10000 ms"})
+	}
+
+	if alarmLoss < 0 || alarmLoss > 100 {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".alarmloss", Value: alarmLoss,
+			Message: "alarm loss threshold must be between 0 and 100 percent"})
+	}
+
+	if alarmJitter < 0 || alarmJitter > 10000 {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".alarmjitter", Value: alarmJitter,
+			Message: "alarm jitter threshold must be between 0 and 10000 ms"})
+	}
+}
+
+// reservedTags are the tags SmogPing sets itself, plus the Prometheus histogram bucket label and
+// the InfluxDB time column. Names starting with an underscore, like InfluxDB's _measurement and
+// _field, are rejected as well.
+var reservedTags = map[string]bool{
+	"host": true, "ip": true, "organization": true, "source": true, "probe": true,
+	"resolved_ip": true, "is_dns_name": true, "af": true, "previous_resolved_ip": true, "le": true,
+	"time": true,
+}
+
+// tagNamePattern matches tag names that are valid InfluxDB tag keys, Prometheus label names
+// and environment variable names
+var tagNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// validateTags validates the user tags of a host, profile or organization
+func (sp *SmogPing) validateTags(filename, fieldPrefix string, tags map[string]string, validator *ConfigValidator) {
+	if len(tags) > 20 {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".tags", Value: len(tags),
+			Message: "too many tags (max 20)"})
+	}
+
+	// Sorted for a stable first error
+	names := make(map[string]string) // Tag names by their upper case alarm receiver variable
+	for _, name := range slices.Sorted(maps.Keys(tags)) {
+		value := tags[name]
+		field := fieldPrefix + ".tags." + name
+		other, collides := names[strings.ToUpper(name)]
+		names[strings.ToUpper(name)] = name
+		switch {
+		case !tagNamePattern.MatchString(name) || len(name) > 64:
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: field, Value: name,
+				Message: "tag name must start with a letter or underscore, contain only letters, digits and underscores and be at most 64 characters"})
+		case strings.HasPrefix(name, "_"):
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: field, Value: name,
+				Message: "tag names starting with '_' are reserved by InfluxDB and Prometheus"})
+		case reservedTags[name]:
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: field, Value: name,
+				Message: "tag name is reserved by SmogPing, Prometheus or InfluxDB"})
+		case collides:
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: field, Value: name,
+				Message: fmt.Sprintf("tag name differs from tag '%s' only by case, both would set SMOGPING_TAG_%s", other, strings.ToUpper(name))})
+		case value == "" || len(value) > 256:
+			validator.AddError(&TOMLValidationError{
+				File: filename, Field: field, Value: value,
+				Message: "tag value must be between 1 and 256 characters"})
+		}
+	}
+}
+
+// validateSampling validates the sampling overrides of an organization or host, 0 inherits
+func (sp *SmogPing) validateSampling(filename, fieldPrefix string, pings, dataPointTime, timeout int, validator *ConfigValidator) {
+	if pings < 0 || pings > 100 {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".datapointpings", Value: pings,
+			Message: "must be 0 (inherit) or between 1 and 100"})
+	}
+
+	if dataPointTime < 0 || dataPointTime > 86400 {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".datapointtime", Value: dataPointTime,
+			Message: "must be 0 (inherit) or between 1 and 86400 seconds"})
+	}
+
+	if timeout < 0 || timeout > 60 {
+		validator.AddError(&TOMLValidationError{
+			File: filename, Field: fieldPrefix + ".pingtimeout", Value: timeout,
+			Message: "must be 0 (inherit) or between 1 and 60 seconds"})
+	}
+
+	if timeout > 0 && dataPointTime > 0 && timeout >= dataPointTime {
+		validator.AddFieldWarning(filename, fieldPrefix+".pingtimeout",
+			fmt.Sprintf("%s: pingtimeout (%d) should be less than datapointtime (%d)", fieldPrefix, timeout, dataPointTime))
+	}
+}
+
+// hostSampling returns the pings per data point, data point time and ping timeout of a host,
+// using the global settings for those the host and its organization leave at 0
+func hostSampling(host Host, config Config) (int, time.Duration, time.Duration) {
+	pings := config.DataPointPings
+	if host.DataPointPings > 0 {
+		pings = host.DataPointPings
+	}
+	dataPointTime := config.DataPointTime
+	if host.DataPointTime > 0 {
+		dataPointTime = host.DataPointTime
+	}
+	timeout := config.PingTimeout
+	if host.PingTimeout > 0 {
+		timeout = host.PingTimeout
+	}
+	return pings, time.Duration(dataPointTime) * time.Second, time.Duration(timeout) * time.Second
+}
+
+// probeLoad returns how many targets at the global data_point_pings and data_point_time a host
+// counts as, by its probe rate
+func probeLoad(host Host, config Config) float64 {
+	if config.DataPointPings <= 0 || config.DataPointTime <= 0 {
+		return 1
+	}
+	pings, dataPointTime, _ := hostSampling(host, config)
+	globalRate := float64(config.DataPointPings) / float64(config.DataPointTime)
+	return float64(pings) / dataPointTime.Seconds() / globalRate
+}
+
+// inheritHostDefaults copies the organization defaults to the settings a host does not set
+func inheritHostDefaults(host *Host, defaults HostDefaults) {
+	if host.AlarmPing == 0 {
+		host.AlarmPing = defaults.AlarmPing
+	}
+	if host.AlarmLoss == 0 {
+		host.AlarmLoss = defaults.AlarmLoss
+	}
+	if host.AlarmJitter == 0 {
+		host.AlarmJitter = defaults.AlarmJitter
+	}
+	if host.AlarmReceiver == "" {
+		host.AlarmReceiver = defaults.AlarmReceiver
+	}
+	if host.PingSource == "" || host.PingSource == "default" {
+		host.PingSource = defaults.PingSource
+	}
+}
+
+// hostWithDefaults returns a host with the config.toml alarm thresholds applied to the ones it
+// does not set. They are applied when alarms are checked, so a config.toml reload takes effect
+// without restarting schedules, like ping_source and alarm_receiver.
+func hostWithDefaults(host Host, config Config) Host {
+	if host.AlarmPing == 0 {
+		host.AlarmPing = config.AlarmPing
+	}
+	if host.AlarmLoss == 0 {
+		host.AlarmLoss = config.AlarmLoss
+	}
+	if host.AlarmJitter == 0 {
+		host.AlarmJitter = config.AlarmJitter
+	}
+	return host
+}
+
+// effectiveSettings returns the alarm thresholds, alarm receiver and ping source a host ends up
+// with, and whether each comes from the host, a profile, its organization or config.toml. host
+// must not have its profiles and organization settings applied yet, or they count as its own.
+func effectiveSettings(host Host, profiles map[string]Host, defaults HostDefaults, config Config) []EffectiveSetting {
+	type layer struct {
+		origin string
+		host   Host
+	}
+	layers := []layer{{"host", host}}
+	for i := len(host.Profile) - 1; i >= 0; i-- {
+		layers = append(layers, layer{"profile " + host.Profile[i], profiles[host.Profile[i]]})
+	}
+	layers = append(layers,
+		layer{"organization", Host{AlarmPing: defaults.AlarmPing, AlarmLoss: defaults.AlarmLoss, AlarmJitter: defaults.AlarmJitter,
+			AlarmReceiver: defaults.AlarmReceiver, PingSource: defaults.PingSource}},
+		layer{"global", Host{AlarmPing: config.AlarmPing, AlarmLoss: config.AlarmLoss, AlarmJitter: config.AlarmJitter,
+			AlarmReceiver: config.AlarmReceiver, PingSource: config.PingSource}})
+
+	// setting reports the first layer that sets a value, "" means unset. A host or profile setting
+	// it to "" hides the profiles after it, the organization and config.toml still apply.
+	setting := func(name, fallback string, value func(Host) string) EffectiveSetting {
+		hidden := false
+		for _, l := range layers {
+			if hidden && strings.HasPrefix(l.origin, "profile ") {
+				continue
+			}
+			if v := value(l.host); v != "" {
+				return EffectiveSetting{Name: name, Value: v, Origin: l.origin}
+			}
+			hidden = hidden || l.host.DefinedKeys[name]
+		}
+		return EffectiveSetting{Name: name, Value: fallback, Origin: "global"}
+	}
+	threshold := func(field func(Host) int) func(Host) string {
+		return func(h Host) string {
+			if field(h) == 0 {
+				return ""
+			}
+			return strconv.Itoa(field(h))
+		}
+	}
+
+	return []EffectiveSetting{
+		setting("alarmping", "0", threshold(func(h Host) int { return h.AlarmPing })),
+		setting("alarmloss", "0", threshold(func(h Host) int { return h.AlarmLoss })),
+		setting("alarmjitter", "0", threshold(func(h Host) int { return h.AlarmJitter })),
+		setting("alarmreceiver", "none", func(h Host) string { return h.AlarmReceiver }),
+		// A ping source of "default" passes the setting on like an empty one
+		setting("pingsource", "default", func(h Host) string {
+			if h.PingSource == "default" {
+				return ""
+			}
+			return h.PingSource
+		}),
+	}
+}
+
+// formatSettings formats effective settings like "alarmping=100 (organization)"
+func formatSettings(settings []EffectiveSetting) string {
+	parts := make([]string, len(settings))
+	for i, setting := range settings {
+		parts[i] = fmt.Sprintf("%s=%s (%s)", setting.Name, setting.Value, setting.Origin)
+	}
+	return strings.Join(parts, " ")
+}
+
+// applyProfiles copies the settings of their profiles to the hosts that do not set them
+func applyProfiles(targets *TargetsConfig, profiles map[string]Host) {
+	for orgName, org := range targets.Organizations {
+		for i := range org.Hosts {
+			mergeProfiles(&org.Hosts[i], profiles)
+		}
+		targets.Organizations[orgName] = org
+	}
+}
+
+// mergeProfiles fills every setting a host leaves out from the profiles it lists, a later profile
+// winning over an earlier one. A setting the host or a later profile sets wins even at 0, "" or
+// false, so "expand = false" turns off the expand of a profile.
+func mergeProfiles(host *Host, profiles map[string]Host) {
+	hostValue := reflect.ValueOf(host).Elem()
+	hostType := hostValue.Type()
+
+	set := make(map[string]bool)
+	for f := 0; f < hostValue.NumField(); f++ {
+		if key := hostType.Field(f).Tag.Get("toml"); definesSetting(*host, key, hostValue.Field(f)) {
+			set[key] = true
+		}
+	}
+
+	for i := len(host.Profile) - 1; i >= 0; i-- {
+		profile, exists := profiles[host.Profile[i]]
+		if !exists {
+			continue
+		}
+		profileValue := reflect.ValueOf(profile)
+		for f := 0; f < hostValue.NumField(); f++ {
+			key := hostType.Field(f).Tag.Get("toml")
+			if key == "" || key == "-" || key == "tags" || set[key] || !definesSetting(profile, key, profileValue.Field(f)) {
+				continue
+			}
+			hostValue.Field(f).Set(profileValue.Field(f))
+			set[key] = true
+		}
+		host.Tags = mergeTags(host.Tags, profile.Tags)
+	}
+}
+
+// definesSetting reports whether a host or profile sets the setting with the given key. Hosts
+// not read from a targets file only set the settings they have a non-zero value for.
+func definesSetting(host Host, key string, value reflect.Value) bool {
+	if host.DefinedKeys == nil {
+		return !value.IsZero()
+	}
+	return host.DefinedKeys[key]
+}
+
+// mergeTags returns tags with the names it does not set taken from defaults. The result is a
+// new map when anything is merged, so tags of profiles and organizations are never shared.
+func mergeTags(tags, defaults map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return tags
+	}
+	merged := make(map[string]string, len(tags)+len(defaults))
+	maps.Copy(merged, defaults)
+	maps.Copy(merged, tags)
+	return merged
+}
+
+// applyOrganizationSettings copies organization-wide settings to hosts that do not set them
+func applyOrganizationSettings(targets *TargetsConfig) {
+	for orgName, org := range targets.Organizations {
+		for i := range org.Hosts {
+			host := &org.Hosts[i]
+			inheritHostDefaults(host, org.Defaults)
+			host.Tags = mergeTags(host.Tags, org.Tags)
+			if host.AlarmCount == 0 {
+				host.AlarmCount = org.AlarmCount
+			}
+			if host.AlarmWindow == 0 {
+				host.AlarmWindow = org.AlarmWindow
+			}
+			if host.Family == "" {
+				host.Family = org.Family
+			}
+			if host.BackendsDown == 0 && host.Expand {
+				host.BackendsDown = org.BackendsDown
+			}
+			if host.DataPointPings == 0 {
+				host.DataPointPings = org.DataPointPings
+			}
+			if host.DataPointTime == 0 {
+				host.DataPointTime = org.DataPointTime
+			}
+			if host.PingTimeout == 0 {
+				host.PingTimeout = org.PingTimeout
+			}
+		}
+		targets.Organizations[orgName] = org
+	}
+}
+
+// expandAddressFamilies sets the address family of every host, monitoring hosts with family
+// "both" as one target per family
+func expandAddressFamilies(targets *TargetsConfig) {
+	for orgName, org := range targets.Organizations {
+		hosts := make([]Host, 0, len(org.Hosts))
+		for _, host := range org.Hosts {
+			switch hostFamily(host) {
+			case familyIPv4:
+				host.AddressFamily = 4
+			case familyIPv6:
+				host.AddressFamily = 6
+			case familyBoth:
+				host.AddressFamily = 4
+				hosts = append(hosts, host)
+				host.AddressFamily = 6
+			}
+			hosts = append(hosts, host)
+		}
+		org.Hosts = hosts
+		targets.Organizations[orgName] = org
+	}
+}
+
+// validateCompleteTargets performs final validation on the complete targets configuration, the
+// targets being loaded rather than the running ones
+func (sp *SmogPing) validateCompleteTargets(targets *TargetsConfig) error {
+	validator := &ConfigValidator{}
+
+	// Check for empty configuration
+	if len(targets.Organizations) == 0 {
+		validator.AddError(fmt.Errorf("no organizations defined"))
+	}
+
+	// Count total hosts and validate overall limits
+	totalHosts := 0
+	allHostNames := make(map[string]string) // hostname -> organization
+
+	var probeTargets float64 // Hosts weighted by their probe rate
+	for _, orgName := range slices.Sorted(maps.Keys(targets.Organizations)) {
+		org := targets.Organizations[orgName]
+		totalHosts += len(org.Hosts)
+
+		// Check for duplicate host names across organizations
+		for _, host := range org.Hosts {
+			probeTargets += probeLoad(host, sp.config)
+			if hostFamily(host) == familyBoth && host.AddressFamily == 6 {
+				continue // Second target of a dual-stack host
+			}
+			if existingOrg, exists := allHostNames[host.Name]; exists && existingOrg != orgName {
+				validator.AddFieldWarning(host.SourceFile, host.SourceField+".name",
+					fmt.Sprintf("Host name '%s' appears in both '%s' and '%s' organizations",
+						host.Name, existingOrg, orgName))
+			}
+			allHostNames[host.Name] = orgName
+		}
+	}
+
+	// Check for profiles of the main targets file that no host uses, in any file
+	usedProfiles := make(map[string]bool)
+	for _, org := range targets.Organizations {
+		for _, host := range org.Hosts {
+			for _, name := range host.Profile {
+				usedProfiles[name] = true
+			}
+		}
+	}
+	for name := range targets.Profiles {
+		if !usedProfiles[name] {
+			validator.AddFieldWarning(sp.targetsFile, "profiles."+name, fmt.Sprintf("Profile '%s' is not used by any host", name))
+		}
+	}
+
+	// Total hosts validation
+	if totalHosts == 0 {
+		validator.AddError(fmt.Errorf("no hosts defined across all organizations"))
+	}
+
+	if totalHosts > 10000 {
+		validator.AddError(fmt.Errorf("too many total hosts (%d), maximum 10000", totalHosts))
+	}
 
-	if hostsPerSecond > 100 {
+	// Performance validation
+	hostsPerSecond := probeTargets / float64(sp.config.DataPointTime)
+
+	if sp.config.DataPointTime > 0 && hostsPerSecond > 100 {
 		validator.AddWarning(fmt.Sprintf("High ping rate: %.1f hosts/second may impact performance", hostsPerSecond))
 	}
 
+	// A check reports every error and warning and carries on loading
+	if sp.check != nil {
+		sp.check.addValidator(sp.targetsFile, validator)
+		return nil
+	}
+
 	// Report warnings
 	for _, warning := range validator.GetWarnings() {
 		sp.verbosef("Targets Warning: %s", warning)
@@ -1122,7 +2814,7 @@ func (sp *SmogPing) validateCompleteTargets() error {
 	}
 
 	sp.verbosef("Targets validation completed: %d organizations, %d total hosts",
-		len(sp.targets.Organizations), totalHosts)
+		len(targets.Organizations), totalHosts)
 
 	return nil
 }
@@ -1192,136 +2884,6 @@ func isValidIPOrHostname(address string) bool {
 	return true
 }
 
-// setupWorkerPool initializes the worker pool for ping operations
-func (sp *SmogPing) setupWorkerPool() {
-	// Set defaults if not configured
-	if sp.config.MaxConcurrentPings == 0 {
-		sp.config.MaxConcurrentPings = 50 // Default: max 50 concurrent pings
-	}
-
-	// Create worker pool
-	sp.workerPool = &PingWorkerPool{
-		jobQueue:   make(chan PingJob, sp.config.MaxConcurrentPings*2), // Buffer for jobs
-		resultChan: make(chan *PingResult, sp.config.MaxConcurrentPings),
-		quit:       make(chan bool),
-	}
-
-	// Start workers
-	for i := 0; i < sp.config.MaxConcurrentPings; i++ {
-		worker := &PingWorker{
-			id:       i,
-			app:      sp,
-			jobQueue: sp.workerPool.jobQueue,
-			quit:     make(chan bool),
-		}
-		sp.workerPool.workers = append(sp.workerPool.workers, worker)
-
-		sp.workerPool.wg.Add(1)
-		go worker.Start()
-	}
-
-	// Start result handler
-	sp.wg.Add(1)
-	go sp.handlePingResults()
-
-	sp.verbosef("Worker pool configured: %d workers with job buffer size %d",
-		sp.config.MaxConcurrentPings, sp.config.MaxConcurrentPings*2)
-}
-
-// stopWorkerPool gracefully stops the worker pool
-func (sp *SmogPing) stopWorkerPool() {
-	if sp.workerPool == nil {
-		return
-	}
-
-	sp.verbosef("Stopping worker pool...")
-
-	// Signal all workers to quit
-	close(sp.workerPool.quit)
-	for _, worker := range sp.workerPool.workers {
-		close(worker.quit)
-	}
-
-	// Close job queue
-	close(sp.workerPool.jobQueue)
-
-	// Wait for all workers to finish
-	sp.workerPool.wg.Wait()
-
-	// Close result channel
-	close(sp.workerPool.resultChan)
-
-	sp.verbosef("Worker pool stopped")
-}
-
-// Start starts the worker to process ping jobs
-func (pw *PingWorker) Start() {
-	defer pw.app.workerPool.wg.Done()
-	pw.app.debugf("Worker %d started", pw.id)
-
-	for {
-		select {
-		case <-pw.quit:
-			pw.app.debugf("Worker %d stopping", pw.id)
-			return
-		case <-pw.app.ctx.Done():
-			pw.app.debugf("Worker %d stopping due to context cancellation", pw.id)
-			return
-		case job, ok := <-pw.jobQueue:
-			if !ok {
-				pw.app.debugf("Worker %d stopping due to closed job queue", pw.id)
-				return
-			}
-
-			pw.app.debugf("Worker %d processing job: %s (%s)", pw.id, job.Host.Name, job.Host.IP)
-			result := pw.app.pingHost(job.OrgName, job.Host)
-			if result != nil {
-				// Send result to result channel (non-blocking)
-				select {
-				case pw.app.workerPool.resultChan <- result:
-					pw.app.debugf("Worker %d sent result for %s", pw.id, job.Host.Name)
-				default:
-					pw.app.debugf("Worker %d: result channel full, dropping result for %s", pw.id, job.Host.Name)
-					// Return result to pool if channel is full
-					pw.app.returnPingResultToPool(result)
-				}
-			}
-		}
-	}
-}
-
-// handlePingResults processes ping results from workers
-func (sp *SmogPing) handlePingResults() {
-	defer sp.wg.Done()
-	sp.debugf("Result handler started")
-
-	for {
-		select {
-		case <-sp.ctx.Done():
-			sp.debugf("Result handler stopping due to context cancellation")
-			return
-		case result, ok := <-sp.workerPool.resultChan:
-			if !ok {
-				sp.debugf("Result handler stopping due to closed result channel")
-				return
-			}
-
-			sp.debugf("Processing result for %s (%s)", result.Host.Name, result.Host.IP)
-
-			// Write to InfluxDB
-			sp.writeToInflux(*result)
-
-			// Check alarms if enabled
-			if !sp.noAlarm {
-				sp.checkAlarms(*result)
-			}
-
-			// Return result object to pool
-			sp.returnPingResultToPool(result)
-		}
-	}
-}
-
 // getPingResultFromPool gets a PingResult from the object pool
 func (sp *SmogPing) getPingResultFromPool() *PingResult {
 	result := pingResultPool.Get().(*PingResult)
@@ -1337,20 +2899,6 @@ func (sp *SmogPing) returnPingResultToPool(result *PingResult) {
 	}
 }
 
-// getRTTSliceFromPool gets an RTT slice from the object pool
-func (sp *SmogPing) getRTTSliceFromPool() []time.Duration {
-	slice := rttSlicePool.Get().([]time.Duration)
-	// Reset slice to zero length but keep capacity
-	return slice[:0]
-}
-
-// returnRTTSliceToPool returns an RTT slice to the object pool
-func (sp *SmogPing) returnRTTSliceToPool(slice []time.Duration) {
-	if slice != nil && cap(slice) > 0 {
-		rttSlicePool.Put(slice)
-	}
-}
-
 // setupDNSResolver initializes the DNS resolver with caching
 func (sp *SmogPing) setupDNSResolver() {
 	sp.dnsResolver = &DNSResolver{
@@ -1366,12 +2914,7 @@ func (sp *SmogPing) setupDNSResolver() {
 		},
 	}
 
-	// Set default DNS refresh interval if not configured
-	if sp.config.DNSRefresh <= 0 {
-		sp.config.DNSRefresh = 600 // Default: 10 minutes
-	}
-
-	sp.verbosef("DNS resolver configured with %d second refresh interval", sp.config.DNSRefresh)
+	sp.verbosef("DNS resolver configured")
 }
 
 // performDNSPreflightChecks resolves all DNS names in targets and validates them
@@ -1391,42 +2934,34 @@ func (sp *SmogPing) performDNSPreflightChecks() error {
 		var validHosts []Host // Track hosts that pass DNS checks
 
 		for _, host := range org.Hosts {
-			// Check if IP field contains a DNS name or IP address
-			if sp.isDNSName(host.IP) {
-				host.IsDNSName = true
-				dnsHostCount++
-				sp.debugf("Host %s (%s) in %s: DNS name detected", host.Name, host.IP, orgName)
-
-				// Resolve DNS name to IP
-				resolvedIP, err := sp.resolveDNSName(host.IP)
+			if host.Expand {
+				backends, err := sp.expandHost(orgName, host)
 				if err != nil {
 					log.Printf("WARNING: Failed to resolve DNS name %s for host %s in %s: %v - removing from targets",
 						host.IP, host.Name, orgName, err)
+					dnsHostCount++
 					errorCount++
 					removedCount++
-					continue // Skip this host - don't add to validHosts
+					continue
 				}
+				dnsHostCount++
+				validHosts = append(validHosts, backends...)
+				continue
+			}
 
-				host.ResolvedIP = resolvedIP
-				host.LastDNSCheck = time.Now()
-
-				sp.verbosef("Resolved %s -> %s for host %s in %s",
-					host.IP, resolvedIP, host.Name, orgName)
+			if err := sp.resolveHostAddress(orgName, &host); err != nil {
+				log.Printf("WARNING: Failed to resolve DNS name %s for host %s in %s: %v - removing from targets",
+					host.IP, host.Name, orgName, err)
+				dnsHostCount++
+				errorCount++
+				removedCount++
+				continue // Skip this host - don't add to validHosts
+			}
 
-				// Cache the DNS resolution
-				sp.dnsResolver.cacheMux.Lock()
-				sp.dnsResolver.cache[host.IP] = &DNSCache{
-					Hostname:    host.IP,
-					ResolvedIP:  resolvedIP,
-					LastChecked: time.Now(),
-					DNSChanges:  0,
-				}
-				sp.dnsResolver.cacheMux.Unlock()
+			if host.IsDNSName {
+				dnsHostCount++
 			} else {
-				host.IsDNSName = false
-				host.ResolvedIP = host.IP // Use IP as-is
 				ipHostCount++
-				sp.debugf("Host %s (%s) in %s: IP address detected", host.Name, host.IP, orgName)
 			}
 
 			// Add valid host to the list
@@ -1452,6 +2987,118 @@ func (sp *SmogPing) performDNSPreflightChecks() error {
 	return nil
 }
 
+// resolveHostAddress fills in the DNS fields of a host, resolving and caching DNS names
+func (sp *SmogPing) resolveHostAddress(orgName string, host *Host) error {
+	// Check if IP field contains a DNS name or IP address
+	if !sp.isDNSName(host.IP) {
+		host.IsDNSName = false
+		host.ResolvedIP = host.IP // Use IP as-is
+		sp.debugf("Host %s (%s) in %s: IP address detected", host.Name, host.IP, orgName)
+		return nil
+	}
+
+	host.IsDNSName = true
+	sp.debugf("Host %s (%s) in %s: DNS name detected", host.Name, host.IP, orgName)
+
+	// Resolve DNS name to IP
+	resolvedIP, err := sp.resolveDNSName(host.IP, sp.resolverFamily(*host))
+	if err != nil {
+		return err
+	}
+
+	host.ResolvedIP = resolvedIP
+	host.LastDNSCheck = time.Now()
+
+	sp.verbosef("Resolved %s -> %s for host %s in %s",
+		host.IP, resolvedIP, host.Name, orgName)
+
+	// Cache the DNS resolution
+	sp.dnsResolver.cacheMux.Lock()
+	sp.dnsResolver.cache[dnsCacheKey(*host)] = &DNSCache{
+		Hostname:    host.IP,
+		ResolvedIP:  resolvedIP,
+		LastChecked: time.Now(),
+		DNSChanges:  0,
+	}
+	sp.dnsResolver.cacheMux.Unlock()
+
+	return nil
+}
+
+// resolverFamily returns the address family (4 or 6) to resolve the DNS name of a host to, 0 for
+// any. Without a family, DNS names resolve to the family of the source address. The host keeps
+// AddressFamily 0 then, so it gets no af tag and shares the DNS cache entry of its name.
+func (sp *SmogPing) resolverFamily(host Host) int {
+	if host.AddressFamily != 0 {
+		return host.AddressFamily
+	}
+	return ipFamily(pingSourceFor(host, sp.currentConfig()))
+}
+
+// expandHost resolves every address of an expanded host and returns one target per address
+func (sp *SmogPing) expandHost(orgName string, host Host) ([]Host, error) {
+	addresses, err := sp.resolveDNSAddresses(host.IP, sp.resolverFamily(host))
+	if err != nil {
+		return nil, err
+	}
+
+	backends := make([]Host, 0, len(addresses))
+	for _, address := range addresses {
+		backend := host
+		backend.IsDNSName = true
+		backend.ResolvedIP = address
+		backend.Backend = address
+		backend.AddressFamily = ipFamily(address)
+		backend.LastDNSCheck = time.Now()
+		backends = append(backends, backend)
+	}
+
+	sp.debugf("Expanded %s for host %s in %s to %d addresses: %s",
+		host.IP, host.Name, orgName, len(addresses), strings.Join(addresses, ", "))
+	return backends, nil
+}
+
+// dnsCacheKey returns the DNS cache key of a host, names resolved per address family are cached separately
+func dnsCacheKey(host Host) string {
+	if host.AddressFamily == 0 {
+		return host.IP
+	}
+	return fmt.Sprintf("%s/ipv%d", host.IP, host.AddressFamily)
+}
+
+// lookup returns the cached resolved IP of a DNS cache key
+func (dr *DNSResolver) lookup(key string) (string, bool) {
+	dr.cacheMux.RLock()
+	defer dr.cacheMux.RUnlock()
+
+	cache, exists := dr.cache[key]
+	if !exists || cache.ResolvedIP == "" {
+		return "", false
+	}
+	return cache.ResolvedIP, true
+}
+
+// currentTargetIP returns the address to ping for a host. DNS names are looked up in the
+// shared resolver cache so changes found by the DNS refresh take effect at the next ping.
+func (sp *SmogPing) currentTargetIP(host Host) string {
+	// Expanded targets always probe their own address
+	if host.Backend != "" {
+		return host.Backend
+	}
+
+	if host.IsDNSName && sp.dnsResolver != nil {
+		if resolvedIP, ok := sp.dnsResolver.lookup(dnsCacheKey(host)); ok {
+			return resolvedIP
+		}
+	}
+
+	// Use resolved IP if available, otherwise use original IP
+	if host.ResolvedIP != "" {
+		return host.ResolvedIP
+	}
+	return host.IP
+}
+
 // isDNSName checks if a string is a DNS name rather than an IP address
 func (sp *SmogPing) isDNSName(address string) bool {
 	// Try to parse as IP address
@@ -1467,8 +3114,9 @@ func (sp *SmogPing) isDNSName(address string) bool {
 	return false
 }
 
-// resolveDNSName resolves a DNS name to an IP address
-func (sp *SmogPing) resolveDNSName(hostname string) (string, error) {
+// resolveDNSName resolves a DNS name to an address of the given family (4 or 6), or to any
+// address preferring IPv4 when family is 0
+func (sp *SmogPing) resolveDNSName(hostname string, family int) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -1481,6 +3129,15 @@ func (sp *SmogPing) resolveDNSName(hostname string) (string, error) {
 		return "", fmt.Errorf("no IP addresses found for hostname %s", hostname)
 	}
 
+	if family != 0 {
+		for _, ip := range ips {
+			if ipFamily(ip) == family {
+				return ip, nil
+			}
+		}
+		return "", fmt.Errorf("no IPv%d addresses found for hostname %s", family, hostname)
+	}
+
 	// Return the first IPv4 address, or first address if no IPv4 found
 	for _, ip := range ips {
 		if parsedIP := net.ParseIP(ip); parsedIP != nil && parsedIP.To4() != nil {
@@ -1492,6 +3149,37 @@ func (sp *SmogPing) resolveDNSName(hostname string) (string, error) {
 	return ips[0], nil
 }
 
+// resolveDNSAddresses resolves a DNS name to all its addresses of the given family (4 or 6), or of
+// both families when family is 0. The addresses are returned sorted.
+func (sp *SmogPing) resolveDNSAddresses(hostname string, family int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ips, err := sp.dnsResolver.resolver.LookupHost(ctx, hostname)
+	if err != nil {
+		return nil, fmt.Errorf("DNS resolution failed: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	var addresses []string
+	for _, ip := range ips {
+		if (family == 0 || ipFamily(ip) == family) && !seen[ip] {
+			seen[ip] = true
+			addresses = append(addresses, ip)
+		}
+	}
+
+	if len(addresses) == 0 {
+		if family != 0 {
+			return nil, fmt.Errorf("no IPv%d addresses found for hostname %s", family, hostname)
+		}
+		return nil, fmt.Errorf("no IP addresses found for hostname %s", hostname)
+	}
+
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
 // startDNSRefreshMonitoring starts periodic DNS refresh checking
 func (sp *SmogPing) startDNSRefreshMonitoring() {
 	if sp.config.DNSRefresh <= 0 {
@@ -1512,6 +3200,7 @@ func (sp *SmogPing) startDNSRefreshMonitoring() {
 				return
 			case <-ticker.C:
 				sp.performDNSRefreshCheck()
+				sp.refreshExpandedHosts()
 			}
 		}
 	}()
@@ -1532,15 +3221,15 @@ func (sp *SmogPing) performDNSRefreshCheck() {
 
 	for orgName, org := range sp.targets.Organizations {
 		for i, host := range org.Hosts {
-			if !host.IsDNSName {
-				continue // Skip IP addresses
+			if !host.IsDNSName || host.Backend != "" {
+				continue // Skip IP addresses and expanded hosts
 			}
 
 			checkedCount++
 			sp.debugf("Checking DNS for %s (%s) in %s", host.Name, host.IP, orgName)
 
 			// Resolve current IP
-			newIP, err := sp.resolveDNSName(host.IP)
+			newIP, err := sp.resolveDNSName(host.IP, sp.resolverFamily(host))
 			if err != nil {
 				sp.debugf("DNS refresh failed for %s (%s) in %s: %v",
 					host.Name, host.IP, orgName, err)
@@ -1561,12 +3250,12 @@ func (sp *SmogPing) performDNSRefreshCheck() {
 
 				// Update DNS cache
 				sp.dnsResolver.cacheMux.Lock()
-				if cache, exists := sp.dnsResolver.cache[host.IP]; exists {
+				if cache, exists := sp.dnsResolver.cache[dnsCacheKey(host)]; exists {
 					cache.ResolvedIP = newIP
 					cache.LastChecked = time.Now()
 					cache.DNSChanges++
 				} else {
-					sp.dnsResolver.cache[host.IP] = &DNSCache{
+					sp.dnsResolver.cache[dnsCacheKey(host)] = &DNSCache{
 						Hostname:    host.IP,
 						ResolvedIP:  newIP,
 						LastChecked: time.Now(),
@@ -1599,33 +3288,149 @@ func (sp *SmogPing) performDNSRefreshCheck() {
 	}
 }
 
-// setupBatching initializes InfluxDB batching system
-func (sp *SmogPing) setupBatching() {
-	// Set defaults if not configured
-	if sp.config.InfluxBatchSize <= 0 {
-		sp.config.InfluxBatchSize = 100 // Default batch size
+// refreshExpandedHosts resolves the DNS names of expanded hosts again, starting targets for new
+// addresses and stopping those of addresses that are gone. A failed lookup keeps the current targets.
+// Lookups run without holding the targets lock, which is only taken to swap in the results.
+func (sp *SmogPing) refreshExpandedHosts() {
+	// Collect one template per expanded host
+	type expandedHost struct {
+		orgName  string
+		template Host
+	}
+	var templates []expandedHost
+	seen := make(map[string]bool)
+	sp.targetsMux.RLock()
+	for orgName, org := range sp.targets.Organizations {
+		for _, host := range org.Hosts {
+			if host.Backend == "" || seen[backendGroupKey(orgName, host)] {
+				continue
+			}
+			seen[backendGroupKey(orgName, host)] = true
+			templates = append(templates, expandedHost{orgName: orgName, template: host})
+		}
 	}
-	if sp.config.InfluxBatchTime <= 0 {
-		sp.config.InfluxBatchTime = 10 // Default 10 seconds
+	sp.targetsMux.RUnlock()
+
+	// Resolve the DNS names again
+	resolved := make(map[string][]Host)
+	for _, expanded := range templates {
+		template := expanded.template
+		template.Backend = ""
+		switch hostFamily(template) {
+		case familyIPv4, familyIPv6, familyBoth:
+			// Keep the family the host was expanded with
+		default:
+			template.AddressFamily = 0
+		}
+
+		backends, err := sp.expandHost(expanded.orgName, template)
+		if err != nil {
+			sp.debugf("DNS refresh failed for %s (%s) in %s: %v", template.Name, template.IP, expanded.orgName, err)
+			continue
+		}
+		resolved[backendGroupKey(expanded.orgName, expanded.template)] = backends
 	}
 
-	// Initialize batching state
-	sp.batchPoints = make([]*write.Point, 0, sp.config.InfluxBatchSize)
-	sp.lastFlush = time.Now()
+	sp.targetsMux.Lock()
 
-	// Start batch flush timer
-	sp.wg.Add(1)
-	go sp.batchFlushTimer()
+	var added, removed []TargetInfo
+	for orgName, org := range sp.targets.Organizations {
+		// Group the expanded targets by the host they were expanded from
+		groups := make(map[string][]Host)
+		var order []string
+		hosts := make([]Host, 0, len(org.Hosts))
+		for _, host := range org.Hosts {
+			if host.Backend == "" {
+				hosts = append(hosts, host)
+				continue
+			}
+			key := backendGroupKey(orgName, host)
+			if _, exists := groups[key]; !exists {
+				order = append(order, key)
+			}
+			groups[key] = append(groups[key], host)
+		}
 
-	sp.verbosef("InfluxDB batching configured: BatchSize=%d, BatchTime=%ds",
-		sp.config.InfluxBatchSize, sp.config.InfluxBatchTime)
+		for _, key := range order {
+			current := groups[key]
+			expanded, exists := resolved[key]
+			if !exists {
+				// Lookup failed, or the host was added by a reload during the lookups
+				hosts = append(hosts, current...)
+				continue
+			}
+
+			known := make(map[string]Host)
+			for _, host := range current {
+				known[host.Backend] = host
+			}
+			var addresses []string
+			for _, backend := range expanded {
+				addresses = append(addresses, backend.Backend)
+				if host, exists := known[backend.Backend]; exists {
+					host.LastDNSCheck = backend.LastDNSCheck
+					hosts = append(hosts, host)
+					delete(known, backend.Backend)
+					continue
+				}
+				// Take the settings of the current targets, a reload may have changed them
+				host := withBackend(current[0], backend)
+				hosts = append(hosts, host)
+				added = append(added, TargetInfo{Host: host, OrgName: orgName})
+			}
+			for _, host := range known {
+				removed = append(removed, TargetInfo{Host: host, OrgName: orgName})
+			}
+
+			if len(known) > 0 || len(expanded) != len(current) {
+				log.Printf("DNS CHANGE: %s (%s) in %s now has %d addresses: %s",
+					current[0].Name, current[0].IP, orgName, len(addresses), strings.Join(addresses, ", "))
+				sp.syslogWarning("DNS CHANGE: %s (%s) in %s now has %d addresses: %s",
+					current[0].Name, current[0].IP, orgName, len(addresses), strings.Join(addresses, ", "))
+			}
+		}
+
+		org.Hosts = hosts
+		sp.targets.Organizations[orgName] = org
+	}
+
+	sp.targetsMux.Unlock()
+
+	for _, target := range removed {
+		sp.stopSchedule(targetKey(target.OrgName, target.Host))
+		sp.clearAlarmStates(target.OrgName, target.Host)
+		sp.removeFromSinks(target.OrgName, target.Host)
+	}
+	sp.startSchedules(added)
+}
+
+// withBackend returns the target of host probing the address of an expanded backend
+func withBackend(host Host, backend Host) Host {
+	host.IsDNSName = backend.IsDNSName
+	host.ResolvedIP = backend.ResolvedIP
+	host.Backend = backend.Backend
+	host.AddressFamily = backend.AddressFamily
+	host.LastDNSCheck = backend.LastDNSCheck
+	return host
 }
 
 // setupAlarms initializes the alarm system
 func (sp *SmogPing) setupAlarms() {
-	sp.lastAlarms = make(map[string]time.Time)
+	sp.alarmStates = make(map[string]map[string]*MetricAlarm)
+	sp.backendGroups = make(map[string]*BackendGroup)
+
+	sp.webhookNotifier = NewWebhookNotifier(
+		time.Duration(sp.config.AlarmWebhookTimeout)*time.Second,
+		sp.config.AlarmWebhookRetries,
+		time.Duration(sp.config.AlarmWebhookBackoff)*time.Second,
+		sp.config.AlarmWebhookHeaders)
 
 	sp.verbosef("Alarm system configured: AlarmRate=%ds", sp.config.AlarmRate)
+	if webhook := sp.alarmWebhookFor(Host{}); webhook != "" {
+		sp.verbosef("Alarm webhook configured: %s (timeout=%ds, retries=%d, backoff=%ds)",
+			webhookDisplayName(webhook), sp.config.AlarmWebhookTimeout,
+			sp.config.AlarmWebhookRetries, sp.config.AlarmWebhookBackoff)
+	}
 }
 
 // setupFileWatching initializes file system watching for configuration changes
@@ -1636,33 +3441,23 @@ func (sp *SmogPing) setupFileWatching() error {
 		return fmt.Errorf("failed to create file watcher: %w", err)
 	}
 
-	// Watch targets file and included files only
-	filesToWatch := []string{sp.targetsFile}
-
-	// Add included files to watch list
-	for _, includeFile := range sp.targets.Include {
-		filesToWatch = append(filesToWatch, includeFile)
-	}
-
-	for _, file := range filesToWatch {
-		if _, err := os.Stat(file); err == nil {
-			err := sp.watcher.Add(file)
-			if err != nil {
-				sp.verbosef("Warning: Failed to watch file %s: %v", file, err)
-			} else {
-				sp.verbosef("Watching file: %s", file)
-			}
-		}
+	// Watch config file, targets file and included files
+	if err := sp.watcher.Add(sp.configFile); err != nil {
+		sp.verbosef("Warning: Failed to watch file %s: %v", sp.configFile, err)
+	} else {
+		sp.verbosef("Watching file: %s", sp.configFile)
 	}
+	sp.updateWatchedFiles()
 
-	// Initialize reload channel
+	// Initialize reload channels
 	sp.reloadChan = make(chan bool, 1)
+	sp.configReloadChan = make(chan bool, 1)
 
 	// Start file watching goroutine
 	sp.wg.Add(1)
 	go sp.watchFiles()
 
-	sp.verbosef("File watching configured for target changes")
+	sp.verbosef("File watching configured for config and target changes")
 	return nil
 }
 
@@ -1670,8 +3465,8 @@ func (sp *SmogPing) setupFileWatching() error {
 func (sp *SmogPing) watchFiles() {
 	defer sp.wg.Done()
 
-	// Debounce timer to prevent multiple rapid reloads
-	var debounceTimer *time.Timer
+	// Debounce timers to prevent multiple rapid reloads
+	var debounceTimer, configDebounceTimer *time.Timer
 	debounceDelay := 2 * time.Second
 
 	for {
@@ -1685,8 +3480,41 @@ func (sp *SmogPing) watchFiles() {
 
 			sp.debugf("File event: %v", event)
 
-			// Only process write and create events
-			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) {
+			// Editors often save by replacing the file, which ends the watch on it
+			replaced := event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)
+
+			// Only process write, create and replace events
+			if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !replaced {
+				continue
+			}
+			isConfig := filepath.Clean(event.Name) == filepath.Clean(sp.configFile)
+
+			// Directories of include patterns report events for all their files
+			if !isConfig && !sp.isTargetsFile(event.Name) {
+				sp.debugf("Ignoring change of %s, not a targets file", event.Name)
+				continue
+			}
+			if replaced {
+				sp.rewatchFile(event.Name, debounceDelay)
+			}
+
+			if isConfig {
+				sp.verbosef("Config file changed: %s", event.Name)
+
+				// Reset debounce timer
+				if configDebounceTimer != nil {
+					configDebounceTimer.Stop()
+				}
+
+				configDebounceTimer = time.AfterFunc(debounceDelay, func() {
+					select {
+					case sp.configReloadChan <- true:
+						sp.verbosef("Triggering config reload")
+					default:
+						sp.debugf("Config reload already pending, skipping")
+					}
+				})
+			} else {
 				sp.verbosef("Target file changed: %s", event.Name)
 
 				// Reset debounce timer
@@ -1710,8 +3538,227 @@ func (sp *SmogPing) watchFiles() {
 			log.Printf("File watcher error: %v", err)
 		case <-sp.reloadChan:
 			sp.reloadConfiguration()
+		case <-sp.configReloadChan:
+			sp.reloadMainConfig()
+		}
+	}
+}
+
+// rewatchFile watches a replaced file again once the new file is in place
+func (sp *SmogPing) rewatchFile(file string, delay time.Duration) {
+	time.AfterFunc(delay/2, func() {
+		if err := sp.watcher.Add(file); err != nil {
+			sp.verbosef("Warning: Failed to watch file %s: %v", file, err)
+		} else {
+			sp.debugf("Watching replaced file: %s", file)
+		}
+	})
+}
+
+// restartOnlySettings are config.toml settings that cannot change while SmogPing is running
+var restartOnlySettings = map[string]bool{
+	"influx_url":          true,
+	"influx_token":        true,
+	"influx_org":          true,
+	"influx_bucket":       true,
+	"influx_spool_dir":    true,
+	"influx_spool_max_mb": true,
+	"metrics_listen":      true,
+	"dns_refresh":         true,
+}
+
+// scheduleSettings are settings that restart all ping schedules when changed
+var scheduleSettings = map[string]bool{
+	"data_point_pings":  true,
+	"data_point_time":   true,
+	"ping_timeout":      true,
+	"ping_source":       true,
+	"align_data_points": true,
+}
+
+// webhookSettings are settings that recreate the alarm webhook notifier when changed
+var webhookSettings = map[string]bool{
+	"alarm_webhook_timeout": true,
+	"alarm_webhook_retries": true,
+	"alarm_webhook_backoff": true,
+	"alarm_webhook_headers": true,
+}
+
+// applyConfigDefaults fills in defaults for settings left at zero
+func applyConfigDefaults(config *Config) {
+	if config.InfluxBatchSize <= 0 {
+		config.InfluxBatchSize = 100 // Default batch size
+	}
+	if config.InfluxBatchTime <= 0 {
+		config.InfluxBatchTime = 10 // Default 10 seconds
+	}
+	if config.InfluxSpoolMaxMB <= 0 {
+		config.InfluxSpoolMaxMB = 100 // Default 100 MB
+	}
+	if config.DNSRefresh <= 0 {
+		config.DNSRefresh = 600 // Default: 10 minutes
+	}
+	if config.AlarmWebhookTimeout <= 0 {
+		config.AlarmWebhookTimeout = 10 // Default: 10 seconds per request
+	}
+	if config.AlarmWebhookBackoff <= 0 {
+		config.AlarmWebhookBackoff = 1 // Default: 1 second before the first retry
+	}
+}
+
+// currentConfig returns a copy of the configuration that is safe to use while config.toml is reloaded
+func (sp *SmogPing) currentConfig() Config {
+	sp.configMux.RLock()
+	defer sp.configMux.RUnlock()
+	return sp.config
+}
+
+// changedConfigSettings returns the TOML names of the settings that differ between two configs
+func changedConfigSettings(oldConfig, newConfig Config) []string {
+	var changed []string
+	oldValue := reflect.ValueOf(oldConfig)
+	newValue := reflect.ValueOf(newConfig)
+	for i := 0; i < oldValue.NumField(); i++ {
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changed = append(changed, oldValue.Type().Field(i).Tag.Get("toml"))
+		}
+	}
+	return changed
+}
+
+// keepConfigSetting copies a setting, identified by its TOML name, from one config to another
+func keepConfigSetting(from Config, to *Config, name string) {
+	fromValue := reflect.ValueOf(from)
+	toValue := reflect.ValueOf(to).Elem()
+	for i := 0; i < fromValue.NumField(); i++ {
+		if fromValue.Type().Field(i).Tag.Get("toml") == name {
+			toValue.Field(i).Set(fromValue.Field(i))
+			return
+		}
+	}
+}
+
+// reloadMainConfig reloads config.toml and applies the settings that can change at runtime
+func (sp *SmogPing) reloadMainConfig() {
+	sp.verbosef("Reloading %s...", sp.configFile)
+
+	var newConfig Config
+	if err := sp.loadAndValidateConfigFile(sp.configFile, &newConfig, true); err != nil {
+		log.Printf("Error reloading %s: %v - keeping current configuration", sp.configFile, err)
+		sp.syslogWarning("Error reloading %s: %v - keeping current configuration", sp.configFile, err)
+		return
+	}
+	applyConfigDefaults(&newConfig)
+
+	oldConfig := sp.currentConfig()
+
+	// Settings that need a restart keep their current value
+	var applied []string
+	for _, name := range changedConfigSettings(oldConfig, newConfig) {
+		if restartOnlySettings[name] {
+			log.Printf("Refusing to change %s in %s at runtime, restart SmogPing to apply it", name, sp.configFile)
+			sp.syslogWarning("Refusing to change %s in %s at runtime, restart SmogPing to apply it", name, sp.configFile)
+			keepConfigSetting(oldConfig, &newConfig, name)
+			continue
+		}
+		applied = append(applied, name)
+	}
+
+	if len(applied) == 0 {
+		sp.verbosef("No applicable changes in %s", sp.configFile)
+		return
+	}
+
+	// The new timing must still cover all targets
+	if err := sp.validateConfiguration(newConfig); err != nil {
+		log.Printf("Error reloading %s: %v - keeping current configuration", sp.configFile, err)
+		sp.syslogWarning("Error reloading %s: %v - keeping current configuration", sp.configFile, err)
+		return
+	}
+
+	// A new ping_source must match the address family of the running targets
+	if newConfig.PingSource != oldConfig.PingSource {
+		if err := sp.checkSourceFamilies(newConfig); err != nil {
+			log.Printf("Error reloading %s: %v - keeping current configuration", sp.configFile, err)
+			sp.syslogWarning("Error reloading %s: %v - keeping current configuration", sp.configFile, err)
+			return
+		}
+	}
+
+	restartSchedules := false
+	recreateNotifier := false
+	for _, name := range applied {
+		restartSchedules = restartSchedules || scheduleSettings[name]
+		recreateNotifier = recreateNotifier || webhookSettings[name]
+	}
+
+	sp.configMux.Lock()
+	sp.config = newConfig
+	if recreateNotifier && sp.webhookNotifier != nil {
+		sp.webhookNotifier = NewWebhookNotifier(
+			time.Duration(newConfig.AlarmWebhookTimeout)*time.Second,
+			newConfig.AlarmWebhookRetries,
+			time.Duration(newConfig.AlarmWebhookBackoff)*time.Second,
+			newConfig.AlarmWebhookHeaders)
+	}
+	sp.configMux.Unlock()
+
+	// Let sinks pick up their settings
+	for _, sink := range sp.sinks {
+		if reloadable, ok := sink.(ReloadableSink); ok {
+			reloadable.Reload(newConfig)
+		}
+	}
+
+	log.Printf("Applied %s changes: %s", sp.configFile, strings.Join(applied, ", "))
+	sp.syslogInfo("Applied %s changes: %s", sp.configFile, strings.Join(applied, ", "))
+
+	if newConfig.MaxConcurrentPings != oldConfig.MaxConcurrentPings {
+		sp.scheduler.Resize(newConfig.MaxConcurrentPings)
+	}
+
+	if restartSchedules {
+		sp.restartSchedules()
+	}
+}
+
+// checkSourceFamilies verifies every target can be probed from its source address with a configuration
+func (sp *SmogPing) checkSourceFamilies(config Config) error {
+	sp.targetsMux.RLock()
+	defer sp.targetsMux.RUnlock()
+
+	for orgName, org := range sp.targets.Organizations {
+		for _, host := range org.Hosts {
+			source := pingSourceFor(host, config)
+			if source == "" {
+				continue
+			}
+			if message := sourceFamilyMismatch(source, host, ipFamily(sp.currentTargetIP(host))); message != "" {
+				return fmt.Errorf("ping_source: host %s in %s: %s", host.Name, orgName, message)
+			}
 		}
 	}
+	return nil
+}
+
+// restartSchedules restarts every running ping schedule so new timing settings take effect.
+// The data point in progress of each target is discarded.
+func (sp *SmogPing) restartSchedules() {
+	sp.schedulesMux.Lock()
+	targets := make([]TargetInfo, 0, len(sp.schedules))
+	for key, schedule := range sp.schedules {
+		sp.scheduler.Remove(schedule)
+		delete(sp.schedules, key)
+		// Probes completing data points update the host under the schedule lock
+		schedule.mu.Lock()
+		host := schedule.Host
+		schedule.mu.Unlock()
+		targets = append(targets, TargetInfo{Host: host, OrgName: schedule.OrgName})
+	}
+	sp.schedulesMux.Unlock()
+
+	log.Printf("Restarting %d ping schedules with new timing settings", len(targets))
+	sp.startSchedules(targets)
 }
 
 // reloadConfiguration reloads target files and updates targets
@@ -1738,41 +3785,13 @@ func (sp *SmogPing) reloadConfiguration() {
 
 // reloadTargets reloads the targets configuration
 func (sp *SmogPing) reloadTargets(newTargets *TargetsConfig) error {
-	// Load main targets file with validation
-	if err := sp.loadAndValidateTargetsFile(sp.targetsFile, newTargets, true); err != nil {
-		return fmt.Errorf("failed to load targets: %w", err)
-	}
-
-	// Load included files with validation
-	for _, includeFile := range newTargets.Include {
-		var includedTargets TargetsConfig
-		if err := sp.loadAndValidateTargetsFile(includeFile, &includedTargets, false); err != nil {
-			sp.syslogWarning("Failed to reload included file %s: %v", includeFile, err)
-			log.Printf("Warning: failed to reload included file %s: %v", includeFile, err)
-			continue
-		}
-
-		// Merge organizations
-		for orgName, org := range includedTargets.Organizations {
-			if existingOrg, exists := newTargets.Organizations[orgName]; exists {
-				existingOrg.Hosts = append(existingOrg.Hosts, org.Hosts...)
-				newTargets.Organizations[orgName] = existingOrg
-			} else {
-				newTargets.Organizations[orgName] = org
-			}
-		}
+	// Load main targets file and included files with validation
+	if err := sp.loadTargetsFiles(newTargets); err != nil {
+		return err
 	}
 
-	// Final validation of reloaded targets
-	// Temporarily store current targets for validation context
-	originalTargets := sp.targets
-	sp.targets = *newTargets
-
-	err := sp.validateCompleteTargets()
-
-	// Restore original targets if validation failed
-	if err != nil {
-		sp.targets = originalTargets
+	// Final validation of reloaded targets, the running targets stay untouched until they are applied
+	if err := sp.validateCompleteTargets(newTargets); err != nil {
 		return fmt.Errorf("reloaded targets validation failed: %w", err)
 	}
 
@@ -1784,18 +3803,32 @@ func (sp *SmogPing) reloadTargets(newTargets *TargetsConfig) error {
 func (sp *SmogPing) applyTargetChanges(newTargets TargetsConfig, oldTargets TargetsConfig) {
 	sp.verbosef("Applying target changes...")
 
+	// Carry DNS state over from running targets and resolve new DNS names
+	sp.prepareReloadedHosts(&newTargets, oldTargets)
+
 	// Compare targets and identify changes
-	added, removed, unchanged := sp.compareTargets(oldTargets, newTargets)
+	added, removed, changed, unchanged := sp.compareTargets(oldTargets, newTargets)
 
 	// Update targets with write lock
 	sp.targetsMux.Lock()
 	sp.targets = newTargets
 	sp.targetsMux.Unlock()
 
+	// Stop schedules of removed targets and restart those whose settings changed
+	for _, target := range removed {
+		sp.stopSchedule(targetKey(target.OrgName, target.Host))
+		sp.clearAlarmStates(target.OrgName, target.Host)
+		sp.removeFromSinks(target.OrgName, target.Host)
+	}
+	for _, target := range changed {
+		sp.stopSchedule(targetKey(target.OrgName, target.Host))
+	}
+	sp.startSchedules(append(added, changed...))
+
 	// Report changes
-	if len(added) > 0 || len(removed) > 0 {
-		log.Printf("Target changes detected: %d added, %d removed, %d unchanged",
-			len(added), len(removed), len(unchanged))
+	if len(added) > 0 || len(removed) > 0 || len(changed) > 0 {
+		log.Printf("Target changes detected: %d added, %d removed, %d changed, %d unchanged",
+			len(added), len(removed), len(changed), len(unchanged))
 
 		if sp.verbose {
 			if len(added) > 0 {
@@ -1810,6 +3843,12 @@ func (sp *SmogPing) applyTargetChanges(newTargets TargetsConfig, oldTargets Targ
 					log.Printf("  %s (%s) in %s", target.Host.Name, target.Host.IP, target.OrgName)
 				}
 			}
+			if len(changed) > 0 {
+				log.Printf("Changed targets (schedule restarted):")
+				for _, target := range changed {
+					log.Printf("  %s (%s) in %s", target.Host.Name, target.Host.IP, target.OrgName)
+				}
+			}
 		}
 
 		// Update file watcher for new included files
@@ -1828,861 +3867,3440 @@ func (sp *SmogPing) applyTargetChanges(newTargets TargetsConfig, oldTargets Targ
 	}
 }
 
-// compareTargets compares old and new targets to identify changes
-func (sp *SmogPing) compareTargets(oldTargets, newTargets TargetsConfig) (added, removed, unchanged []TargetInfo) {
-	// Create maps for easier comparison
-	oldMap := make(map[string]TargetInfo)
-	newMap := make(map[string]TargetInfo)
-
-	// Populate old targets map
+// prepareReloadedHosts copies DNS state of known hosts and resolves newly added DNS names.
+// Unchanged expanded hosts keep their addresses, which the DNS refresh keeps up to date.
+// Added hosts whose DNS name cannot be resolved are dropped, as during startup.
+func (sp *SmogPing) prepareReloadedHosts(newTargets *TargetsConfig, oldTargets TargetsConfig) {
+	oldHosts := make(map[string]Host)
+	oldBackends := make(map[string][]Host)
 	for orgName, org := range oldTargets.Organizations {
 		for _, host := range org.Hosts {
-			key := fmt.Sprintf("%s_%s_%s", orgName, host.Name, host.IP)
-			oldMap[key] = TargetInfo{Host: host, OrgName: orgName}
+			oldHosts[targetKey(orgName, host)] = host
+			if host.Backend != "" {
+				key := backendGroupKey(orgName, host)
+				oldBackends[key] = append(oldBackends[key], host)
+			}
+		}
+	}
+
+	for orgName, org := range newTargets.Organizations {
+		validHosts := make([]Host, 0, len(org.Hosts))
+		for _, host := range org.Hosts {
+			if host.Expand {
+				current := oldBackends[backendGroupKey(orgName, host)]
+				if len(current) > 0 && !hostSettingsChanged(current[0], host) {
+					for _, backend := range current {
+						validHosts = append(validHosts, withBackend(host, backend))
+					}
+					continue
+				}
+
+				backends, err := sp.expandHost(orgName, host)
+				if err != nil && len(current) > 0 {
+					log.Printf("WARNING: Failed to resolve DNS name %s for host %s in %s: %v - keeping %d existing addresses",
+						host.IP, host.Name, orgName, err, len(current))
+					for _, backend := range current {
+						validHosts = append(validHosts, withBackend(host, backend))
+					}
+					continue
+				}
+				if err != nil {
+					log.Printf("WARNING: Failed to resolve DNS name %s for host %s in %s: %v - not adding to targets",
+						host.IP, host.Name, orgName, err)
+					continue
+				}
+				validHosts = append(validHosts, backends...)
+				continue
+			}
+
+			if oldHost, exists := oldHosts[targetKey(orgName, host)]; exists && !hostSettingsChanged(oldHost, host) {
+				host.IsDNSName = oldHost.IsDNSName
+				host.ResolvedIP = oldHost.ResolvedIP
+				host.LastDNSCheck = oldHost.LastDNSCheck
+				host.AddressFamily = oldHost.AddressFamily
+			} else if err := sp.resolveHostAddress(orgName, &host); err != nil {
+				log.Printf("WARNING: Failed to resolve DNS name %s for host %s in %s: %v - not adding to targets",
+					host.IP, host.Name, orgName, err)
+				continue
+			}
+			validHosts = append(validHosts, host)
+		}
+		org.Hosts = validHosts
+		newTargets.Organizations[orgName] = org
+	}
+}
+
+// targetKey returns the key identifying a target across reloads
+func targetKey(orgName string, host Host) string {
+	if host.Backend != "" {
+		return backendGroupKey(orgName, host) + "_" + host.Backend
+	}
+	return backendGroupKey(orgName, host)
+}
+
+// backendGroupKey returns the key shared by all targets expanded from the same host
+func backendGroupKey(orgName string, host Host) string {
+	return fmt.Sprintf("%s_%s_%s%s", orgName, host.Name, host.IP, dualStackSuffix(host))
+}
+
+// dualStackSuffix tells the two targets of a host with family "both" apart in target and alarm keys
+func dualStackSuffix(host Host) string {
+	if hostFamily(host) != familyBoth {
+		return ""
+	}
+	return fmt.Sprintf("_ipv%d", host.AddressFamily)
+}
+
+// hostSettingsChanged reports whether a target's schedule must be restarted to pick up new settings
+func hostSettingsChanged(oldHost, newHost Host) bool {
+	return oldHost.AlarmPing != newHost.AlarmPing ||
+		oldHost.AlarmLoss != newHost.AlarmLoss ||
+		oldHost.AlarmJitter != newHost.AlarmJitter ||
+		oldHost.WarnPing != newHost.WarnPing ||
+		oldHost.WarnLoss != newHost.WarnLoss ||
+		oldHost.WarnJitter != newHost.WarnJitter ||
+		oldHost.ClearPing != newHost.ClearPing ||
+		oldHost.ClearLoss != newHost.ClearLoss ||
+		oldHost.ClearJitter != newHost.ClearJitter ||
+		oldHost.AlarmCount != newHost.AlarmCount ||
+		oldHost.AlarmWindow != newHost.AlarmWindow ||
+		oldHost.AlarmReceiver != newHost.AlarmReceiver ||
+		oldHost.AlarmWebhook != newHost.AlarmWebhook ||
+		oldHost.PingSource != newHost.PingSource ||
+		hostProbe(oldHost) != hostProbe(newHost) ||
+		oldHost.Port != newHost.Port ||
+		oldHost.URL != newHost.URL ||
+		oldHost.Method != newHost.Method ||
+		oldHost.ExpectStatus != newHost.ExpectStatus ||
+		oldHost.ExpectBody != newHost.ExpectBody ||
+		oldHost.Query != newHost.Query ||
+		oldHost.QueryType != newHost.QueryType ||
+		oldHost.Transport != newHost.Transport ||
+		oldHost.ExpectRcode != newHost.ExpectRcode ||
+		oldHost.ExpectAnswer != newHost.ExpectAnswer ||
+		hostFamily(oldHost) != hostFamily(newHost) ||
+		oldHost.Expand != newHost.Expand ||
+		oldHost.DataPointPings != newHost.DataPointPings ||
+		oldHost.DataPointTime != newHost.DataPointTime ||
+		oldHost.PingTimeout != newHost.PingTimeout ||
+		oldHost.BackendsDown != newHost.BackendsDown ||
+		!maps.Equal(oldHost.Tags, newHost.Tags)
+}
+
+// compareTargets compares old and new targets to identify changes
+func (sp *SmogPing) compareTargets(oldTargets, newTargets TargetsConfig) (added, removed, changed, unchanged []TargetInfo) {
+	// Create maps for easier comparison
+	oldMap := make(map[string]TargetInfo)
+	newMap := make(map[string]TargetInfo)
+
+	// Populate old targets map
+	for orgName, org := range oldTargets.Organizations {
+		for _, host := range org.Hosts {
+			oldMap[targetKey(orgName, host)] = TargetInfo{Host: host, OrgName: orgName}
 		}
 	}
 
-	// Populate new targets map and identify added/unchanged
+	// Populate new targets map and identify added/changed/unchanged
 	for orgName, org := range newTargets.Organizations {
 		for _, host := range org.Hosts {
-			key := fmt.Sprintf("%s_%s_%s", orgName, host.Name, host.IP)
+			key := targetKey(orgName, host)
 			targetInfo := TargetInfo{Host: host, OrgName: orgName}
 			newMap[key] = targetInfo
 
-			if _, exists := oldMap[key]; exists {
-				unchanged = append(unchanged, targetInfo)
-			} else {
+			if oldInfo, exists := oldMap[key]; !exists {
 				added = append(added, targetInfo)
+			} else if hostSettingsChanged(oldInfo.Host, host) {
+				changed = append(changed, targetInfo)
+			} else {
+				unchanged = append(unchanged, targetInfo)
+			}
+		}
+	}
+
+	// Identify removed targets
+	for key, targetInfo := range oldMap {
+		if _, exists := newMap[key]; !exists {
+			removed = append(removed, targetInfo)
+		}
+	}
+
+	return added, removed, changed, unchanged
+}
+
+// updateWatchedFiles watches the targets files and the directories of include glob patterns,
+// so files that newly match a pattern are loaded when they appear
+func (sp *SmogPing) updateWatchedFiles() {
+	if sp.watcher == nil {
+		return
+	}
+
+	// Get current watched files
+	watchedFiles := make(map[string]bool)
+	for _, watchedFile := range sp.watcher.WatchList() {
+		watchedFiles[filepath.Clean(watchedFile)] = true
+	}
+
+	sp.targetsMux.RLock()
+	files := slices.Clone(sp.targets.Files)
+	for _, file := range sp.targets.FailedFiles {
+		// Missing files are watched for in their directory until they are created
+		if _, err := os.Stat(file); err != nil {
+			file = filepath.Dir(file)
+		}
+		files = append(files, file)
+	}
+	var dirs []string
+	for _, pattern := range sp.targets.IncludePatterns {
+		// Directories with glob characters cannot be watched, their new files are found on the next reload
+		if dir := filepath.Dir(pattern); !strings.ContainsAny(dir, "*?[") && !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	sp.targetsMux.RUnlock()
+
+	for _, file := range append(files, dirs...) {
+		if watchedFiles[filepath.Clean(file)] {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		kind := "file"
+		if info.IsDir() {
+			kind = "directory"
+		}
+		if err := sp.watcher.Add(file); err != nil {
+			sp.verbosef("Warning: Failed to watch %s %s: %v", kind, file, err)
+		} else {
+			sp.verbosef("Watching %s: %s", kind, file)
+			watchedFiles[filepath.Clean(file)] = true
+		}
+	}
+}
+
+// isTargetsFile reports whether a file is a loaded or failed targets file or matches an include pattern
+func (sp *SmogPing) isTargetsFile(file string) bool {
+	file = filepath.Clean(file)
+	sp.targetsMux.RLock()
+	defer sp.targetsMux.RUnlock()
+
+	for _, targetsFile := range slices.Concat(sp.targets.Files, sp.targets.FailedFiles) {
+		if filepath.Clean(targetsFile) == file {
+			return true
+		}
+	}
+	for _, pattern := range sp.targets.IncludePatterns {
+		if matched, _ := filepath.Match(pattern, file); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validateConfiguration performs sanity checks on the configuration and target count
+func (sp *SmogPing) validateConfiguration(config Config) error {
+	// Get current targets with read lock
+	sp.targetsMux.RLock()
+	currentTargets := sp.targets
+	sp.targetsMux.RUnlock()
+
+	// Count total hosts and sum up their sampling rates, which hosts and organizations may override
+	totalHosts := 0
+	var targetLoad float64 // Targets weighted by their probe rate compared to the global one
+	var dataPointsPerMinute float64
+	shortIntervals, overlapping := 0, 0
+	minInterval := time.Duration(math.MaxInt64)
+	for _, org := range currentTargets.Organizations {
+		for _, host := range org.Hosts {
+			totalHosts++
+			pings, dataPointTime, timeout := hostSampling(host, config)
+			interval := dataPointTime / time.Duration(pings)
+
+			targetLoad += probeLoad(host, config)
+			dataPointsPerMinute += 60 / dataPointTime.Seconds()
+			if interval < time.Second {
+				shortIntervals++
+			}
+			if timeout > interval {
+				overlapping++
 			}
+			minInterval = min(minInterval, interval)
+		}
+	}
+	effectiveTargets := int(math.Ceil(targetLoad))
+
+	// Calculate theoretical maximum targets that can be handled
+	// The scheduler runs at most max_concurrent_pings probes at once, and schedules are staggered
+	// over data_point_time, so each worker can serve one target per second of the data point time.
+	// Hosts with their own datapointpings or datapointtime count in proportion to their probe rate.
+	maxTargets := config.MaxConcurrentPings * config.DataPointTime
+
+	if sp.verbose {
+		log.Printf("Configuration validation:")
+		log.Printf("  Total targets: %d", totalHosts)
+		if effectiveTargets != totalHosts {
+			log.Printf("  Effective targets at %d pings per %d seconds: %d",
+				config.DataPointPings, config.DataPointTime, effectiveTargets)
+		}
+		log.Printf("  Max concurrent pings: %d", config.MaxConcurrentPings)
+		log.Printf("  Data point time: %d seconds", config.DataPointTime)
+		log.Printf("  Theoretical maximum targets: %d", maxTargets)
+	}
+
+	// Check if we exceed the theoretical maximum
+	if effectiveTargets > maxTargets {
+		return fmt.Errorf("target count (%d) exceeds theoretical maximum (%d). "+
+			"With %d max concurrent pings and %d second data point time, "+
+			"you can monitor at most %d targets. "+
+			"Consider increasing max_concurrent_pings or data_point_time",
+			effectiveTargets, maxTargets, config.MaxConcurrentPings,
+			config.DataPointTime, maxTargets)
+	}
+
+	// Warning if we're approaching the limit (80% or more)
+	warningThreshold := int(float64(maxTargets) * 0.8)
+	if effectiveTargets >= warningThreshold {
+		sp.configWarning("Target count (%d) is approaching the theoretical maximum (%d). "+
+			"Consider monitoring system performance and potentially increasing max_concurrent_pings "+
+			"if you plan to add more targets", effectiveTargets, maxTargets)
+	}
+
+	// Validate ping timing makes sense
+	if shortIntervals > 0 {
+		sp.configWarning("Ping interval is very short (%.2f seconds) for %d targets. "+
+			"Pings are sent every data point time divided by its pings. "+
+			"Consider reducing data_point_pings or increasing data_point_time",
+			minInterval.Seconds(), shortIntervals)
+	}
+
+	// Timeouts longer than the ping interval only delay the data point, pings are sent on schedule
+	if overlapping > 0 {
+		sp.verbosef("Ping timeout is longer than the ping interval for %d targets, "+
+			"their pings overlap and data points are written up to the ping timeout after their last ping",
+			overlapping)
+	}
+
+	// Validate InfluxDB batch settings
+	if config.InfluxBatchSize <= 0 && sp.verbose {
+		log.Printf("WARNING: InfluxDB batch size is %d, the default of 100 is used. "+
+			"Consider setting influx_batch_size to a positive value (recommended: 100-1000)",
+			config.InfluxBatchSize)
+	}
+
+	if config.InfluxBatchTime <= 0 && sp.verbose {
+		log.Printf("WARNING: InfluxDB batch time is %d seconds, the default of 10 is used. "+
+			"Consider setting influx_batch_time to a positive value (recommended: 5-30 seconds)",
+			config.InfluxBatchTime)
+	}
+
+	// Calculate expected data points per interval
+	if sp.verbose {
+		log.Printf("  Expected data points: ~%.0f per minute", dataPointsPerMinute)
+		log.Printf("Configuration validation completed successfully")
+	}
+
+	return nil
+}
+
+// configWarning logs a warning of the configuration sanity checks, or adds it to the report of a check
+func (sp *SmogPing) configWarning(format string, args ...interface{}) {
+	if sp.check != nil {
+		sp.check.addWarning(sp.configFile, "", fmt.Sprintf(format, args...))
+		return
+	}
+	log.Printf("WARNING: "+format, args...)
+}
+
+// startPingMonitoring starts individual ping schedules for each target
+func (sp *SmogPing) startPingMonitoring() {
+	sp.verbosef("Starting ping monitoring: %d pings per %ds (interval: %v)",
+		sp.config.DataPointPings, sp.config.DataPointTime, sp.pingInterval())
+
+	// Get current targets
+	sp.targetsMux.RLock()
+	var targets []TargetInfo
+	for orgName, org := range sp.targets.Organizations {
+		for _, host := range org.Hosts {
+			targets = append(targets, TargetInfo{Host: host, OrgName: orgName})
+		}
+	}
+	sp.targetsMux.RUnlock()
+
+	sp.startSchedules(targets)
+}
+
+// pingInterval returns the time between individual pings of a target
+func (sp *SmogPing) pingInterval() time.Duration {
+	config := sp.currentConfig()
+	return time.Duration(config.DataPointTime) * time.Second / time.Duration(config.DataPointPings)
+}
+
+// startSchedules starts ping schedules for the given targets with staggered starts
+func (sp *SmogPing) startSchedules(targets []TargetInfo) {
+	if len(targets) == 0 {
+		return
+	}
+
+	staggerDelay := sp.pingInterval() / time.Duration(len(targets))
+	if staggerDelay > 100*time.Millisecond {
+		staggerDelay = 100 * time.Millisecond // Cap at 100ms
+	}
+
+	sp.verbosef("Starting %d individual ping schedules with %v stagger delay", len(targets), staggerDelay)
+
+	for i, target := range targets {
+		// Stagger the start times to avoid thundering herd
+		sp.startSchedule(target.OrgName, target.Host, time.Duration(i)*staggerDelay)
+	}
+}
+
+// startSchedule registers the ping schedule of a single target with the scheduler
+func (sp *SmogPing) startSchedule(orgName string, host Host, delay time.Duration) {
+	key := targetKey(orgName, host)
+
+	sp.schedulesMux.Lock()
+	defer sp.schedulesMux.Unlock()
+
+	if sp.schedules == nil {
+		sp.schedules = make(map[string]*PingSchedule)
+	}
+	if _, exists := sp.schedules[key]; exists {
+		sp.debugf("Ping schedule for %s (%s) in %s already running", host.Name, host.IP, orgName)
+		return
+	}
+
+	schedule := sp.newPingSchedule(orgName, host, delay)
+	sp.debugf("Started ping schedule for %s (%s): ping every %v, first at %s",
+		host.Name, host.IP, schedule.interval, schedule.next.Format(time.RFC3339Nano))
+
+	sp.schedules[key] = schedule
+	sp.scheduler.Add(schedule)
+}
+
+// stopSchedule removes the ping schedule of a single target, its data point in progress is discarded
+func (sp *SmogPing) stopSchedule(key string) {
+	sp.schedulesMux.Lock()
+	schedule, exists := sp.schedules[key]
+	delete(sp.schedules, key)
+	sp.schedulesMux.Unlock()
+
+	if !exists {
+		return
+	}
+
+	sp.scheduler.Remove(schedule)
+	sp.debugf("Stopped ping schedule for %s (%s) in %s",
+		schedule.Host.Name, schedule.Host.IP, schedule.OrgName)
+}
+
+// pendingDataPoint collects the probes of a data point until all of them have finished
+type pendingDataPoint struct {
+	startTime time.Time
+	samples   []ProbeSample
+	finished  int
+}
+
+// alignedWindowStart returns the start of the window containing t, with windows of the given
+// length counted from the Unix epoch
+func alignedWindowStart(t time.Time, window time.Duration) time.Time {
+	return time.Unix(0, t.UnixNano()-t.UnixNano()%int64(window))
+}
+
+// newPingSchedule creates the schedule of a target from its current sampling settings. The first
+// probe is due after the stagger delay, or with align_data_points at that offset into the next
+// data_point_time window.
+func (sp *SmogPing) newPingSchedule(orgName string, host Host, delay time.Duration) *PingSchedule {
+	config := sp.currentConfig()
+	pings, dataPointTime, _ := hostSampling(host, config)
+	interval := dataPointTime / time.Duration(pings)
+
+	schedule := &PingSchedule{
+		OrgName:        orgName,
+		Host:           host,
+		dataPointPings: pings,
+		interval:       interval,
+		align:          config.AlignDataPoints,
+		window:         dataPointTime,
+		offset:         delay % interval,
+		heapIndex:      -1,
+		pending:        make(map[int]*pendingDataPoint),
+		resolvedPoint:  -1,
+	}
+
+	// Aligned data points start on multiples of data_point_time since the epoch and are
+	// timestamped with their window start, the stagger offset spreads the pings inside it
+	schedule.windowStart = alignedWindowStart(time.Now(), schedule.window).Add(schedule.window)
+	schedule.next = time.Now().Add(delay + interval)
+	if schedule.align {
+		schedule.next = schedule.windowStart.Add(schedule.offset)
+	}
+	return schedule
+}
+
+// nextProbe returns the probe that is due and advances the schedule to the one after it
+func (ps *PingSchedule) nextProbe() probeJob {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.index == 0 {
+		startTime := time.Now()
+		if ps.align {
+			startTime = ps.windowStart
+		}
+		ps.pending[ps.dataPoint] = &pendingDataPoint{startTime: startTime, samples: make([]ProbeSample, ps.dataPointPings)}
+	}
+	job := probeJob{schedule: ps, host: ps.Host, dataPoint: ps.dataPoint, index: ps.index, due: ps.next}
+
+	ps.index++
+	if ps.index >= ps.dataPointPings {
+		ps.dataPoint++
+		ps.index = 0
+		ps.windowStart = ps.windowStart.Add(ps.window)
+		// Skip windows that already passed, e.g. after the system was suspended
+		if ps.align && time.Now().After(ps.windowStart.Add(ps.window)) {
+			ps.windowStart = alignedWindowStart(time.Now(), ps.window).Add(ps.window)
+		}
+	}
+
+	ps.next = ps.next.Add(ps.interval)
+	if ps.align {
+		ps.next = ps.windowStart.Add(ps.offset + time.Duration(ps.index)*ps.interval)
+	}
+	return job
+}
+
+// finishProbe stores the outcome of a probe. Once every probe of its data point has finished it
+// returns the data point with the host as it was before, and records the address last probed.
+// Data points finish out of order when a probe of an older one times out after a newer one has
+// finished, so only a data point newer than the last one recorded updates the address.
+func (ps *PingSchedule) finishProbe(job probeJob, sample ProbeSample) (*pendingDataPoint, Host) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	point, exists := ps.pending[job.dataPoint]
+	if ps.stopped || !exists {
+		return nil, Host{}
+	}
+	point.samples[job.index] = sample
+	point.finished++
+
+	// Wait until every probe of the data point has finished
+	if point.finished < ps.dataPointPings {
+		return nil, Host{}
+	}
+	delete(ps.pending, job.dataPoint)
+
+	host := ps.Host
+	if job.dataPoint > ps.resolvedPoint {
+		ps.resolvedPoint = job.dataPoint
+		ps.Host.ResolvedIP = point.samples[ps.dataPointPings-1].TargetIP
+	}
+	return point, host
+}
+
+// recordProbe hands the outcome of a probe to its schedule and stores the data point it completes
+func (sp *SmogPing) recordProbe(job probeJob, sample ProbeSample) {
+	host := job.host
+	if sample.Success {
+		sp.debugf("Ping %d/%d for %s (%s): %v", job.index+1, job.schedule.dataPointPings, host.Name, host.IP, sample.RTT)
+	} else if !sample.Dropped {
+		sp.debugf("Ping %d/%d for %s (%s): failed", job.index+1, job.schedule.dataPointPings, host.Name, host.IP)
+	}
+
+	point, host := job.schedule.finishProbe(job, sample)
+	if point == nil {
+		return
+	}
+
+	// Probes dropped under back-pressure say nothing about the target, they are reported in the
+	// dropped field of the data point and left out of its loss
+	rtts := make([]time.Duration, 0, len(point.samples))
+	var phaseTotals HTTPPhases // Summed HTTP phase timings of the successful pings
+	var sent []ProbeSample
+	for _, sample := range point.samples {
+		if sample.Dropped {
+			continue
+		}
+		sent = append(sent, sample)
+		if sample.Success {
+			rtts = append(rtts, sample.RTT)
+			phaseTotals.add(sample.Phases)
 		}
 	}
+	if len(sent) == 0 {
+		sp.verbosef("Skipping data point for %s (%s), all its probes were dropped because the probe queue was full",
+			host.Name, host.IP)
+		return
+	}
+
+	// Track address changes made by DNS refresh within this data point
+	firstIP := sent[0].TargetIP
+	lastIP := sent[len(sent)-1].TargetIP
+	if lastIP != host.ResolvedIP {
+		sp.verbosef("Ping target for %s (%s) changed from %s to %s", host.Name, host.IP, host.ResolvedIP, lastIP)
+	}
+	host.ResolvedIP = lastIP
+
+	// Remember the old address if the data point spans a DNS change
+	previousIP := ""
+	if firstIP != lastIP {
+		previousIP = firstIP
+	}
+
+	// Calculate and store the data point
+	sp.processDataPoint(job.schedule.OrgName, host, rtts, phaseTotals, len(sent), len(point.samples)-len(sent), point.startTime, previousIP)
+}
+
+// probeJob is a single due probe handed from the scheduler to the worker pool
+type probeJob struct {
+	schedule  *PingSchedule
+	host      Host
+	dataPoint int       // Sequence number of the data point within the schedule
+	index     int       // Position of the probe within the data point
+	due       time.Time // When the probe should have been sent
+}
+
+// schedulerQueueSize is how many due probes may wait for a free worker before probes are dropped
+const schedulerQueueSize = 10000
+
+// SchedulerStats counts the work of the scheduler for its back-pressure metrics
+type SchedulerStats struct {
+	ProbesSent     atomic.Uint64 // Probes sent by a worker
+	ProbesDropped  atomic.Uint64 // Probes not sent because the queue was full
+	WorkersBusy    atomic.Int64  // Workers currently sending a probe
+	ProbesInFlight atomic.Int64  // Probes sent and waiting for their reply or timeout
+}
+
+// Scheduler sends the probes of all targets from a single timer heap. Due probes are queued for
+// a pool of max_concurrent_pings workers, so that setting bounds how many probes are sent at once.
+// Workers only send, replies are collected asynchronously so timeouts do not hold a worker.
+type Scheduler struct {
+	sp         *SmogPing
+	mu         sync.Mutex // Protects queue and workers
+	queue      scheduleHeap
+	workers    int
+	wake       chan struct{} // Signals a new earliest due time to the timer loop
+	jobs       chan probeJob // Due probes waiting for a worker
+	stopWorker chan struct{} // Stops one worker when the pool shrinks
+	stats      SchedulerStats
+	waitMux    sync.Mutex     // Protects queueWait
+	queueWait  *PromHistogram // Time probes waited for a worker in milliseconds
+}
+
+// newScheduler creates the scheduler and starts its timer loop and worker pool
+func (sp *SmogPing) newScheduler() *Scheduler {
+	scheduler := &Scheduler{
+		sp:         sp,
+		wake:       make(chan struct{}, 1),
+		jobs:       make(chan probeJob, schedulerQueueSize),
+		stopWorker: make(chan struct{}),
+		queueWait:  NewPromHistogram(rttBucketsMs),
+	}
+
+	scheduler.Resize(sp.config.MaxConcurrentPings)
+
+	sp.wg.Add(1)
+	go scheduler.run()
+
+	sp.verbosef("Probe scheduler configured: %d workers, queue size %d", sp.config.MaxConcurrentPings, schedulerQueueSize)
+	return scheduler
+}
+
+// Add queues a schedule, its first probe is sent when due
+func (s *Scheduler) Add(schedule *PingSchedule) {
+	s.mu.Lock()
+	heap.Push(&s.queue, schedule)
+	s.mu.Unlock()
+	s.notify()
+}
+
+// Remove stops a schedule, outcomes of its probes still running are discarded
+func (s *Scheduler) Remove(schedule *PingSchedule) {
+	s.mu.Lock()
+	if schedule.heapIndex >= 0 {
+		heap.Remove(&s.queue, schedule.heapIndex)
+	}
+	s.mu.Unlock()
+
+	schedule.mu.Lock()
+	schedule.stopped = true
+	schedule.mu.Unlock()
+}
+
+// Resize changes the number of workers, busy workers stop after their current probe
+func (s *Scheduler) Resize(workers int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.workers < workers {
+		s.workers++
+		s.sp.wg.Add(1)
+		go s.worker()
+	}
+	for s.workers > workers {
+		s.workers--
+		go func() {
+			select {
+			case s.stopWorker <- struct{}{}:
+			case <-s.sp.ctx.Done():
+			}
+		}()
+	}
+}
+
+// Close logs the scheduler statistics once all schedules have stopped
+func (s *Scheduler) Close() {
+	log.Printf("Probe scheduler: %d probes sent, %d dropped", s.stats.ProbesSent.Load(), s.stats.ProbesDropped.Load())
+}
+
+// notify wakes the timer loop to pick up a changed earliest due time
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run queues due probes for the workers until shutdown
+func (s *Scheduler) run() {
+	defer s.sp.wg.Done()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		var dropped []probeJob
+		wait := time.Hour
+
+		s.mu.Lock()
+		now := time.Now()
+		for len(s.queue) > 0 && !s.queue[0].next.After(now) {
+			job := s.queue[0].nextProbe()
+			heap.Fix(&s.queue, 0)
+
+			select {
+			case s.jobs <- job:
+			default:
+				dropped = append(dropped, job)
+			}
+		}
+		if len(s.queue) > 0 {
+			wait = time.Until(s.queue[0].next)
+		}
+		s.mu.Unlock()
+
+		// All workers are busy and the queue is full, the probes are reported as dropped in their data points
+		for _, job := range dropped {
+			s.stats.ProbesDropped.Add(1)
+			s.sp.debugf("Probe queue full, dropping ping %d for %s (%s)", job.index+1, job.host.Name, job.host.IP)
+			s.sp.recordProbe(job, ProbeSample{TargetIP: s.sp.currentTargetIP(job.host), Dropped: true})
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-s.sp.ctx.Done():
+			return
+		case <-timer.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// worker runs queued probes until shutdown or until the pool shrinks
+func (s *Scheduler) worker() {
+	defer s.sp.wg.Done()
+
+	for {
+		select {
+		case <-s.sp.ctx.Done():
+			return
+		case <-s.stopWorker:
+			return
+		case job := <-s.jobs:
+			waited := time.Since(job.due)
+			s.waitMux.Lock()
+			s.queueWait.Observe(math.Max(float64(waited.Nanoseconds())/1e6, 0))
+			s.waitMux.Unlock()
+
+			// The worker only sends the probe, its outcome is recorded when the reply arrives or
+			// the ping timeout expires. Shutdown waits for probes in flight.
+			s.stats.WorkersBusy.Add(1)
+			s.stats.ProbesInFlight.Add(1)
+			s.sp.wg.Add(1)
+			s.sp.startProbe(job.host, func(sample ProbeSample) {
+				defer s.sp.wg.Done()
+				s.stats.ProbesInFlight.Add(-1)
+				s.sp.recordProbe(job, sample)
+			})
+			s.stats.WorkersBusy.Add(-1)
+			s.stats.ProbesSent.Add(1)
+		}
+	}
+}
+
+// WriteMetrics writes the scheduler back-pressure metrics in the Prometheus text format
+func (s *Scheduler) WriteMetrics(w io.Writer) {
+	s.mu.Lock()
+	workers := s.workers
+	schedules := len(s.queue)
+	s.mu.Unlock()
+
+	gauges := []struct {
+		name  string
+		help  string
+		value int64
+	}{
+		{"smogping_scheduler_targets", "Targets with a running ping schedule.", int64(schedules)},
+		{"smogping_scheduler_workers", "Size of the probe worker pool (max_concurrent_pings).", int64(workers)},
+		{"smogping_scheduler_workers_busy", "Workers currently sending a probe.", s.stats.WorkersBusy.Load()},
+		{"smogping_scheduler_queue_length", "Due probes waiting for a free worker.", int64(len(s.jobs))},
+		{"smogping_scheduler_probes_in_flight", "Probes sent and waiting for their reply or timeout.", s.stats.ProbesInFlight.Load()},
+	}
+	for _, gauge := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", gauge.name, gauge.help, gauge.name, gauge.name, gauge.value)
+	}
+
+	counters := []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"smogping_scheduler_probes_sent_total", "Probes sent by the worker pool.", s.stats.ProbesSent.Load()},
+		{"smogping_scheduler_probes_dropped_total", "Probes not sent because the probe queue was full, reported in the dropped field of their data points.", s.stats.ProbesDropped.Load()},
+	}
+	for _, counter := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", counter.name, counter.help, counter.name, counter.name, counter.value)
+	}
+
+	s.waitMux.Lock()
+	defer s.waitMux.Unlock()
+	name := "smogping_scheduler_queue_wait_ms"
+	fmt.Fprintf(w, "# HELP %s Time probes waited for a free worker after they were due in milliseconds.\n# TYPE %s histogram\n", name, name)
+	var cumulative uint64
+	for i, bound := range s.queueWait.Buckets {
+		cumulative += s.queueWait.Counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatPromValue(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, s.queueWait.Count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, formatPromValue(s.queueWait.Sum), name, s.queueWait.Count)
+}
+
+// scheduleHeap orders ping schedules by the due time of their next probe
+type scheduleHeap []*PingSchedule
+
+func (h scheduleHeap) Len() int           { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool { return h[i].next.Before(h[j].next) }
+func (h scheduleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *scheduleHeap) Push(x any) {
+	schedule := x.(*PingSchedule)
+	schedule.heapIndex = len(*h)
+	*h = append(*h, schedule)
+}
+
+func (h *scheduleHeap) Pop() any {
+	old := *h
+	schedule := old[len(old)-1]
+	old[len(old)-1] = nil
+	schedule.heapIndex = -1
+	*h = old[:len(old)-1]
+	return schedule
+}
+
+// Probe types selectable per host with the probe setting
+const (
+	probeICMP = "icmp"
+	probeTCP  = "tcp"
+	probeHTTP = "http"
+	probeDNS  = "dns"
+)
+
+// httpProbeMethods are the request methods allowed for http probes
+var httpProbeMethods = map[string]bool{"GET": true, "HEAD": true, "POST": true, "OPTIONS": true}
+
+// httpProbeMaxBody limits how much of a response body an http probe reads
+const httpProbeMaxBody = 1 << 20
+
+// httpBodyPatterns caches compiled expectbody expressions by pattern
+var httpBodyPatterns sync.Map
+
+// ProbeSample is the outcome of a single probe of a data point
+type ProbeSample struct {
+	RTT      time.Duration
+	TargetIP string // Address probed
+	Success  bool
+	Phases   HTTPPhases // Request phase timings, http probes only
+	Dropped  bool       // Not sent because the probe queue was full, not counted as loss
+}
+
+// HTTPPhases holds the phase timings of an HTTP request, each measured from the start of the request
+// except Connect and TLS which are the durations of those phases
+type HTTPPhases struct {
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	TTFB    time.Duration
+	Total   time.Duration
+}
+
+// add sums the timings of another sample
+func (p *HTTPPhases) add(other HTTPPhases) {
+	p.DNS += other.DNS
+	p.Connect += other.Connect
+	p.TLS += other.TLS
+	p.TTFB += other.TTFB
+	p.Total += other.Total
+}
+
+// average divides summed timings by the number of samples
+func (p HTTPPhases) average(samples int) HTTPPhases {
+	if samples == 0 {
+		return HTTPPhases{}
+	}
+	n := time.Duration(samples)
+	return HTTPPhases{DNS: p.DNS / n, Connect: p.Connect / n, TLS: p.TLS / n, TTFB: p.TTFB / n, Total: p.Total / n}
+}
+
+// Address families selectable per host and organization with the family setting
+const (
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+	familyBoth = "both"
+)
+
+// isValidFamily reports whether a family setting is empty or a known family
+func isValidFamily(family string) bool {
+	switch strings.ToLower(family) {
+	case "", familyIPv4, familyIPv6, familyBoth:
+		return true
+	}
+	return false
+}
+
+// hostFamily returns the normalized family setting of a host, "" when none is configured
+func hostFamily(host Host) string {
+	return strings.ToLower(host.Family)
+}
+
+// ipFamily returns 4 or 6 for an IP address and 0 for anything else
+func ipFamily(address string) int {
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return 0
+	case ip.To4() != nil:
+		return 4
+	default:
+		return 6
+	}
+}
+
+// declaredFamily returns the family a host is known to use before resolution: that of an IP
+// address, or the one set with family. It returns 0 for DNS names without a single family.
+func declaredFamily(host Host) int {
+	if family := ipFamily(host.IP); family != 0 {
+		return family
+	}
+	switch hostFamily(host) {
+	case familyIPv4:
+		return 4
+	case familyIPv6:
+		return 6
+	}
+	return 0
+}
+
+// sourceFamilyMismatch returns why a source address cannot be used for a host with the given
+// target family, or "" if it can
+func sourceFamilyMismatch(source string, host Host, targetFamily int) string {
+	sourceFamily := ipFamily(source)
+	if sourceFamily == 0 {
+		return ""
+	}
+	if hostFamily(host) == familyBoth && host.AddressFamily == 0 {
+		return fmt.Sprintf("source address %s cannot serve both address families, use family 'ipv4' or 'ipv6'", source)
+	}
+	if targetFamily != 0 && targetFamily != sourceFamily {
+		return fmt.Sprintf("source address %s is IPv%d but the target is IPv%d", source, sourceFamily, targetFamily)
+	}
+	return ""
+}
+
+// pingSourceFor returns the source address to probe a host from, "" for OS routing.
+// A per-host pingsource takes precedence over the global ping_source.
+func pingSourceFor(host Host, config Config) string {
+	if host.PingSource != "" && host.PingSource != "default" {
+		return host.PingSource
+	}
+	if config.PingSource != "" && config.PingSource != "default" {
+		return config.PingSource
+	}
+	return ""
+}
+
+// hostProbe returns the probe type of a host, ICMP when none is configured
+func hostProbe(host Host) string {
+	if host.Probe == "" {
+		return probeICMP
+	}
+	return strings.ToLower(host.Probe)
+}
+
+// startProbe sends a single probe to a host and calls done with its outcome once the reply arrived
+// or the ping timeout expired. ICMP replies are collected by the ICMP engine and connection based
+// probes finish on a goroutine of their own, so the caller is not held for the reply.
+func (sp *SmogPing) startProbe(host Host, done func(ProbeSample)) {
+	config := sp.currentConfig()
+
+	// Use the current resolved address, which follows DNS refresh changes
+	targetIP := sp.currentTargetIP(host)
+	_, _, timeout := hostSampling(host, config)
+
+	// Set source IP if configured - check host-specific first, then global
+	sourceIP := pingSourceFor(host, config)
+	if sourceIP != "" {
+		sp.debugf("Using source IP %s for probing %s", sourceIP, targetIP)
+	}
+
+	sample := ProbeSample{TargetIP: targetIP}
+	switch hostProbe(host) {
+	case probeTCP:
+		go func() {
+			sample.RTT, sample.Success = sp.sendTCPProbe(host, targetIP, sourceIP, timeout)
+			done(sample)
+		}()
+	case probeHTTP:
+		go func() {
+			sample.Phases, sample.Success = sp.sendHTTPProbe(host, targetIP, sourceIP, timeout)
+			sample.RTT = sample.Phases.Total
+			done(sample)
+		}()
+	case probeDNS:
+		go func() {
+			sample.RTT, sample.Success = sp.sendDNSProbe(host, targetIP, sourceIP, timeout)
+			done(sample)
+		}()
+	default:
+		sp.sendICMPPing(host, targetIP, sourceIP, timeout, func(rtt time.Duration, success bool) {
+			sample.RTT, sample.Success = rtt, success
+			done(sample)
+		})
+	}
+}
+
+// sendICMPPing sends a single ICMP echo request, done is called with the RTT and success status
+func (sp *SmogPing) sendICMPPing(host Host, targetIP, sourceIP string, timeout time.Duration, done func(time.Duration, bool)) {
+	sp.icmpEngine.Send(targetIP, sourceIP, timeout, func(rtt time.Duration, err error) {
+		if err != nil {
+			sp.debugf("Ping failed for %s (%s -> %s): %v", host.Name, host.IP, targetIP, err)
+			done(0, false)
+			return
+		}
+		done(rtt, true)
+	})
+}
+
+// errICMPTimeout is returned for echo requests without a reply within the ping timeout
+var errICMPTimeout = errors.New("no reply within timeout")
+
+// icmpReopenAfter is how many receive errors in a row make the receive goroutine reopen its socket
+const icmpReopenAfter = 5
+
+// icmpMaxReceiveBackoff limits the pause between reads after receive errors
+const icmpMaxReceiveBackoff = 5 * time.Second
+
+// ICMPEngine sends ICMP echo requests for all targets over long-lived sockets, one per address
+// family and source address. Senders only write requests; a receive goroutine per socket reads
+// the replies and completes the waiting request, matched by identifier, sequence number, payload
+// token and peer address. Requests without a reply are completed by a timer.
+type ICMPEngine struct {
+	mu      sync.Mutex
+	sockets map[string]*icmpSocket // Open sockets keyed by family and source address
+	closed  bool
+}
+
+// icmpSocket is a single socket of the ICMP engine with its echo requests awaiting a reply
+type icmpSocket struct {
+	family   int
+	address  string // Local address the socket is bound to
+	id       int    // Echo identifier of the requests
+	token    []byte // Echo payload identifying the requests of this socket
+	mu       sync.Mutex
+	sequence uint16
+	pending  map[uint16]*icmpRequest // Requests awaiting a reply by sequence number
+	// Connection, replaced when the socket is reopened after receive errors
+	conn       *icmp.PacketConn
+	privileged bool // Raw socket, which also receives the replies of other processes
+	closed     bool
+}
+
+// icmpRequest is an echo request awaiting its reply
+type icmpRequest struct {
+	target net.IP
+	sent   time.Time
+	timer  *time.Timer                // Completes the request when the timeout expires
+	done   func(time.Duration, error) // Called once with the round-trip time or the failure
+}
+
+// NewICMPEngine creates an ICMP engine, sockets are opened on first use
+func NewICMPEngine() *ICMPEngine {
+	return &ICMPEngine{sockets: make(map[string]*icmpSocket)}
+}
+
+// Send sends one echo request to targetIP from sourceIP ("" for OS routing) without waiting for
+// the reply. done is called exactly once, with the round-trip time, or with an error if sending
+// failed or no reply arrived within timeout.
+func (e *ICMPEngine) Send(targetIP, sourceIP string, timeout time.Duration, done func(time.Duration, error)) {
+	target := net.ParseIP(targetIP)
+	if target == nil {
+		done(0, fmt.Errorf("invalid IP address %q", targetIP))
+		return
+	}
+
+	socket, err := e.socket(ipFamily(targetIP), sourceIP)
+	if err != nil {
+		done(0, err)
+		return
+	}
+
+	request := &icmpRequest{target: target, done: done}
+	sequence, err := socket.register(request, timeout)
+	if err != nil {
+		done(0, err)
+		return
+	}
+
+	var messageType icmp.Type = ipv4.ICMPTypeEcho
+	if socket.family == 6 {
+		messageType = ipv6.ICMPTypeEchoRequest
+	}
+	message := icmp.Message{
+		Type: messageType,
+		Body: &icmp.Echo{ID: socket.id, Seq: int(sequence), Data: socket.token},
+	}
+	packet, err := message.Marshal(nil)
+	if err != nil {
+		socket.complete(sequence, request, 0, err)
+		return
+	}
+
+	conn, privileged := socket.connection()
+	var destination net.Addr = &net.UDPAddr{IP: target}
+	if privileged {
+		destination = &net.IPAddr{IP: target}
+	}
+	if _, err := conn.WriteTo(packet, destination); err != nil {
+		socket.complete(sequence, request, 0, err)
+	}
+}
+
+// Close closes all sockets, requests still waiting for a reply time out
+func (e *ICMPEngine) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.closed = true
+	for key, socket := range e.sockets {
+		socket.close()
+		delete(e.sockets, key)
+	}
+}
+
+// socket returns the socket for the given family and source address, opening it if needed
+func (e *ICMPEngine) socket(family int, sourceIP string) (*icmpSocket, error) {
+	key := fmt.Sprintf("ipv%d/%s", family, sourceIP)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return nil, errors.New("ICMP engine closed")
+	}
+	if socket, exists := e.sockets[key]; exists {
+		return socket, nil
+	}
+
+	address := "0.0.0.0"
+	if family == 6 {
+		address = "::"
+	}
+	if sourceIP != "" {
+		address = sourceIP
+	}
+
+	conn, privileged, err := listenICMP(family, address)
+	if err != nil {
+		return nil, err
+	}
+
+	socket := newICMPSocket(family, address)
+	socket.conn, socket.privileged = conn, privileged
+	e.sockets[key] = socket
+
+	go socket.receive()
+	return socket, nil
+}
+
+// listenICMP opens an ICMP socket on address. It prefers unprivileged ICMP and falls back to a
+// raw socket when net.ipv4.ping_group_range does not allow it but SmogPing runs with CAP_NET_RAW.
+func listenICMP(family int, address string) (*icmp.PacketConn, bool, error) {
+	datagramNetwork, rawNetwork := "udp4", "ip4:icmp"
+	if family == 6 {
+		datagramNetwork, rawNetwork = "udp6", "ip6:ipv6-icmp"
+	}
+
+	conn, err := icmp.ListenPacket(datagramNetwork, address)
+	if err == nil {
+		return conn, false, nil
+	}
+	rawConn, rawErr := icmp.ListenPacket(rawNetwork, address)
+	if rawErr != nil {
+		return nil, false, fmt.Errorf("failed to open ICMP socket on %s: %w", address, err)
+	}
+	return rawConn, true, nil
+}
+
+// newICMPSocket creates a socket with a random echo identifier and token, without a connection
+func newICMPSocket(family int, address string) *icmpSocket {
+	token := make([]byte, 8)
+	binary.BigEndian.PutUint64(token, rand.Uint64())
+	return &icmpSocket{
+		family:  family,
+		address: address,
+		id:      rand.IntN(0xffff) + 1,
+		token:   token,
+		pending: make(map[uint16]*icmpRequest),
+	}
+}
+
+// connection returns the current connection of the socket and whether it is a raw socket
+func (s *icmpSocket) connection() (*icmp.PacketConn, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn, s.privileged
+}
+
+// close closes the socket for good, its receive goroutine stops
+func (s *icmpSocket) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.conn.Close()
+}
+
+// reopen replaces the connection of the socket with a new one on the same address. Requests sent
+// over the old connection time out.
+func (s *icmpSocket) reopen() error {
+	conn, privileged, err := listenICMP(s.family, s.address)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return net.ErrClosed
+	}
+	s.conn.Close()
+	s.conn, s.privileged = conn, privileged
+	return nil
+}
+
+// register assigns a free sequence number to a request, marks it as sent and starts its timeout
+func (s *icmpSocket) register(request *icmpRequest, timeout time.Duration) (uint16, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.pending) > 0xffff {
+		return 0, errors.New("too many ICMP requests in flight")
+	}
+	for {
+		s.sequence++
+		if _, busy := s.pending[s.sequence]; !busy {
+			break
+		}
+	}
+
+	sequence := s.sequence
+	request.sent = time.Now()
+	request.timer = time.AfterFunc(timeout, func() {
+		s.complete(sequence, request, 0, errICMPTimeout)
+	})
+	s.pending[sequence] = request
+	return sequence, nil
+}
+
+// complete hands the outcome to a request that is still pending. The reply and the timeout race
+// for the request, only the first of them completes it.
+func (s *icmpSocket) complete(sequence uint16, request *icmpRequest, rtt time.Duration, err error) {
+	s.mu.Lock()
+	pending := s.pending[sequence] == request
+	if pending {
+		delete(s.pending, sequence)
+	}
+	s.mu.Unlock()
+
+	if pending {
+		request.timer.Stop()
+		request.done(rtt, err)
+	}
+}
+
+// receive reads echo replies until the socket is closed and delivers them to their requests.
+// After receive errors it backs off, and reopens the socket when they persist.
+func (s *icmpSocket) receive() {
+	buffer := make([]byte, 1500)
+	failures := 0
+	for {
+		conn, _ := s.connection()
+		n, peer, err := conn.ReadFrom(buffer)
+		received := time.Now()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			failures++
+			if failures == 1 {
+				log.Printf("ICMP receive error on %s: %v", s.address, err)
+			}
+			if failures%icmpReopenAfter == 0 {
+				if err := s.reopen(); err != nil {
+					log.Printf("Failed to reopen ICMP socket on %s after %d receive errors: %v", s.address, failures, err)
+				} else {
+					log.Printf("Reopened ICMP socket on %s after %d receive errors", s.address, failures)
+				}
+			}
+			time.Sleep(min(10*time.Millisecond<<min(failures, 10), icmpMaxReceiveBackoff))
+			continue
+		}
+		failures = 0
+
+		s.handleReply(buffer[:n], peer, received)
+	}
+}
+
+// handleReply completes the request an echo reply answers. Replies to other sockets or processes,
+// to requests that already timed out and from other addresses than the target are ignored.
+func (s *icmpSocket) handleReply(packet []byte, peer net.Addr, received time.Time) {
+	protocol := 1 // ICMP
+	if s.family == 6 {
+		protocol = 58 // ICMPv6
+	}
+
+	message, err := icmp.ParseMessage(protocol, packet)
+	if err != nil || (message.Type != ipv4.ICMPTypeEchoReply && message.Type != ipv6.ICMPTypeEchoReply) {
+		return
+	}
+	echo, ok := message.Body.(*icmp.Echo)
+	if !ok || !bytes.Equal(echo.Data, s.token) {
+		return
+	}
+	// Unprivileged sockets get their identifier from the kernel, which only delivers their own replies
+	if _, privileged := s.connection(); privileged && echo.ID != s.id {
+		return
+	}
+
+	var peerIP net.IP
+	switch addr := peer.(type) {
+	case *net.UDPAddr:
+		peerIP = addr.IP
+	case *net.IPAddr:
+		peerIP = addr.IP
+	}
+
+	sequence := uint16(echo.Seq)
+	s.mu.Lock()
+	request, exists := s.pending[sequence]
+	s.mu.Unlock()
+	if exists && request.target.Equal(peerIP) {
+		s.complete(sequence, request, received.Sub(request.sent), nil)
+	}
+}
+
+// sendTCPProbe opens a TCP connection to the host's port and returns the handshake time and success status.
+// Refused, timed out and unreachable connections all count as loss.
+func (sp *SmogPing) sendTCPProbe(host Host, targetIP, sourceIP string, timeout time.Duration) (time.Duration, bool) {
+	dialer := net.Dialer{Timeout: timeout}
+	if sourceIP != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(sourceIP)}
+	}
+
+	address := net.JoinHostPort(targetIP, strconv.Itoa(host.Port))
+	start := time.Now()
+	conn, err := dialer.Dial("tcp", address)
+	rtt := time.Since(start)
+	if err != nil {
+		sp.debugf("TCP probe failed for %s (%s -> %s): %s: %v", host.Name, host.IP, address, tcpProbeFailure(err), err)
+		return 0, false
+	}
+	conn.Close()
+
+	return rtt, true
+}
+
+// sendHTTPProbe requests the host's URL and returns the phase timings and success status. Transport
+// errors, an unexpected status code or a body not matching expectbody all count as loss. When the
+// host's ip is not the URL hostname the connection goes to that address instead of resolving the URL.
+func (sp *SmogPing) sendHTTPProbe(host Host, targetIP, sourceIP string, timeout time.Duration) (HTTPPhases, bool) {
+	// The trace callbacks run on the dial goroutines, which may outlive the request on errors,
+	// so phases is only accessed under phaseMux and copied by result
+	var phases HTTPPhases
+	var phaseMux sync.Mutex
+	result := func(ok bool) (HTTPPhases, bool) {
+		phaseMux.Lock()
+		defer phaseMux.Unlock()
+		return phases, ok
+	}
+
+	requestURL, err := url.Parse(host.URL)
+	if err != nil {
+		sp.debugf("HTTP probe failed for %s (%s): %v", host.Name, host.URL, err)
+		return result(false)
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	if sourceIP != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(sourceIP)}
+	}
+	pinned := host.Backend != "" || !strings.EqualFold(requestURL.Hostname(), host.IP)
+
+	// A new transport per request so every sample measures a full connection
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if host.AddressFamily != 0 {
+				network = fmt.Sprintf("tcp%d", host.AddressFamily)
+			}
+			if pinned {
+				_, port, err := net.SplitHostPort(address)
+				if err != nil {
+					return nil, err
+				}
+				address = net.JoinHostPort(targetIP, port)
+			}
+			return dialer.DialContext(ctx, network, address)
+		},
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse // Redirects are checked against expectstatus, not followed
+		},
+	}
+
+	method := http.MethodGet
+	if host.Method != "" {
+		method = strings.ToUpper(host.Method)
+	}
+
+	// start is set before the request is sent and only read afterwards
+	var start, dnsStart, connectStart, tlsStart time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			phaseMux.Lock()
+			dnsStart = time.Now()
+			phaseMux.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			phaseMux.Lock()
+			phases.DNS = time.Since(dnsStart)
+			phaseMux.Unlock()
+		},
+		// Dual stack hosts can dial several addresses in parallel
+		ConnectStart: func(string, string) {
+			phaseMux.Lock()
+			connectStart = time.Now()
+			phaseMux.Unlock()
+		},
+		ConnectDone: func(string, string, error) {
+			phaseMux.Lock()
+			phases.Connect = time.Since(connectStart)
+			phaseMux.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			phaseMux.Lock()
+			tlsStart = time.Now()
+			phaseMux.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			phaseMux.Lock()
+			phases.TLS = time.Since(tlsStart)
+			phaseMux.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			phaseMux.Lock()
+			phases.TTFB = time.Since(start)
+			phaseMux.Unlock()
+		},
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), method, host.URL, nil)
+	if err != nil {
+		sp.debugf("HTTP probe failed for %s (%s): %v", host.Name, host.URL, err)
+		return result(false)
+	}
+	req.Header.Set("User-Agent", "smogping")
+
+	start = time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		sp.debugf("HTTP probe failed for %s (%s -> %s): %v", host.Name, host.URL, targetIP, err)
+		return result(false)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, httpProbeMaxBody))
+	phaseMux.Lock()
+	phases.Total = time.Since(start)
+	phaseMux.Unlock()
+	if err != nil {
+		sp.debugf("HTTP probe failed for %s (%s -> %s): reading body: %v", host.Name, host.URL, targetIP, err)
+		return result(false)
+	}
+
+	expectStatus := host.ExpectStatus
+	if expectStatus == 0 {
+		expectStatus = http.StatusOK
+	}
+	if resp.StatusCode != expectStatus {
+		sp.debugf("HTTP probe failed for %s (%s -> %s): status %d, expected %d", host.Name, host.URL, targetIP, resp.StatusCode, expectStatus)
+		return result(false)
+	}
+
+	if host.ExpectBody != "" {
+		pattern, err := httpBodyPattern(host.ExpectBody)
+		if err != nil || !pattern.Match(body) {
+			sp.debugf("HTTP probe failed for %s (%s -> %s): body does not match %q", host.Name, host.URL, targetIP, host.ExpectBody)
+			return result(false)
+		}
+	}
+
+	return result(true)
+}
+
+// httpBodyPattern returns the compiled expectbody expression, compiling it on first use
+func httpBodyPattern(expr string) (*regexp.Regexp, error) {
+	if cached, ok := httpBodyPatterns.Load(expr); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	httpBodyPatterns.Store(expr, pattern)
+	return pattern, nil
+}
+
+// dnsQueryTypes are the record types dns probes can query
+var dnsQueryTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"SOA":   dnsmessage.TypeSOA,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+// dnsRcodes are the response codes a dns probe can expect
+var dnsRcodes = map[string]dnsmessage.RCode{
+	"NOERROR":  dnsmessage.RCodeSuccess,
+	"FORMERR":  dnsmessage.RCodeFormatError,
+	"SERVFAIL": dnsmessage.RCodeServerFailure,
+	"NXDOMAIN": dnsmessage.RCodeNameError,
+	"NOTIMP":   dnsmessage.RCodeNotImplemented,
+	"REFUSED":  dnsmessage.RCodeRefused,
+}
+
+// dnsRcodeName returns the name of a response code for log messages
+func dnsRcodeName(rcode dnsmessage.RCode) string {
+	for name, code := range dnsRcodes {
+		if code == rcode {
+			return name
+		}
+	}
+	return strconv.Itoa(int(rcode))
+}
+
+// dnsQueryName returns the query name as a fully qualified name
+func dnsQueryName(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// dnsQueryType returns the record type of a dns probe, A when none is configured
+func dnsQueryType(host Host) string {
+	if host.QueryType == "" {
+		return "A"
+	}
+	return strings.ToUpper(host.QueryType)
+}
+
+// dnsExpectRcode returns the response code a dns probe expects, NOERROR when none is configured
+func dnsExpectRcode(host Host) string {
+	if host.ExpectRcode == "" {
+		return "NOERROR"
+	}
+	return strings.ToUpper(host.ExpectRcode)
+}
+
+// sendDNSProbe sends the host's query to the nameserver at its address and returns the response time
+// and success status. For TCP the time includes the connection handshake. Timeouts, malformed
+// responses, an unexpected response code and a missing expected answer all count as loss.
+func (sp *SmogPing) sendDNSProbe(host Host, targetIP, sourceIP string, timeout time.Duration) (time.Duration, bool) {
+	network := "udp"
+	if strings.ToLower(host.Transport) == "tcp" {
+		network = "tcp"
+	}
+	port := host.Port
+	if port == 0 {
+		port = 53
+	}
+	address := net.JoinHostPort(targetIP, strconv.Itoa(port))
+
+	query, id, err := buildDNSQuery(host)
+	if err != nil {
+		sp.debugf("DNS probe failed for %s (%s): %v", host.Name, host.Query, err)
+		return 0, false
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	if sourceIP != "" {
+		if network == "tcp" {
+			dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(sourceIP)}
+		} else {
+			dialer.LocalAddr = &net.UDPAddr{IP: net.ParseIP(sourceIP)}
+		}
+	}
+
+	start := time.Now()
+	conn, err := dialer.Dial(network, address)
+	if err != nil {
+		sp.debugf("DNS probe failed for %s (%s -> %s/%s): %v", host.Name, host.Query, address, network, err)
+		return 0, false
+	}
+	defer conn.Close()
+	conn.SetDeadline(start.Add(timeout))
+
+	response, err := exchangeDNS(conn, network, query)
+	rtt := time.Since(start)
+	if err != nil {
+		sp.debugf("DNS probe failed for %s (%s -> %s/%s): %v", host.Name, host.Query, address, network, err)
+		return 0, false
+	}
+
+	if err := checkDNSResponse(host, id, response); err != nil {
+		sp.debugf("DNS probe failed for %s (%s -> %s/%s): %v", host.Name, host.Query, address, network, err)
+		return 0, false
+	}
+
+	return rtt, true
+}
+
+// buildDNSQuery packs a recursive query for the host's name and type and returns it with its ID
+func buildDNSQuery(host Host) ([]byte, uint16, error) {
+	name, err := dnsmessage.NewName(dnsQueryName(host.Query))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	id := uint16(rand.Uint32())
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := builder.Question(dnsmessage.Question{
+		Name:  name,
+		Type:  dnsQueryTypes[dnsQueryType(host)],
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return nil, 0, err
+	}
+	query, err := builder.Finish()
+	return query, id, err
+}
+
+// exchangeDNS writes a query to the connection and reads the response, TCP messages carry a length prefix
+func exchangeDNS(conn net.Conn, network string, query []byte) ([]byte, error) {
+	if network == "tcp" {
+		framed := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(framed, uint16(len(query)))
+		copy(framed[2:], query)
+		if _, err := conn.Write(framed); err != nil {
+			return nil, err
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		response := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return nil, err
+		}
+		return response, nil
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 65535)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	return response[:n], nil
+}
+
+// checkDNSResponse verifies the response matches the query, carries the expected response code
+// and, when expectanswer is set, contains an answer record with that value
+func checkDNSResponse(host Host, id uint16, response []byte) error {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return fmt.Errorf("malformed response: %w", err)
+	}
+	if !header.Response || header.ID != id {
+		return fmt.Errorf("response does not match the query")
+	}
+
+	expectRcode := dnsExpectRcode(host)
+	if header.RCode != dnsRcodes[expectRcode] {
+		return fmt.Errorf("rcode %s, expected %s", dnsRcodeName(header.RCode), expectRcode)
+	}
+
+	if host.ExpectAnswer == "" {
+		return nil
+	}
+
+	if err := parser.SkipAllQuestions(); err != nil {
+		return fmt.Errorf("malformed response: %w", err)
+	}
+	answers, err := parser.AllAnswers()
+	if err != nil {
+		return fmt.Errorf("malformed response: %w", err)
+	}
+	for _, answer := range answers {
+		if dnsAnswerMatches(answer.Body, host.ExpectAnswer) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no answer matches %q", host.ExpectAnswer)
+}
+
+// dnsAnswerMatches reports whether an answer record holds the expected value. Addresses are
+// compared as IPs, names without the trailing dot and case, TXT records by their joined strings.
+func dnsAnswerMatches(body dnsmessage.ResourceBody, expected string) bool {
+	sameName := func(name dnsmessage.Name) bool {
+		return strings.EqualFold(strings.TrimSuffix(name.String(), "."), strings.TrimSuffix(expected, "."))
+	}
+
+	switch record := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(record.A[:]).Equal(net.ParseIP(expected))
+	case *dnsmessage.AAAAResource:
+		return net.IP(record.AAAA[:]).Equal(net.ParseIP(expected))
+	case *dnsmessage.CNAMEResource:
+		return sameName(record.CNAME)
+	case *dnsmessage.MXResource:
+		return sameName(record.MX)
+	case *dnsmessage.NSResource:
+		return sameName(record.NS)
+	case *dnsmessage.PTRResource:
+		return sameName(record.PTR)
+	case *dnsmessage.SOAResource:
+		return sameName(record.NS)
+	case *dnsmessage.SRVResource:
+		return sameName(record.Target)
+	case *dnsmessage.TXTResource:
+		return strings.Join(record.TXT, "") == expected
+	}
+	return false
+}
+
+// tcpProbeFailure classifies a failed TCP connect for log messages
+func tcpProbeFailure(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	default:
+		return "error"
+	}
+}
+
+// processDataPoint calculates statistics and stores the data point
+func (sp *SmogPing) processDataPoint(orgName string, host Host, rtts []time.Duration, phaseTotals HTTPPhases, dataPointPings, dropped int, startTime time.Time, previousIP string) {
+	// Get result object from pool
+	result := sp.getPingResultFromPool()
+	defer sp.returnPingResultToPool(result)
+
+	// Calculate statistics
+	successfulPings := len(rtts)
+
+	if successfulPings == 0 {
+		// Complete packet loss
+		result.Host = host
+		result.AvgRTT = 0
+		result.PacketLoss = 100.0
+		result.Jitter = 0
+		result.Timestamp = startTime
+		result.OrgName = orgName
+		result.PreviousIP = previousIP
+		result.Dropped = dropped
+
+		sp.verbosef("Data point for %s (%s): 100%% packet loss", host.Name, host.IP)
+	} else {
+		// Calculate average RTT
+		var totalRTT time.Duration
+		for _, rtt := range rtts {
+			totalRTT += rtt
+		}
+		avgRTT := totalRTT / time.Duration(successfulPings)
+
+		// Calculate packet loss percentage
+		packetLoss := float64(dataPointPings-successfulPings) / float64(dataPointPings) * 100.0
+
+		// Calculate jitter (standard deviation of RTTs)
+		var jitter time.Duration
+		if successfulPings > 1 {
+			variance := float64(0)
+			avgRTTFloat := float64(avgRTT)
+			for _, rtt := range rtts {
+				diff := float64(rtt) - avgRTTFloat
+				variance += diff * diff
+			}
+			variance /= float64(successfulPings)
+			jitter = time.Duration(math.Sqrt(variance))
+		}
+
+		result.Host = host
+		result.AvgRTT = avgRTT
+		result.PacketLoss = packetLoss
+		result.Jitter = jitter
+		result.Timestamp = startTime
+		result.OrgName = orgName
+		result.PreviousIP = previousIP
+		result.Dropped = dropped
+		// Sort samples for the distribution fields
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		result.RTTs = rtts
+		result.HTTPPhases = phaseTotals.average(successfulPings)
+
+		sp.verbosef("Data point for %s (%s): avg=%v, loss=%.1f%%, jitter=%v",
+			host.Name, host.IP, avgRTT, packetLoss, jitter)
+	}
+
+	// Store the result
+	sp.storeResult(result)
+}
+
+// storeResult processes and stores a ping result
+func (sp *SmogPing) storeResult(result *PingResult) {
+	sp.debugf("Processing result for %s (%s)", result.Host.Name, result.Host.IP)
+
+	// Write to output sinks
+	sp.writeToSinks(*result)
+
+	// Check alarms if enabled
+	if !sp.noAlarm {
+		sp.checkAlarms(*result)
+		sp.checkBackendRollup(*result)
+	}
+}
+
+// resultTags builds the tags identifying a data point, shared by InfluxDB and Prometheus output
+func (sp *SmogPing) resultTags(result PingResult) map[string]string {
+	// Use resolved IP if available for the actual ping target
+	targetIP := result.Host.ResolvedIP
+	if targetIP == "" {
+		targetIP = result.Host.IP
+	}
+
+	// Determine effective source IP for tags
+	effectiveSource := pingSourceFor(result.Host, sp.currentConfig())
+	if effectiveSource == "" {
+		effectiveSource = "default"
+	}
+
+	tags := map[string]string{
+		"host":         result.Host.Name,
+		"ip":           result.Host.IP, // Original IP/hostname
+		"organization": result.OrgName,
+		"source":       effectiveSource,
+		"probe":        hostProbe(result.Host),
+	}
+
+	// User tags, validation keeps them from replacing the tags above
+	for name, value := range result.Host.Tags {
+		tags[name] = value
+	}
+
+	// Add resolved IP as a tag if different from original
+	if result.Host.IsDNSName && targetIP != result.Host.IP {
+		tags["resolved_ip"] = targetIP
+		tags["is_dns_name"] = "true"
+	} else {
+		tags["is_dns_name"] = "false"
+	}
+
+	// Hosts with an address family carry it as a tag, keeping dual-stack series apart
+	if result.Host.AddressFamily != 0 {
+		tags["af"] = strconv.Itoa(result.Host.AddressFamily)
+	}
+
+	return tags
+}
+
+// Sink is an output for data points. Every configured sink receives each data point.
+type Sink interface {
+	// Name identifies the sink in log messages
+	Name() string
+	// Write stores a data point, result.RTTs is only valid during the call
+	Write(result PingResult, tags map[string]string)
+	// RemoveTarget is called when a target is no longer monitored
+	RemoveTarget(orgName string, host Host)
+	// Close flushes pending data on shutdown
+	Close()
+}
+
+// ReloadableSink is implemented by sinks that apply config.toml changes at runtime
+type ReloadableSink interface {
+	Reload(config Config)
+}
+
+// setupSinks creates the configured output sinks
+func (sp *SmogPing) setupSinks() error {
+	if sp.influxEnabled() {
+		sp.sinks = append(sp.sinks, sp.newInfluxSink())
+	} else {
+		log.Println("InfluxDB output disabled (influx_url not set)")
+	}
+
+	if sp.metricsEnabled() {
+		exporter, err := sp.newMetricsExporter()
+		if err != nil {
+			return fmt.Errorf("failed to setup Prometheus exporter: %w", err)
+		}
+		sp.sinks = append(sp.sinks, exporter)
+	} else {
+		sp.verbosef("Prometheus exporter disabled (metrics_listen not set)")
+	}
+
+	if len(sp.sinks) == 0 {
+		log.Println("No output sinks configured, data points are only used for alarms")
+		return nil
+	}
+
+	// Export output and scheduler statistics through the Prometheus exporter
+	for _, sink := range sp.sinks {
+		exporter, ok := sink.(*PrometheusExporter)
+		if !ok {
+			continue
+		}
+		exporter.AddCollector(sp.scheduler)
+		for _, other := range sp.sinks {
+			if collector, ok := other.(MetricsCollector); ok {
+				exporter.AddCollector(collector)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(sp.sinks))
+	for _, sink := range sp.sinks {
+		names = append(names, sink.Name())
+	}
+	sp.verbosef("Output sinks: %s", strings.Join(names, ", "))
+	return nil
+}
+
+// rttFields returns the configured RTT distribution fields in milliseconds. The samples
+// must be sorted, no fields are returned for a data point without successful pings.
+func (sp *SmogPing) rttFields(rtts []time.Duration) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if len(rtts) == 0 {
+		return fields
+	}
+
+	config := sp.currentConfig()
+
+	for _, stat := range config.RTTStats {
+		switch stat {
+		case "min":
+			fields["rtt_min"] = float64(rtts[0].Nanoseconds()) / 1e6
+		case "max":
+			fields["rtt_max"] = float64(rtts[len(rtts)-1].Nanoseconds()) / 1e6
+		case "median":
+			fields["rtt_median"] = rttPercentile(rtts, 50)
+		}
+	}
+
+	for _, percentile := range config.RTTPercentiles {
+		fields[fmt.Sprintf("rtt_p%d", percentile)] = rttPercentile(rtts, float64(percentile))
+	}
+
+	if config.RTTSamples {
+		for i, rtt := range rtts {
+			fields[fmt.Sprintf("rtt_%d", i+1)] = float64(rtt.Nanoseconds()) / 1e6
+		}
+	}
+
+	return fields
+}
+
+// httpPhaseFields returns the average HTTP phase timings in milliseconds for http probes,
+// no fields are returned for a data point without successful requests
+func httpPhaseFields(result PingResult) map[string]interface{} {
+	if hostProbe(result.Host) != probeHTTP || len(result.RTTs) == 0 {
+		return nil
+	}
+	phases := result.HTTPPhases
+	return map[string]interface{}{
+		"http_dns":     float64(phases.DNS.Nanoseconds()) / 1e6,
+		"http_connect": float64(phases.Connect.Nanoseconds()) / 1e6,
+		"http_tls":     float64(phases.TLS.Nanoseconds()) / 1e6,
+		"http_ttfb":    float64(phases.TTFB.Nanoseconds()) / 1e6,
+		"http_total":   float64(phases.Total.Nanoseconds()) / 1e6,
+	}
+}
+
+// rttPercentile returns a percentile of sorted samples in milliseconds, interpolating
+// linearly between the two closest ranks
+func rttPercentile(rtts []time.Duration, percentile float64) float64 {
+	rank := percentile / 100 * float64(len(rtts)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	value := float64(rtts[lower]) + (rank-float64(lower))*float64(rtts[upper]-rtts[lower])
+	return value / 1e6
+}
+
+// writeToSinks hands a data point to every output sink
+func (sp *SmogPing) writeToSinks(result PingResult) {
+	for _, sink := range sp.sinks {
+		// Each sink gets its own tag map so it can add sink specific tags
+		sink.Write(result, sp.resultTags(result))
+	}
+}
+
+// removeFromSinks tells every output sink that a target is no longer monitored
+func (sp *SmogPing) removeFromSinks(orgName string, host Host) {
+	for _, sink := range sp.sinks {
+		sink.RemoveTarget(orgName, host)
+	}
+}
+
+// closeSinks flushes and closes every output sink
+func (sp *SmogPing) closeSinks() {
+	for _, sink := range sp.sinks {
+		sp.debugf("Closing %s output", sink.Name())
+		sink.Close()
+	}
+}
+
+// influxWriteQueueSize is the number of batches that may wait for the InfluxDB writer
+const influxWriteQueueSize = 100
+
+// influxWriteTimeout bounds a single InfluxDB write request
+const influxWriteTimeout = 10 * time.Second
+
+// InfluxStats counts the outcome of InfluxDB writes
+type InfluxStats struct {
+	PointsWritten  atomic.Uint64 // Points accepted by InfluxDB, including replayed ones
+	PointsSpooled  atomic.Uint64 // Points written to the spool after a failure
+	PointsReplayed atomic.Uint64 // Spooled points later accepted by InfluxDB
+	PointsDropped  atomic.Uint64 // Points lost (rejected, spool disabled or full)
+	WriteErrors    atomic.Uint64 // Failed write requests
+}
+
+// influxBatch is a flushed batch in line protocol
+type influxBatch struct {
+	lines  []string
+	reason string // Why the batch was flushed (size, timer, shutdown)
+}
+
+// InfluxSink writes data points to InfluxDB v2 with batching. Batches are handed to a
+// writer goroutine, failed batches are kept in an on-disk spool and replayed in order.
+type InfluxSink struct {
+	sp        *SmogPing // Owning application, used for logging
+	client    influxdb2.Client
+	writeAPI  api.WriteAPIBlocking
+	batchSize int
+	batchTime time.Duration
+	// Batching components
+	batchMutex  sync.Mutex
+	batchPoints []*write.Point
+	lastFlush   time.Time
+	// Writer components, queueMutex orders queued and spooled batches
+	queueMutex  sync.Mutex
+	writeQueue  []influxBatch // Batches waiting for the writer, oldest first
+	queueSignal chan struct{} // Wakes the writer when a batch is queued
+	writerStop  chan struct{} // Closed by Close once the last batch is queued
+	writerDone  chan struct{} // Closed when the writer has exited
+	spool       *InfluxSpool  // Failed batches, nil if spooling is disabled
+	stats       InfluxStats   // Write counters, exported as Prometheus metrics
+}
+
+// newInfluxSink connects to InfluxDB and starts the batch flush timer and writer
+func (sp *SmogPing) newInfluxSink() *InfluxSink {
+	client := influxdb2.NewClient(sp.config.InfluxURL, sp.config.InfluxToken)
+
+	// Test connection, an unreachable InfluxDB is not fatal as failed writes are spooled
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	health, err := client.Health(ctx)
+	if err != nil {
+		log.Printf("WARNING: Failed to connect to InfluxDB at %s: %v", sp.config.InfluxURL, err)
+		sp.syslogWarning("Failed to connect to InfluxDB at %s: %v", sp.config.InfluxURL, err)
+	} else if health.Status != "pass" {
+		log.Printf("WARNING: InfluxDB health check failed: %s", health.Status)
+		sp.syslogWarning("InfluxDB health check failed: %s", health.Status)
+	} else {
+		sp.verbosef("Connected to InfluxDB at %s", sp.config.InfluxURL)
+	}
+
+	is := &InfluxSink{
+		sp:          sp,
+		client:      client,
+		writeAPI:    client.WriteAPIBlocking(sp.config.InfluxOrg, sp.config.InfluxBucket),
+		batchSize:   sp.config.InfluxBatchSize,
+		batchTime:   time.Duration(sp.config.InfluxBatchTime) * time.Second,
+		batchPoints: make([]*write.Point, 0, sp.config.InfluxBatchSize),
+		lastFlush:   time.Now(),
+		queueSignal: make(chan struct{}, 1),
+		writerStop:  make(chan struct{}),
+		writerDone:  make(chan struct{}),
+	}
+
+	// Setup spool for failed writes
+	if sp.config.InfluxSpoolDir != "" && strings.ToLower(sp.config.InfluxSpoolDir) != "none" {
+		spool, err := NewInfluxSpool(sp.config.InfluxSpoolDir, int64(sp.config.InfluxSpoolMaxMB)*1024*1024)
+		if err != nil {
+			log.Printf("WARNING: InfluxDB spool disabled, failed writes will be dropped: %v", err)
+			sp.syslogWarning("InfluxDB spool disabled: %v", err)
+		} else {
+			is.spool = spool
+			segments, bytes := spool.Size()
+			sp.verbosef("InfluxDB spool configured: Dir=%s, MaxSize=%dMB", sp.config.InfluxSpoolDir, sp.config.InfluxSpoolMaxMB)
+			if segments > 0 {
+				log.Printf("InfluxDB spool holds %d batches (%d bytes) from a previous run, replaying", segments, bytes)
+			}
+		}
+	} else {
+		sp.verbosef("InfluxDB spool disabled (influx_spool_dir not set)")
+	}
+
+	// Start batch flush timer
+	sp.wg.Add(1)
+	go is.batchFlushTimer()
+
+	// Start writer, it outlives the schedules and is stopped by Close
+	go is.runWriter()
+
+	sp.verbosef("InfluxDB batching configured: BatchSize=%d, BatchTime=%ds",
+		sp.config.InfluxBatchSize, sp.config.InfluxBatchTime)
+
+	return is
+}
+
+// Reload applies changed batch settings
+func (is *InfluxSink) Reload(config Config) {
+	is.batchMutex.Lock()
+	defer is.batchMutex.Unlock()
+	is.batchSize = config.InfluxBatchSize
+	is.batchTime = time.Duration(config.InfluxBatchTime) * time.Second
+}
+
+// Name implements Sink
+func (is *InfluxSink) Name() string {
+	return "influxdb"
+}
+
+// Write adds a data point to the current batch
+func (is *InfluxSink) Write(result PingResult, tags map[string]string) {
+	// Use resolved IP if available for the actual ping target
+	targetIP := result.Host.ResolvedIP
+	if targetIP == "" {
+		targetIP = result.Host.IP
+	}
+
+	// Tag the data point that spans a DNS change with the old address too
+	if result.PreviousIP != "" {
+		tags["previous_resolved_ip"] = result.PreviousIP
+	}
+
+	fields := map[string]interface{}{
+		"rtt_avg":     float64(result.AvgRTT.Nanoseconds()) / 1e6, // Convert to milliseconds
+		"packet_loss": result.PacketLoss,
+		"jitter":      float64(result.Jitter.Nanoseconds()) / 1e6, // Convert to milliseconds
+		"dropped":     int64(result.Dropped),                      // Probes not sent under back-pressure
+	}
+	for name, value := range is.sp.rttFields(result.RTTs) {
+		fields[name] = value
+	}
+	for name, value := range httpPhaseFields(result) {
+		fields[name] = value
+	}
+
+	point := influxdb2.NewPoint("ping", tags, fields, result.Timestamp)
+
+	is.sp.debugf("Created InfluxDB point for %s (%s -> %s): rtt=%.1fms, loss=%.1f%%, jitter=%.1fms",
+		result.Host.Name, result.Host.IP, targetIP,
+		float64(result.AvgRTT.Nanoseconds())/1e6,
+		result.PacketLoss,
+		float64(result.Jitter.Nanoseconds())/1e6)
 
-	// Identify removed targets
-	for key, targetInfo := range oldMap {
-		if _, exists := newMap[key]; !exists {
-			removed = append(removed, targetInfo)
-		}
-	}
+	// Add to batch, flushing it once it is full
+	is.batchMutex.Lock()
+	defer is.batchMutex.Unlock()
+	is.batchPoints = append(is.batchPoints, point)
 
-	return added, removed, unchanged
-}
+	is.sp.debugf("Added point to batch (current size: %d/%d)", len(is.batchPoints), is.batchSize)
 
-// updateWatchedFiles updates the file watcher for new included files
-func (sp *SmogPing) updateWatchedFiles() {
-	if sp.watcher == nil {
-		return
+	if len(is.batchPoints) >= is.batchSize {
+		is.flushBatchUnsafe("size")
 	}
+}
 
-	// Get current watched files
-	watchedFiles := make(map[string]bool)
-	for _, watchedFile := range sp.watcher.WatchList() {
-		watchedFiles[watchedFile] = true
-	}
+// RemoveTarget implements Sink, points already written are kept
+func (is *InfluxSink) RemoveTarget(orgName string, host Host) {}
 
-	// Add new included files to watch list
-	for _, includeFile := range sp.targets.Include {
-		if !watchedFiles[includeFile] {
-			if _, err := os.Stat(includeFile); err == nil {
-				err := sp.watcher.Add(includeFile)
-				if err != nil {
-					sp.verbosef("Warning: Failed to watch new included file %s: %v", includeFile, err)
-				} else {
-					sp.verbosef("Now watching new included file: %s", includeFile)
-				}
-			}
-		}
-	}
+// Close flushes the remaining points, waits for the writer and closes the client
+func (is *InfluxSink) Close() {
+	is.flushBatch("shutdown")
+	close(is.writerStop)
+	<-is.writerDone
+	is.client.Close()
+
+	log.Printf("InfluxDB writes: %d points written, %d spooled, %d replayed, %d dropped, %d write errors",
+		is.stats.PointsWritten.Load(), is.stats.PointsSpooled.Load(), is.stats.PointsReplayed.Load(),
+		is.stats.PointsDropped.Load(), is.stats.WriteErrors.Load())
 }
 
-// batchFlushTimer periodically flushes batches based on time
-func (sp *SmogPing) batchFlushTimer() {
-	defer sp.wg.Done()
+// batchFlushTimer periodically flushes batches based on time. It checks every second
+// so a changed influx_batch_time takes effect without restarting the timer.
+func (is *InfluxSink) batchFlushTimer() {
+	defer is.sp.wg.Done()
 
-	ticker := time.NewTicker(time.Duration(sp.config.InfluxBatchTime) * time.Second)
+	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-sp.ctx.Done():
-			// Final flush on shutdown
-			sp.flushBatch("shutdown")
+		case <-is.sp.ctx.Done():
+			// Final flush happens in Close once all schedules have stopped
 			return
 		case <-ticker.C:
-			sp.checkAndFlushBatch("timer")
+			is.checkAndFlushBatch("timer")
 		}
 	}
 }
 
 // checkAndFlushBatch flushes batch if it has points and time has elapsed
-func (sp *SmogPing) checkAndFlushBatch(reason string) {
-	sp.batchMutex.Lock()
-	defer sp.batchMutex.Unlock()
+func (is *InfluxSink) checkAndFlushBatch(reason string) {
+	is.batchMutex.Lock()
+	defer is.batchMutex.Unlock()
 
-	if len(sp.batchPoints) > 0 && time.Since(sp.lastFlush) >= time.Duration(sp.config.InfluxBatchTime)*time.Second {
-		sp.flushBatchUnsafe(reason)
+	if len(is.batchPoints) > 0 && time.Since(is.lastFlush) >= is.batchTime {
+		is.flushBatchUnsafe(reason)
 	}
 }
 
 // flushBatch safely flushes the current batch
-func (sp *SmogPing) flushBatch(reason string) {
-	sp.batchMutex.Lock()
-	defer sp.batchMutex.Unlock()
-	sp.flushBatchUnsafe(reason)
+func (is *InfluxSink) flushBatch(reason string) {
+	is.batchMutex.Lock()
+	defer is.batchMutex.Unlock()
+	is.flushBatchUnsafe(reason)
 }
 
-// flushBatchUnsafe flushes batch without locking (must be called with lock held)
-func (sp *SmogPing) flushBatchUnsafe(reason string) {
-	if len(sp.batchPoints) == 0 {
+// flushBatchUnsafe hands the batch to the writer (must be called with lock held)
+func (is *InfluxSink) flushBatchUnsafe(reason string) {
+	if len(is.batchPoints) == 0 {
 		return
 	}
 
-	sp.debugf("Flushing batch of %d points (reason: %s)", len(sp.batchPoints), reason)
+	is.sp.debugf("Flushing batch of %d points (reason: %s)", len(is.batchPoints), reason)
 
-	// Write all points in batch
-	for _, point := range sp.batchPoints {
-		sp.influxWrite.WritePoint(point)
+	// Encode the batch so it can be written as is or spooled to disk
+	lines := make([]string, 0, len(is.batchPoints))
+	for _, point := range is.batchPoints {
+		lines = append(lines, strings.TrimSuffix(write.PointToLineProtocol(point, time.Nanosecond), "\n"))
 	}
 
-	sp.verbosef("Flushed %d points to InfluxDB (reason: %s)", len(sp.batchPoints), reason)
+	is.queueMutex.Lock()
+	full := len(is.writeQueue) >= influxWriteQueueSize
+	switch {
+	case is.spool != nil && (full || is.spool.Pending()):
+		// Keep points in order, once batches wait on disk the queued ones and this one follow them
+		spoolReason := "spool not yet replayed"
+		if full {
+			spoolReason = "write queue full"
+		}
+		for _, queued := range is.writeQueue {
+			is.spoolBatch(queued.lines, spoolReason)
+		}
+		is.writeQueue = nil
+		is.spoolBatch(lines, spoolReason)
+	case full:
+		// The writer is stuck on a slow InfluxDB and there is no spool to keep the batch
+		is.spoolBatch(lines, "write queue full")
+	default:
+		is.writeQueue = append(is.writeQueue, influxBatch{lines: lines, reason: reason})
+		select {
+		case is.queueSignal <- struct{}{}:
+		default:
+		}
+	}
+	is.queueMutex.Unlock()
 
 	// Reset batch
-	sp.batchPoints = sp.batchPoints[:0] // Keep capacity, reset length
-	sp.lastFlush = time.Now()
+	is.batchPoints = is.batchPoints[:0] // Keep capacity, reset length
+	is.lastFlush = time.Now()
 }
 
-// validateConfiguration performs sanity checks on the configuration and target count
-func (sp *SmogPing) validateConfiguration() error {
-	// Get current targets with read lock
-	sp.targetsMux.RLock()
-	currentTargets := sp.targets
-	sp.targetsMux.RUnlock()
+// runWriter writes queued batches and replays the spool until the queue is closed
+func (is *InfluxSink) runWriter() {
+	defer close(is.writerDone)
 
-	// Count total hosts
-	totalHosts := 0
-	for _, org := range currentTargets.Organizations {
-		totalHosts += len(org.Hosts)
-	}
+	ticker := time.NewTicker(is.batchTime)
+	defer ticker.Stop()
 
-	// Calculate theoretical maximum targets that can be handled
-	// Each ping sequence takes data_point_time seconds, and we can have max_concurrent_pings running
-	// So maximum targets = max_concurrent_pings * data_point_time / data_point_time = max_concurrent_pings
-	// But since ping sequences are staggered over data_point_time, the real limit is higher
-	maxTargets := sp.config.MaxConcurrentPings * sp.config.DataPointTime
+	for {
+		if batch, ok := is.nextBatch(); ok {
+			is.writeBatch(batch)
+			continue
+		}
 
-	if sp.verbose {
-		log.Printf("Configuration validation:")
-		log.Printf("  Total targets: %d", totalHosts)
-		log.Printf("  Max concurrent pings: %d", sp.config.MaxConcurrentPings)
-		log.Printf("  Data point time: %d seconds", sp.config.DataPointTime)
-		log.Printf("  Theoretical maximum targets: %d", maxTargets)
+		select {
+		case <-is.queueSignal:
+		case <-is.writerStop:
+			// Write the batches flushed on shutdown, then drain the spool one last time
+			for batch, ok := is.nextBatch(); ok; batch, ok = is.nextBatch() {
+				is.writeBatch(batch)
+			}
+			is.replaySpool()
+			return
+		case <-ticker.C:
+			is.replaySpool()
+		}
 	}
+}
 
-	// Check if we exceed the theoretical maximum
-	if totalHosts > maxTargets {
-		return fmt.Errorf("target count (%d) exceeds theoretical maximum (%d). "+
-			"With %d max concurrent pings and %d second data point time, "+
-			"you can monitor at most %d targets. "+
-			"Consider increasing max_concurrent_pings or data_point_time",
-			totalHosts, maxTargets, sp.config.MaxConcurrentPings,
-			sp.config.DataPointTime, maxTargets)
+// nextBatch takes the oldest queued batch that can be written right away. Batches
+// queued behind spooled ones are spooled as well so points keep their order.
+func (is *InfluxSink) nextBatch() (influxBatch, bool) {
+	is.queueMutex.Lock()
+	defer is.queueMutex.Unlock()
+
+	for len(is.writeQueue) > 0 {
+		batch := is.writeQueue[0]
+		is.writeQueue = is.writeQueue[1:]
+		if is.spool != nil && is.spool.Pending() {
+			is.spoolBatch(batch.lines, "spool not yet replayed")
+			continue
+		}
+		return batch, true
 	}
+	return influxBatch{}, false
+}
 
-	// Warning if we're approaching the limit (80% or more)
-	warningThreshold := int(float64(maxTargets) * 0.8)
-	if totalHosts >= warningThreshold {
-		log.Printf("WARNING: Target count (%d) is approaching the theoretical maximum (%d). "+
-			"Consider monitoring system performance and potentially increasing max_concurrent_pings "+
-			"if you plan to add more targets", totalHosts, maxTargets)
-	}
+// writeBatch writes a batch to InfluxDB, spooling it if InfluxDB is unavailable. The spool
+// was empty when the batch was taken from the queue, so anything spooled while it was being
+// written is newer and a failed batch goes in front of it.
+func (is *InfluxSink) writeBatch(batch influxBatch) {
+	lines := batch.lines
 
-	// Validate ping timing makes sense
-	pingInterval := float64(sp.config.DataPointTime) / float64(sp.config.DataPointPings)
-	if pingInterval < 1.0 {
-		log.Printf("WARNING: Ping interval is very short (%.2f seconds). "+
-			"With %d pings over %d seconds, pings will be sent every %.2f seconds. "+
-			"Consider reducing data_point_pings or increasing data_point_time",
-			pingInterval, sp.config.DataPointPings, sp.config.DataPointTime, pingInterval)
+	if err := is.send(lines); err != nil {
+		if !isRetryableInfluxError(err) {
+			is.stats.PointsDropped.Add(uint64(len(lines)))
+			log.Printf("InfluxDB rejected batch of %d points, dropping: %v", len(lines), err)
+			return
+		}
+		log.Printf("InfluxDB write of %d points failed: %v", len(lines), err)
+		is.sp.syslogWarning("InfluxDB write of %d points failed: %v", len(lines), err)
+		is.spoolBatchFirst(lines, "write failed")
+		return
 	}
 
-	// Validate timeout vs ping interval
-	if float64(sp.config.PingTimeout) > pingInterval {
-		log.Printf("WARNING: Ping timeout (%d seconds) is longer than ping interval (%.2f seconds). "+
-			"This may cause overlapping ping operations",
-			sp.config.PingTimeout, pingInterval)
-	}
+	is.sp.verbosef("Flushed %d points to InfluxDB (reason: %s)", len(lines), batch.reason)
+}
 
-	// Validate InfluxDB batch settings
-	if sp.config.InfluxBatchSize <= 0 && sp.verbose {
-		log.Printf("WARNING: InfluxDB batch size is %d, which may cause performance issues. "+
-			"Consider setting influx_batch_size to a positive value (recommended: 100-1000)",
-			sp.config.InfluxBatchSize)
+// send performs a single write request and updates the counters
+func (is *InfluxSink) send(lines []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), influxWriteTimeout)
+	defer cancel()
+
+	if err := is.writeAPI.WriteRecord(ctx, lines...); err != nil {
+		is.stats.WriteErrors.Add(1)
+		return err
 	}
+	is.stats.PointsWritten.Add(uint64(len(lines)))
+	return nil
+}
 
-	if sp.config.InfluxBatchTime <= 0 && sp.verbose {
-		log.Printf("WARNING: InfluxDB batch time is %d seconds, which may cause data loss. "+
-			"Consider setting influx_batch_time to a positive value (recommended: 5-30 seconds)",
-			sp.config.InfluxBatchTime)
+// spoolBatch stores a batch at the end of the spool, or drops it if spooling is disabled
+func (is *InfluxSink) spoolBatch(lines []string, reason string) {
+	is.storeBatch(lines, reason, false)
+}
+
+// spoolBatchFirst stores a batch older than all spooled ones at the front of the spool
+func (is *InfluxSink) spoolBatchFirst(lines []string, reason string) {
+	is.storeBatch(lines, reason, true)
+}
+
+// storeBatch stores a batch in the spool, in front of the spooled batches if first is set
+func (is *InfluxSink) storeBatch(lines []string, reason string, first bool) {
+	if is.spool == nil {
+		is.stats.PointsDropped.Add(uint64(len(lines)))
+		log.Printf("Dropped %d InfluxDB points (%s, spool disabled)", len(lines), reason)
+		return
 	}
 
-	// Calculate expected data points per interval
-	dataPointsPerInterval := totalHosts
-	dataPointsPerMinute := dataPointsPerInterval * (60 / sp.config.DataPointTime)
-	if sp.verbose {
-		log.Printf("  Expected data points: %d per %ds interval, ~%d per minute",
-			dataPointsPerInterval, sp.config.DataPointTime, dataPointsPerMinute)
-		log.Printf("Configuration validation completed successfully")
+	store := is.spool.Append
+	if first {
+		store = is.spool.Prepend
+	}
+	dropped, err := store(lines)
+	if dropped > 0 {
+		is.stats.PointsDropped.Add(uint64(dropped))
+		log.Printf("InfluxDB spool full, dropped %d oldest points", dropped)
+	}
+	if err != nil {
+		is.stats.PointsDropped.Add(uint64(len(lines)))
+		log.Printf("Failed to spool %d InfluxDB points, dropping: %v", len(lines), err)
+		return
 	}
 
-	return nil
+	is.stats.PointsSpooled.Add(uint64(len(lines)))
+	segments, bytes := is.spool.Size()
+	is.sp.verbosef("Spooled %d InfluxDB points (%s), spool holds %d batches (%d bytes)",
+		len(lines), reason, segments, bytes)
 }
 
-// setupInfluxDB initializes the InfluxDB client
-func (sp *SmogPing) setupInfluxDB() error {
-	client := influxdb2.NewClient(sp.config.InfluxURL, sp.config.InfluxToken)
+// replaySpool writes spooled batches oldest first and stops at the first failure
+func (is *InfluxSink) replaySpool() {
+	if is.spool == nil {
+		return
+	}
 
-	// Test connection
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	replayed := 0
+	for {
+		segment, ok := is.spool.Oldest()
+		if !ok {
+			break
+		}
 
-	health, err := client.Health(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to connect to InfluxDB: %w", err)
-	}
+		lines, err := is.spool.Read(segment)
+		if err != nil {
+			log.Printf("Discarding unreadable InfluxDB spool segment %s: %v", segment.Path, err)
+			is.stats.PointsDropped.Add(uint64(segment.Points))
+			is.spool.Remove(segment)
+			continue
+		}
+
+		if err := is.send(lines); err != nil {
+			if isRetryableInfluxError(err) {
+				is.sp.debugf("InfluxDB still unavailable, keeping spool: %v", err)
+				break
+			}
+			log.Printf("InfluxDB rejected spooled batch of %d points, dropping: %v", len(lines), err)
+			is.stats.PointsDropped.Add(uint64(len(lines)))
+			is.spool.Remove(segment)
+			continue
+		}
 
-	if health.Status != "pass" {
-		return fmt.Errorf("InfluxDB health check failed: %s", health.Status)
+		is.stats.PointsReplayed.Add(uint64(len(lines)))
+		replayed += len(lines)
+		if err := is.spool.Remove(segment); err != nil {
+			log.Printf("Failed to remove InfluxDB spool segment %s: %v", segment.Path, err)
+		}
 	}
 
-	sp.influxWrite = client.WriteAPI(sp.config.InfluxOrg, sp.config.InfluxBucket)
+	if replayed > 0 {
+		segments, _ := is.spool.Size()
+		log.Printf("Replayed %d spooled points to InfluxDB, %d batches remaining", replayed, segments)
+		if segments == 0 {
+			is.sp.syslogInfo("InfluxDB spool replayed, %d points recovered", replayed)
+		}
+	}
+}
 
-	sp.verbosef("Connected to InfluxDB at %s", sp.config.InfluxURL)
-	return nil
+// WriteMetrics implements MetricsCollector
+func (is *InfluxSink) WriteMetrics(w io.Writer) {
+	counters := []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"smogping_influx_points_written_total", "Points accepted by InfluxDB.", is.stats.PointsWritten.Load()},
+		{"smogping_influx_points_spooled_total", "Points spooled to disk after a failed write.", is.stats.PointsSpooled.Load()},
+		{"smogping_influx_points_replayed_total", "Spooled points later written to InfluxDB.", is.stats.PointsReplayed.Load()},
+		{"smogping_influx_points_dropped_total", "Points lost because they were rejected or the spool was unavailable or full.", is.stats.PointsDropped.Load()},
+		{"smogping_influx_write_errors_total", "Failed InfluxDB write requests.", is.stats.WriteErrors.Load()},
+	}
+	for _, counter := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", counter.name, counter.help, counter.name, counter.name, counter.value)
+	}
+
+	var segments int
+	var bytes int64
+	if is.spool != nil {
+		segments, bytes = is.spool.Size()
+	}
+	fmt.Fprintf(w, "# HELP smogping_influx_spool_batches Batches waiting in the InfluxDB spool.\n# TYPE smogping_influx_spool_batches gauge\nsmogping_influx_spool_batches %d\n", segments)
+	fmt.Fprintf(w, "# HELP smogping_influx_spool_bytes Size of the InfluxDB spool in bytes.\n# TYPE smogping_influx_spool_bytes gauge\nsmogping_influx_spool_bytes %d\n", bytes)
 }
 
-// startPingMonitoring starts individual ping schedules for each target
-func (sp *SmogPing) startPingMonitoring() {
-	// Calculate ping interval (time between individual pings)
-	pingInterval := time.Duration(sp.config.DataPointTime) * time.Second / time.Duration(sp.config.DataPointPings)
+// isRetryableInfluxError reports whether a failed write may succeed later. Network errors,
+// rate limiting and server errors are retried, batches rejected as invalid are not.
+func isRetryableInfluxError(err error) bool {
+	var httpErr *influxhttp.Error
+	if !errors.As(err, &httpErr) {
+		return true
+	}
+	switch httpErr.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return false
+	}
+	return true
+}
 
-	sp.verbosef("Starting ping monitoring: %d pings per %ds (interval: %v)",
-		sp.config.DataPointPings, sp.config.DataPointTime, pingInterval)
+// SpoolSegment is a single spooled batch
+type SpoolSegment struct {
+	Path   string
+	Size   int64 // Bytes
+	Points int   // Lines of line protocol
+}
 
-	// Get current targets
-	sp.targetsMux.RLock()
-	currentTargets := sp.targets
-	sp.targetsMux.RUnlock()
+// InfluxSpool keeps InfluxDB batches that could not be written as line protocol
+// segment files, one batch per file, named by a sequence number so they replay in order
+type InfluxSpool struct {
+	dir      string
+	maxBytes int64
+	mutex    sync.Mutex
+	segments []SpoolSegment // Oldest first
+	bytes    int64
+	lastSeq  int64
+}
 
-	// Start individual ping goroutines for each target with staggered starts
-	hostIndex := 0
-	totalHosts := 0
-	for _, org := range currentTargets.Organizations {
-		totalHosts += len(org.Hosts)
+// NewInfluxSpool opens the spool directory, creating it if needed, and indexes existing segments
+func NewInfluxSpool(dir string, maxBytes int64) (*InfluxSpool, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory %s: %w", dir, err)
 	}
 
-	staggerDelay := pingInterval / time.Duration(totalHosts)
-	if staggerDelay > 100*time.Millisecond {
-		staggerDelay = 100 * time.Millisecond // Cap at 100ms
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory %s: %w", dir, err)
 	}
 
-	sp.verbosef("Starting %d individual ping schedules with %v stagger delay", totalHosts, staggerDelay)
+	spool := &InfluxSpool{dir: dir, maxBytes: maxBytes}
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
 
-	for orgName, org := range currentTargets.Organizations {
-		for _, host := range org.Hosts {
-			// Stagger the start times to avoid thundering herd
-			startDelay := time.Duration(hostIndex) * staggerDelay
-			hostIndex++
+		// Remove segments left half written by a crash
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(path)
+			continue
+		}
 
-			sp.wg.Add(1)
-			go func(orgName string, host Host, delay time.Duration) {
-				defer sp.wg.Done()
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, ".lp"), 10, 64)
+		if err != nil || !strings.HasSuffix(name, ".lp") {
+			continue
+		}
 
-				// Initial delay to stagger starts
-				if delay > 0 {
-					select {
-					case <-sp.ctx.Done():
-						return
-					case <-time.After(delay):
-					}
-				}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read spool segment %s: %w", path, err)
+		}
 
-				sp.runIndividualPingSchedule(orgName, host, pingInterval)
-			}(orgName, host, startDelay)
+		spool.segments = append(spool.segments, SpoolSegment{
+			Path: path, Size: int64(len(data)), Points: strings.Count(string(data), "\n")})
+		spool.bytes += int64(len(data))
+		if seq > spool.lastSeq {
+			spool.lastSeq = seq
 		}
 	}
-}
 
-// runIndividualPingSchedule runs a consistent ping schedule for a single target
-func (sp *SmogPing) runIndividualPingSchedule(orgName string, host Host, pingInterval time.Duration) {
-	// Initialize ping data collection for this host
-	pingData := make([]time.Duration, 0, sp.config.DataPointPings)
-	pingCount := 0
-	dataPointStartTime := time.Now()
+	// Zero padded names sort by sequence
+	sort.Slice(spool.segments, func(i, j int) bool {
+		return spool.segments[i].Path < spool.segments[j].Path
+	})
 
-	ticker := time.NewTicker(pingInterval)
-	defer ticker.Stop()
+	return spool, nil
+}
 
-	sp.debugf("Started individual ping schedule for %s (%s): ping every %v", host.Name, host.IP, pingInterval)
+// Append stores a batch as a new segment. The oldest segments are dropped to stay
+// within the size limit, the number of points dropped is returned.
+func (s *InfluxSpool) Append(lines []string) (int, error) {
+	return s.store(lines, false)
+}
 
-	for {
-		select {
-		case <-sp.ctx.Done():
-			return
-		case <-ticker.C:
-			// Send a single ping
-			rtt, success := sp.sendSinglePing(host)
+// Prepend stores a batch as a segment replayed before all others, for a batch older
+// than the spooled ones. Like Append it drops the oldest segments to stay within the size limit.
+func (s *InfluxSpool) Prepend(lines []string) (int, error) {
+	return s.store(lines, true)
+}
 
-			if success {
-				pingData = append(pingData, rtt)
-				sp.debugf("Ping %d/%d for %s (%s): %v", len(pingData), sp.config.DataPointPings, host.Name, host.IP, rtt)
-			} else {
-				sp.debugf("Ping %d/%d for %s (%s): failed", pingCount+1, sp.config.DataPointPings, host.Name, host.IP)
-			}
+// store writes a batch as a new segment, at the front of the spool if first is set
+func (s *InfluxSpool) store(lines []string, first bool) (int, error) {
+	data := strings.Join(lines, "\n") + "\n"
+	size := int64(len(data))
+	if size > s.maxBytes {
+		return 0, fmt.Errorf("batch of %d bytes exceeds spool size %d", size, s.maxBytes)
+	}
 
-			pingCount++
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-			// Check if we have collected enough pings for a data point
-			if pingCount >= sp.config.DataPointPings {
-				// Calculate and store the data point
-				sp.processDataPoint(orgName, host, pingData, dataPointStartTime)
+	dropped := 0
+	for len(s.segments) > 0 && s.bytes+size > s.maxBytes {
+		oldest := s.segments[0]
+		os.Remove(oldest.Path)
+		s.segments = s.segments[1:]
+		s.bytes -= oldest.Size
+		dropped += oldest.Points
+	}
 
-				// Reset for next data point
-				pingData = pingData[:0] // Reuse slice
-				pingCount = 0
-				dataPointStartTime = time.Now()
-			}
+	seq := time.Now().UnixNano()
+	if seq <= s.lastSeq {
+		seq = s.lastSeq + 1
+	}
+	if first && len(s.segments) > 0 {
+		// Sort before the oldest segment, whose name is its sequence number
+		oldest, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(s.segments[0].Path), ".lp"), 10, 64)
+		if err != nil {
+			return dropped, err
 		}
+		seq = oldest - 1
 	}
-}
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d.lp", seq))
 
-// sendSinglePing sends a single ping to a host and returns the RTT and success status
-func (sp *SmogPing) sendSinglePing(host Host) (time.Duration, bool) {
-	// Use resolved IP if available, otherwise use original IP
-	targetIP := host.ResolvedIP
-	if targetIP == "" {
-		targetIP = host.IP
+	// Write to a temporary file first so a crash never leaves a partial segment
+	if err := os.WriteFile(path+".tmp", []byte(data), 0640); err != nil {
+		os.Remove(path + ".tmp")
+		return dropped, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return dropped, err
 	}
 
-	// Create pinger
-	pinger, err := probing.NewPinger(targetIP)
-	if err != nil {
-		sp.debugf("Failed to create pinger for %s (%s -> %s): %v", host.Name, host.IP, targetIP, err)
-		return 0, false
+	segment := SpoolSegment{Path: path, Size: size, Points: len(lines)}
+	if first {
+		s.segments = append([]SpoolSegment{segment}, s.segments...)
+	} else {
+		s.segments = append(s.segments, segment)
 	}
+	if seq > s.lastSeq {
+		s.lastSeq = seq
+	}
+	s.bytes += size
+	return dropped, nil
+}
 
-	// Set pinger options for single ping
-	pinger.Count = 1
-	pinger.Timeout = time.Duration(sp.config.PingTimeout) * time.Second
-	pinger.SetPrivileged(false) // Use unprivileged mode
+// Oldest returns the segment to replay next
+func (s *InfluxSpool) Oldest() (SpoolSegment, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	// Set source IP if configured - check host-specific first, then global
-	var sourceIP string
-	if host.PingSource != "" && host.PingSource != "default" {
-		sourceIP = host.PingSource
-	} else if sp.config.PingSource != "" && sp.config.PingSource != "default" {
-		sourceIP = sp.config.PingSource
+	if len(s.segments) == 0 {
+		return SpoolSegment{}, false
 	}
+	return s.segments[0], true
+}
 
-	if sourceIP != "" {
-		pinger.Source = sourceIP
-		sp.debugf("Using source IP %s for pinging %s", sourceIP, targetIP)
+// Read returns the lines of a segment
+func (s *InfluxSpool) Read(segment SpoolSegment) ([]string, error) {
+	data, err := os.ReadFile(segment.Path)
+	if err != nil {
+		return nil, err
 	}
 
-	// Send ping
-	err = pinger.Run()
-	if err != nil {
-		sp.debugf("Ping failed for %s (%s -> %s): %v", host.Name, host.IP, targetIP, err)
-		return 0, false
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
 	}
+	return lines, nil
+}
+
+// Remove deletes a segment, segments already dropped to stay within the size limit are ignored
+func (s *InfluxSpool) Remove(segment SpoolSegment) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	// Check results
-	stats := pinger.Statistics()
-	if stats.PacketsRecv > 0 {
-		return stats.AvgRtt, true
+	for i, existing := range s.segments {
+		if existing.Path == segment.Path {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			s.bytes -= existing.Size
+			return os.Remove(segment.Path)
+		}
 	}
+	return nil
+}
 
-	return 0, false
+// Pending reports whether batches are waiting to be replayed
+func (s *InfluxSpool) Pending() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.segments) > 0
 }
 
-// processDataPoint calculates statistics and stores the data point
-func (sp *SmogPing) processDataPoint(orgName string, host Host, rtts []time.Duration, startTime time.Time) {
-	// Get result object from pool
-	result := sp.getPingResultFromPool()
-	defer sp.returnPingResultToPool(result)
+// Size returns the number of spooled batches and their total size in bytes
+func (s *InfluxSpool) Size() (int, int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.segments), s.bytes
+}
 
-	// Calculate statistics
-	successfulPings := len(rtts)
+// Histogram buckets of the Prometheus exporter
+var (
+	rttBucketsMs       = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+	lossBucketsPercent = []float64{0, 1, 5, 10, 25, 50, 75, 100}
+)
 
-	if successfulPings == 0 {
-		// Complete packet loss
-		result.Host = host
-		result.AvgRTT = 0
-		result.PacketLoss = 100.0
-		result.Jitter = 0
-		result.Timestamp = startTime
-		result.OrgName = orgName
+// PromHistogram is a cumulative Prometheus histogram
+type PromHistogram struct {
+	Buckets []float64 // Upper bounds, ascending
+	Counts  []uint64  // Observations per bucket (not cumulative)
+	Sum     float64
+	Count   uint64
+}
 
-		sp.verbosef("Data point for %s (%s): 100%% packet loss", host.Name, host.IP)
-	} else {
-		// Calculate average RTT
-		var totalRTT time.Duration
-		for _, rtt := range rtts {
-			totalRTT += rtt
+// NewPromHistogram creates an empty histogram with the given bucket upper bounds
+func NewPromHistogram(buckets []float64) *PromHistogram {
+	return &PromHistogram{Buckets: buckets, Counts: make([]uint64, len(buckets))}
+}
+
+// Observe adds a value to the histogram
+func (ph *PromHistogram) Observe(value float64) {
+	for i, bound := range ph.Buckets {
+		if value <= bound {
+			ph.Counts[i]++
+			break
 		}
-		avgRTT := totalRTT / time.Duration(successfulPings)
+	}
+	ph.Sum += value
+	ph.Count++
+}
 
-		// Calculate packet loss percentage
-		packetLoss := float64(sp.config.DataPointPings-successfulPings) / float64(sp.config.DataPointPings) * 100.0
+// PromSeries holds the exported state of a single target
+type PromSeries struct {
+	Labels      map[string]string
+	RTTAvg      float64 // Milliseconds
+	PacketLoss  float64 // Percent
+	Jitter      float64 // Milliseconds
+	RTTSamples  *PromHistogram
+	LossSamples *PromHistogram
+}
 
-		// Calculate jitter (standard deviation of RTTs)
-		var jitter time.Duration
-		if successfulPings > 1 {
-			variance := float64(0)
-			avgRTTFloat := float64(avgRTT)
-			for _, rtt := range rtts {
-				diff := float64(rtt) - avgRTTFloat
-				variance += diff * diff
-			}
-			variance /= float64(successfulPings)
-			jitter = time.Duration(math.Sqrt(variance))
-		}
+// PrometheusExporter exposes the latest data point of every target in the Prometheus text format
+type PrometheusExporter struct {
+	mutex      sync.RWMutex
+	series     map[string]*PromSeries // Keyed by targetKey
+	collectors []MetricsCollector     // Additional metrics such as output statistics
+	server     *http.Server           // Serves /metrics, nil if not listening
+}
 
-		result.Host = host
-		result.AvgRTT = avgRTT
-		result.PacketLoss = packetLoss
-		result.Jitter = jitter
-		result.Timestamp = startTime
-		result.OrgName = orgName
+// MetricsCollector contributes additional metrics to the Prometheus exporter
+type MetricsCollector interface {
+	WriteMetrics(w io.Writer)
+}
 
-		sp.verbosef("Data point for %s (%s): avg=%v, loss=%.1f%%, jitter=%v",
-			host.Name, host.IP, avgRTT, packetLoss, jitter)
-	}
+// NewPrometheusExporter creates an empty exporter
+func NewPrometheusExporter() *PrometheusExporter {
+	return &PrometheusExporter{series: make(map[string]*PromSeries)}
+}
 
-	// Store the result
-	sp.storeResult(result)
+// AddCollector registers additional metrics
+func (pe *PrometheusExporter) AddCollector(collector MetricsCollector) {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+	pe.collectors = append(pe.collectors, collector)
 }
 
-// storeResult processes and stores a ping result
-func (sp *SmogPing) storeResult(result *PingResult) {
-	sp.debugf("Processing result for %s (%s)", result.Host.Name, result.Host.IP)
+// Name implements Sink
+func (pe *PrometheusExporter) Name() string {
+	return "prometheus"
+}
+
+// Write records a data point of a target. Histograms restart when the target's labels change.
+func (pe *PrometheusExporter) Write(result PingResult, labels map[string]string) {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	key := targetKey(result.OrgName, result.Host)
+
+	series, exists := pe.series[key]
+	if !exists || !equalLabels(series.Labels, labels) {
+		series = &PromSeries{
+			Labels:      labels,
+			RTTSamples:  NewPromHistogram(rttBucketsMs),
+			LossSamples: NewPromHistogram(lossBucketsPercent),
+		}
+		pe.series[key] = series
+	}
+
+	series.RTTAvg = float64(result.AvgRTT.Nanoseconds()) / 1e6
+	series.PacketLoss = result.PacketLoss
+	series.Jitter = float64(result.Jitter.Nanoseconds()) / 1e6
+
+	for _, rtt := range result.RTTs {
+		series.RTTSamples.Observe(float64(rtt.Nanoseconds()) / 1e6)
+	}
+	series.LossSamples.Observe(result.PacketLoss)
+}
 
-	// Write to InfluxDB
-	sp.writeToInflux(*result)
+// RemoveTarget drops a target that is no longer monitored
+func (pe *PrometheusExporter) RemoveTarget(orgName string, host Host) {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+	delete(pe.series, targetKey(orgName, host))
+}
 
-	// Check alarms if enabled
-	if !sp.noAlarm {
-		sp.checkAlarms(*result)
+// Close stops the HTTP listener
+func (pe *PrometheusExporter) Close() {
+	if pe.server == nil {
+		return
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pe.server.Shutdown(ctx)
 }
 
-// pingAllTargets pings all configured targets using the worker pool with dynamic staggered starts
-func (sp *SmogPing) pingAllTargets() {
-	startTime := time.Now()
+// WriteTo writes all series in the Prometheus text exposition format
+func (pe *PrometheusExporter) WriteTo(w io.Writer) (int64, error) {
+	pe.mutex.RLock()
+	defer pe.mutex.RUnlock()
+
+	// Sort series for stable output
+	keys := make([]string, 0, len(pe.series))
+	for key := range pe.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+
+	gauges := []struct {
+		name  string
+		help  string
+		value func(*PromSeries) float64
+	}{
+		{"smogping_rtt_avg_ms", "Average round trip time of the latest data point in milliseconds.",
+			func(s *PromSeries) float64 { return s.RTTAvg }},
+		{"smogping_packet_loss_percent", "Packet loss of the latest data point in percent.",
+			func(s *PromSeries) float64 { return s.PacketLoss }},
+		{"smogping_jitter_ms", "Jitter (RTT standard deviation) of the latest data point in milliseconds.",
+			func(s *PromSeries) float64 { return s.Jitter }},
+	}
+	for _, gauge := range gauges {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n", gauge.name, gauge.help, gauge.name)
+		for _, key := range keys {
+			series := pe.series[key]
+			fmt.Fprintf(&buf, "%s%s %s\n", gauge.name, formatPromLabels(series.Labels, "", ""),
+				formatPromValue(gauge.value(series)))
+		}
+	}
 
-	// Get current targets with read lock
-	sp.targetsMux.RLock()
-	currentTargets := sp.targets
-	sp.targetsMux.RUnlock()
+	histograms := []struct {
+		name  string
+		help  string
+		value func(*PromSeries) *PromHistogram
+	}{
+		{"smogping_rtt_sample_ms", "Round trip time of individual successful pings in milliseconds.",
+			func(s *PromSeries) *PromHistogram { return s.RTTSamples }},
+		{"smogping_data_point_loss_percent", "Packet loss per data point in percent.",
+			func(s *PromSeries) *PromHistogram { return s.LossSamples }},
+	}
+	for _, histogram := range histograms {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s histogram\n", histogram.name, histogram.help, histogram.name)
+		for _, key := range keys {
+			series := pe.series[key]
+			h := histogram.value(series)
+			var cumulative uint64
+			for i, bound := range h.Buckets {
+				cumulative += h.Counts[i]
+				fmt.Fprintf(&buf, "%s_bucket%s %d\n", histogram.name,
+					formatPromLabels(series.Labels, "le", formatPromValue(bound)), cumulative)
+			}
+			fmt.Fprintf(&buf, "%s_bucket%s %d\n", histogram.name, formatPromLabels(series.Labels, "le", "+Inf"), h.Count)
+			fmt.Fprintf(&buf, "%s_sum%s %s\n", histogram.name, formatPromLabels(series.Labels, "", ""), formatPromValue(h.Sum))
+			fmt.Fprintf(&buf, "%s_count%s %d\n", histogram.name, formatPromLabels(series.Labels, "", ""), h.Count)
+		}
+	}
 
-	// Count total hosts
-	totalHosts := 0
-	for _, org := range currentTargets.Organizations {
-		totalHosts += len(org.Hosts)
+	for _, collector := range pe.collectors {
+		collector.WriteMetrics(&buf)
 	}
 
-	// Calculate dynamic stagger timing
-	// hosts_per_second = ceil(total_hosts / data_point_time)
-	hostsPerSecond := int(math.Ceil(float64(totalHosts) / float64(sp.config.DataPointTime)))
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
 
-	sp.verbosef("Starting ping cycle for %d targets: %d hosts per second over %d seconds",
-		totalHosts, hostsPerSecond, sp.config.DataPointTime)
+// ServeHTTP implements the /metrics endpoint
+func (pe *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	pe.WriteTo(w)
+}
 
-	// Create a slice of all hosts with their org names for easier batching
-	allJobs := make([]PingJob, 0, totalHosts)
-	for orgName, org := range currentTargets.Organizations {
-		for _, host := range org.Hosts {
-			allJobs = append(allJobs, PingJob{
-				OrgName: orgName,
-				Host:    host,
-			})
+// formatPromLabels renders a sorted label set, optionally with one extra label such as le
+func formatPromLabels(labels map[string]string, extraName, extraValue string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		fmt.Fprintf(&sb, "%s=\"%s\"", name, escapePromLabelValue(labels[name]))
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			sb.WriteString(",")
 		}
+		fmt.Fprintf(&sb, "%s=\"%s\"", extraName, extraValue)
 	}
+	sb.WriteString("}")
+	return sb.String()
+}
 
-	// Start hosts in batches every second
-	jobIndex := 0
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+// escapePromLabelValue escapes backslashes, quotes and newlines in a label value
+func escapePromLabelValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+// formatPromValue formats a sample value
+func formatPromValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
 
-	for jobIndex < len(allJobs) {
-		// Calculate how many hosts to start in this batch
-		remainingJobs := len(allJobs) - jobIndex
-		batchSize := hostsPerSecond
-		if remainingJobs < batchSize {
-			batchSize = remainingJobs
+// equalLabels reports whether two label sets are identical
+func equalLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if b[name] != value {
+			return false
 		}
+	}
+	return true
+}
 
-		sp.debugf("Submitting batch of %d jobs (jobs %d-%d of %d)",
-			batchSize, jobIndex+1, jobIndex+batchSize, totalHosts)
+// newMetricsExporter starts the Prometheus /metrics listener
+func (sp *SmogPing) newMetricsExporter() (*PrometheusExporter, error) {
+	listener, err := net.Listen("tcp", sp.config.MetricsListen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", sp.config.MetricsListen, err)
+	}
 
-		// Submit this batch of jobs to worker pool
-		for i := 0; i < batchSize && jobIndex < len(allJobs); i++ {
-			job := allJobs[jobIndex]
-			jobIndex++
+	exporter := NewPrometheusExporter()
 
-			sp.debugf("Submitting job for %s (%s)", job.Host.Name, job.Host.IP)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+	exporter.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
 
-			// Submit job to worker pool (non-blocking)
-			select {
-			case sp.workerPool.jobQueue <- job:
-				// Job submitted successfully
-			default:
-				// Job queue is full, log warning
-				sp.debugf("Warning: Job queue full, skipping %s (%s)", job.Host.Name, job.Host.IP)
-			}
+	go func() {
+		if err := exporter.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Prometheus exporter error: %v", err)
 		}
+	}()
 
-		// If there are more jobs to process, wait for next second
-		if jobIndex < len(allJobs) {
-			<-ticker.C
-		}
-	}
+	log.Printf("Prometheus metrics available at http://%s/metrics", listener.Addr())
+	return exporter, nil
+}
 
-	elapsed := time.Since(startTime)
-	sp.verbosef("Submitted all %d ping jobs in %v", totalHosts, elapsed)
+// metricsEnabled reports whether the Prometheus exporter is configured
+func (sp *SmogPing) metricsEnabled() bool {
+	return sp.config.MetricsListen != "" && strings.ToLower(sp.config.MetricsListen) != "none"
 }
 
-// pingHost performs ping operations on a single host spread over the data point time interval
-func (sp *SmogPing) pingHost(orgName string, host Host) *PingResult {
-	// Use resolved IP if available, otherwise use original IP
-	targetIP := host.ResolvedIP
-	if targetIP == "" {
-		targetIP = host.IP
+// influxEnabled reports whether InfluxDB output is configured
+func (sp *SmogPing) influxEnabled() bool {
+	return sp.config.InfluxURL != ""
+}
+
+// checkAlarms evaluates ping results against alarm thresholds and advances the
+// per-metric alarm state machines of the host
+func (sp *SmogPing) checkAlarms(result PingResult) {
+	result.Host = hostWithDefaults(result.Host, sp.currentConfig())
+	host := result.Host
+	hostKey := alarmKey(result.OrgName, host)
+
+	// Skip alarm checking if no alarm thresholds are configured, resolving alarms a reload left active
+	if host.AlarmPing == 0 && host.AlarmLoss == 0 && host.AlarmJitter == 0 &&
+		host.WarnPing == 0 && host.WarnLoss == 0 && host.WarnJitter == 0 {
+		sp.debugf("No alarm thresholds configured for %s (%s), skipping alarm check", host.Name, host.IP)
+		sp.resolveAlarmStates(result, hostKey, "alarm thresholds removed")
+		return
 	}
 
-	// Calculate interval between pings
-	pingInterval := time.Duration(sp.config.DataPointTime) * time.Second / time.Duration(sp.config.DataPointPings)
+	// Skip alarm checking if neither an alarm receiver nor a webhook is configured
+	if sp.alarmReceiverFor(host) == "" && sp.alarmWebhookFor(host) == "" {
+		sp.debugf("No alarm receiver configured for %s (%s), skipping alarm check", host.Name, host.IP)
+		sp.resolveAlarmStates(result, hostKey, "alarm receiver removed")
+		return
+	}
 
-	sp.debugf("Pinging %s (%s -> %s): %d pings over %v (interval: %v)",
-		host.Name, host.IP, targetIP, sp.config.DataPointPings,
-		time.Duration(sp.config.DataPointTime)*time.Second, pingInterval)
+	sp.debugf("Checking alarms for %s (%s): ping_threshold=%d/%d, loss_threshold=%d/%d, jitter_threshold=%d/%d",
+		host.Name, host.IP, host.WarnPing, host.AlarmPing, host.WarnLoss, host.AlarmLoss, host.WarnJitter, host.AlarmJitter)
 
-	// Get RTT slice from pool for better memory efficiency
-	rtts := sp.getRTTSliceFromPool()
-	defer sp.returnRTTSliceToPool(rtts)
+	metrics := []alarmMetric{
+		{"ping", "ping_time", "ms", float64(result.AvgRTT.Nanoseconds()) / 1e6, host.WarnPing, host.AlarmPing, host.ClearPing},
+		{"loss", "packet_loss", "%", result.PacketLoss, host.WarnLoss, host.AlarmLoss, host.ClearLoss},
+		{"jitter", "jitter", "ms", float64(result.Jitter.Nanoseconds()) / 1e6, host.WarnJitter, host.AlarmJitter, host.ClearJitter},
+	}
 
-	successfulPings := 0
-	startTime := time.Now()
+	// Raise after alarmcount breaching data points out of the last alarmwindow
+	count, window := alarmCountWindow(host)
 
-	// Send pings at intervals with natural rate control via worker pool
-	for i := 0; i < sp.config.DataPointPings; i++ {
-		// Check if we should stop due to context cancellation
-		select {
-		case <-sp.ctx.Done():
-			return nil
-		default:
-		}
+	now := time.Now()
+	var events []AlarmEvent
 
-		sp.debugf("Sending ping %d/%d to %s (%s -> %s)", i+1, sp.config.DataPointPings, host.Name, host.IP, targetIP)
+	sp.alarmMutex.Lock()
+	hostAlarms, exists := sp.alarmStates[hostKey]
+	if !exists {
+		hostAlarms = make(map[string]*MetricAlarm)
+		sp.alarmStates[hostKey] = hostAlarms
+	}
 
-		// Send single ping to resolved IP
-		pinger, err := probing.NewPinger(targetIP)
-		if err != nil {
-			sp.debugf("Failed to create pinger for %s (%s -> %s) ping %d: %v", host.Name, host.IP, targetIP, i+1, err)
+	for _, metric := range metrics {
+		if metric.warning == 0 && metric.critical == 0 {
+			// A reload removed the thresholds, close the alarm before forgetting it
+			if event, active := resolveEvent(hostAlarms[metric.name], metric.name, "alarm thresholds removed", now); active {
+				events = append(events, event)
+			}
+			delete(hostAlarms, metric.name)
 			continue
 		}
 
-		// Set pinger options for single ping
-		pinger.Count = 1
-		pinger.Timeout = time.Duration(sp.config.PingTimeout) * time.Second
-		pinger.SetPrivileged(false) // Use unprivileged mode
-
-		// Set source IP if configured - check host-specific first, then global
-		var sourceIP string
-		if host.PingSource != "" && host.PingSource != "default" {
-			sourceIP = host.PingSource
-		} else if sp.config.PingSource != "" && sp.config.PingSource != "default" {
-			sourceIP = sp.config.PingSource
+		alarm, exists := hostAlarms[metric.name]
+		if !exists {
+			alarm = &MetricAlarm{State: AlarmStateOK}
+			hostAlarms[metric.name] = alarm
 		}
 
-		if sourceIP != "" {
-			pinger.Source = sourceIP
-		}
+		// Determine the state the recent data points put the metric in
+		newState, reason := evaluateAlarmMetric(alarm, metric, count, window)
 
-		pingStart := time.Now()
-		err = pinger.Run()
-		if err != nil {
-			sp.debugf("Failed ping %d for %s (%s -> %s): %v", i+1, host.Name, host.IP, targetIP, err)
-		} else {
-			stats := pinger.Statistics()
-			if stats.PacketsRecv > 0 {
-				rtts = append(rtts, stats.AvgRtt)
-				successfulPings++
-				sp.debugf("Ping %d for %s (%s -> %s): %v", i+1, host.Name, host.IP, targetIP, stats.AvgRtt)
-			} else {
-				sp.debugf("Ping %d for %s (%s -> %s): no response", i+1, host.Name, host.IP, targetIP)
-			}
-		}
+		event := AlarmEvent{Metric: metric.name, State: newState, PreviousState: alarm.State, Reason: reason}
 
-		// Wait for next ping interval (unless this is the last ping)
-		if i < sp.config.DataPointPings-1 {
-			elapsed := time.Since(pingStart)
-			sleepTime := pingInterval - elapsed
-			if sleepTime > 0 {
-				time.Sleep(sleepTime)
+		switch {
+		case newState == alarm.State && newState == AlarmStateOK:
+			continue
+		case newState == alarm.State:
+			// Still in alarm, remind the receiver once per alarm_rate
+			if now.Sub(alarm.LastNotify) < time.Duration(sp.currentConfig().AlarmRate)*time.Second {
+				sp.debugf("Alarm rate limit active for %s (%s) %s, last notification: %v ago",
+					host.Name, host.IP, metric.name, now.Sub(alarm.LastNotify))
+				continue
+			}
+			event.Type = AlarmEventRepeat
+			event.Duration = now.Sub(alarm.Since)
+		case newState == AlarmStateOK:
+			event.Type = AlarmEventResolve
+			event.Duration = now.Sub(alarm.Since)
+		default:
+			// Raised from OK, escalated or de-escalated between WARNING and CRITICAL
+			if alarm.State == AlarmStateOK {
+				alarm.Since = now
 			}
+			event.Type = AlarmEventTrigger
+			event.Duration = now.Sub(alarm.Since)
 		}
-	}
 
-	// Get result object from pool
-	result := sp.getPingResultFromPool()
+		sp.debugf("Alarm %s for %s (%s) %s: %s -> %s", event.Type, host.Name, host.IP,
+			metric.name, alarm.State, newState)
 
-	// Calculate aggregated results
-	if len(rtts) == 0 {
-		result.Host = host
-		result.AvgRTT = 0
-		result.PacketLoss = 100.0
-		result.Jitter = 0
-		result.Timestamp = startTime
-		result.OrgName = orgName
+		alarm.State = newState
+		alarm.LastNotify = now
+		events = append(events, event)
+	}
+	sp.alarmMutex.Unlock()
 
-		sp.verbosef("Ping summary for %s (%s -> %s): 100%% packet loss", host.Name, host.IP, targetIP)
-		return result
+	if len(events) == 0 {
+		sp.debugf("No alarm state changes for %s (%s)", host.Name, host.IP)
+		return
 	}
 
-	// Calculate average RTT
-	var totalRTT time.Duration
-	for _, rtt := range rtts {
-		totalRTT += rtt
+	for _, event := range events {
+		sp.triggerAlarm(result, event)
 	}
-	avgRTT := totalRTT / time.Duration(len(rtts))
+}
 
-	// Calculate packet loss percentage
-	packetLoss := float64(sp.config.DataPointPings-successfulPings) / float64(sp.config.DataPointPings) * 100.0
+// Maximum backendsdown of an expanded host
+const maxBackends = 1000
 
-	// Calculate jitter (standard deviation of RTTs)
-	var jitter time.Duration
-	if len(rtts) > 1 {
-		variance := float64(0)
-		for _, rtt := range rtts {
-			diff := float64(rtt - avgRTT)
-			variance += diff * diff
-		}
-		variance /= float64(len(rtts) - 1)
-		jitter = time.Duration(math.Sqrt(variance))
+// BackendGroup tracks the roll-up alarm of a host expanded into one target per address
+type BackendGroup struct {
+	Down  map[string]bool // Whether the latest data point of each address had 100% packet loss
+	Alarm MetricAlarm
+}
+
+// checkBackendRollup counts the addresses of an expanded host that are down and raises an alarm
+// for the host once backendsdown of them are. It resolves when fewer addresses are down.
+func (sp *SmogPing) checkBackendRollup(result PingResult) {
+	result.Host = hostWithDefaults(result.Host, sp.currentConfig())
+	host := result.Host
+	if host.Backend == "" || host.BackendsDown <= 0 {
+		return
+	}
+	if sp.alarmReceiverFor(host) == "" && sp.alarmWebhookFor(host) == "" {
+		return
 	}
 
-	// Fill result object
-	result.Host = host
-	result.AvgRTT = avgRTT
-	result.PacketLoss = packetLoss
-	result.Jitter = jitter
-	result.Timestamp = startTime
-	result.OrgName = orgName
+	key := backendGroupKey(result.OrgName, host)
+	now := time.Now()
 
-	sp.verbosef("Ping summary for %s (%s -> %s): avg=%.1fms, loss=%.1f%%, jitter=%.1fms",
-		host.Name, host.IP, targetIP,
-		float64(avgRTT.Nanoseconds())/1e6,
-		packetLoss,
-		float64(jitter.Nanoseconds())/1e6)
+	sp.alarmMutex.Lock()
+	group, exists := sp.backendGroups[key]
+	if !exists {
+		group = &BackendGroup{Down: make(map[string]bool), Alarm: MetricAlarm{State: AlarmStateOK}}
+		sp.backendGroups[key] = group
+	}
+	group.Down[host.Backend] = result.PacketLoss >= 100
 
-	if sp.debug {
-		sp.debugf("Data point calculated for %s (%s -> %s):", host.Name, host.IP, targetIP)
-		sp.debugf("  RTTs collected: %v", rtts)
-		sp.debugf("  Successful pings: %d/%d", successfulPings, sp.config.DataPointPings)
-		sp.debugf("  Average RTT: %v (%.1fms)", avgRTT, float64(avgRTT.Nanoseconds())/1e6)
-		sp.debugf("  Packet loss: %.1f%%", packetLoss)
-		sp.debugf("  Jitter: %v (%.1fms)", jitter, float64(jitter.Nanoseconds())/1e6)
-		sp.debugf("  Timestamp: %s", startTime.Format(time.RFC3339))
+	down := 0
+	for _, isDown := range group.Down {
+		if isDown {
+			down++
+		}
 	}
 
-	return result
+	alarm := &group.Alarm
+	newState := AlarmStateOK
+	reason := fmt.Sprintf("backends_down=%d/%d<%d", down, len(group.Down), host.BackendsDown)
+	if down >= host.BackendsDown {
+		newState = AlarmStateCritical
+		reason = fmt.Sprintf("backends_down=%d/%d>=%d", down, len(group.Down), host.BackendsDown)
+	}
+
+	event := AlarmEvent{Metric: "backends", State: newState, PreviousState: alarm.State, Reason: reason}
+	switch {
+	case newState == alarm.State && newState == AlarmStateOK:
+		sp.alarmMutex.Unlock()
+		return
+	case newState == alarm.State:
+		// Still in alarm, remind the receiver once per alarm_rate
+		if now.Sub(alarm.LastNotify) < time.Duration(sp.currentConfig().AlarmRate)*time.Second {
+			sp.alarmMutex.Unlock()
+			return
+		}
+		event.Type = AlarmEventRepeat
+	case newState == AlarmStateOK:
+		event.Type = AlarmEventResolve
+	default:
+		alarm.Since = now
+		event.Type = AlarmEventTrigger
+	}
+	event.Duration = now.Sub(alarm.Since)
+	alarm.State = newState
+	alarm.LastNotify = now
+	sp.alarmMutex.Unlock()
+
+	// Report the alarm for the host rather than the address that completed it
+	result.Host.Backend = ""
+	result.Host.ResolvedIP = ""
+	result.RTTs = nil
+	sp.triggerAlarm(result, event)
 }
 
-// writeToInflux writes ping results to InfluxDB with batching
-func (sp *SmogPing) writeToInflux(result PingResult) {
-	// Use resolved IP if available for the actual ping target
-	targetIP := result.Host.ResolvedIP
-	if targetIP == "" {
-		targetIP = result.Host.IP
-	}
+// alarmMetric is a single metric of a data point checked against its thresholds
+type alarmMetric struct {
+	name     string // ping, loss or jitter
+	field    string // Reason prefix
+	unit     string
+	value    float64
+	warning  int
+	critical int
+	clear    int // Value at or below which an alarm clears (defaults to the lowest threshold)
+}
 
-	// Determine effective source IP for tags
-	var effectiveSource string
-	if result.Host.PingSource != "" && result.Host.PingSource != "default" {
-		effectiveSource = result.Host.PingSource
-	} else if sp.config.PingSource != "" && sp.config.PingSource != "default" {
-		effectiveSource = sp.config.PingSource
-	} else {
-		effectiveSource = "default"
+// alarmCountWindow returns the M-of-N alarm evaluation settings of a host
+func alarmCountWindow(host Host) (int, int) {
+	count := host.AlarmCount
+	if count <= 0 {
+		count = 1 // Raise on the first breaching data point
 	}
+	window := host.AlarmWindow
+	if window < count {
+		window = count // N consecutive data points
+	}
+	if window > maxAlarmWindow {
+		window = maxAlarmWindow
+	}
+	return count, window
+}
 
-	tags := map[string]string{
-		"host":         result.Host.Name,
-		"ip":           result.Host.IP, // Original IP/hostname
-		"organization": result.OrgName,
-		"source":       effectiveSource,
+// evaluateAlarmMetric adds a data point to the metric history and returns the resulting alarm state.
+// A level is raised when at least count of the last window values exceed its threshold. An active
+// alarm only returns to OK once the last count values are at or below the clear threshold.
+func evaluateAlarmMetric(alarm *MetricAlarm, metric alarmMetric, count, window int) (AlarmState, string) {
+	// Append to the history ring, dropping the oldest values beyond the window
+	alarm.History = append(alarm.History, metric.value)
+	if len(alarm.History) > window {
+		alarm.History = append(alarm.History[:0], alarm.History[len(alarm.History)-window:]...)
+	}
+
+	breaches := func(threshold int) int {
+		n := 0
+		for _, value := range alarm.History {
+			if value > float64(threshold) {
+				n++
+			}
+		}
+		return n
 	}
 
-	// Add resolved IP as a tag if different from original
-	if result.Host.IsDNSName && targetIP != result.Host.IP {
-		tags["resolved_ip"] = targetIP
-		tags["is_dns_name"] = "true"
-	} else {
-		tags["is_dns_name"] = "false"
+	describe := func(threshold, n int) string {
+		if window > 1 {
+			return fmt.Sprintf("%s=%.1f%s, %d/%d data points>%d%s",
+				metric.field, metric.value, metric.unit, n, window, threshold, metric.unit)
+		}
+		return fmt.Sprintf("%s=%.1f%s>%d%s", metric.field, metric.value, metric.unit, threshold, metric.unit)
 	}
 
-	point := influxdb2.NewPoint("ping", tags,
-		map[string]interface{}{
-			"rtt_avg":     float64(result.AvgRTT.Nanoseconds()) / 1e6, // Convert to milliseconds
-			"packet_loss": result.PacketLoss,
-			"jitter":      float64(result.Jitter.Nanoseconds()) / 1e6, // Convert to milliseconds
-		},
-		result.Timestamp)
+	if metric.critical > 0 {
+		if n := breaches(metric.critical); n >= count {
+			return AlarmStateCritical, describe(metric.critical, n)
+		}
+	}
+	if metric.warning > 0 {
+		if n := breaches(metric.warning); n >= count {
+			return AlarmStateWarning, describe(metric.warning, n)
+		}
+	}
 
-	sp.debugf("Created InfluxDB point for %s (%s -> %s): rtt=%.1fms, loss=%.1f%%, jitter=%.1fms",
-		result.Host.Name, result.Host.IP, targetIP,
-		float64(result.AvgRTT.Nanoseconds())/1e6,
-		result.PacketLoss,
-		float64(result.Jitter.Nanoseconds())/1e6)
+	if alarm.State == AlarmStateOK {
+		return AlarmStateOK, ""
+	}
 
-	// Add to batch
-	sp.batchMutex.Lock()
-	sp.batchPoints = append(sp.batchPoints, point)
-	batchSize := len(sp.batchPoints)
-	sp.batchMutex.Unlock()
+	// Hysteresis: stay in alarm until the most recent values are at or below the clear threshold
+	clearThreshold := metric.clear
+	if clearThreshold <= 0 {
+		clearThreshold = metric.critical
+		if metric.warning > 0 {
+			clearThreshold = metric.warning
+		}
+	}
+	recent := alarm.History
+	if len(recent) > count {
+		recent = recent[len(recent)-count:]
+	}
+	for _, value := range recent {
+		if value > float64(clearThreshold) {
+			return alarm.State, fmt.Sprintf("%s=%.1f%s, clears at <=%d%s",
+				metric.field, metric.value, metric.unit, clearThreshold, metric.unit)
+		}
+	}
 
-	sp.debugf("Added point to batch (current size: %d/%d)", batchSize, sp.config.InfluxBatchSize)
+	return AlarmStateOK, fmt.Sprintf("%s=%.1f%s<=%d%s", metric.field, metric.value, metric.unit, clearThreshold, metric.unit)
+}
 
-	// Check if we need to flush due to size
-	if batchSize >= sp.config.InfluxBatchSize {
-		sp.flushBatch("size")
+// alarmKey returns the key of a host in the alarm state tracking
+func alarmKey(orgName string, host Host) string {
+	if host.Backend != "" {
+		return fmt.Sprintf("%s_%s%s_%s", orgName, host.Name, dualStackSuffix(host), host.Backend)
 	}
+	return fmt.Sprintf("%s_%s%s", orgName, host.Name, dualStackSuffix(host))
 }
 
-// checkAlarms evaluates ping results against alarm thresholds
-func (sp *SmogPing) checkAlarms(result PingResult) {
-	host := result.Host
-
-	// Skip alarm checking if no alarm thresholds are configured
-	if host.AlarmPing == 0 && host.AlarmLoss == 0 && host.AlarmJitter == 0 {
-		sp.debugf("No alarm thresholds configured for %s (%s), skipping alarm check", host.Name, host.IP)
-		return
+// resolveEvent returns the resolve event of an alarm that stops being evaluated, active is false
+// when there is no alarm or it is OK
+func resolveEvent(alarm *MetricAlarm, metric, reason string, now time.Time) (event AlarmEvent, active bool) {
+	if alarm == nil || alarm.State == AlarmStateOK {
+		return AlarmEvent{}, false
 	}
+	return AlarmEvent{
+		Type: AlarmEventResolve, Metric: metric, State: AlarmStateOK, PreviousState: alarm.State,
+		Duration: now.Sub(alarm.Since), Reason: reason}, true
+}
 
-	// Skip alarm checking if no alarm receiver is configured
-	alarmReceiver := host.AlarmReceiver
-	if alarmReceiver == "" {
-		alarmReceiver = sp.config.AlarmReceiver
-	}
-	if alarmReceiver == "" || strings.ToLower(alarmReceiver) == "none" {
-		sp.debugf("No alarm receiver configured for %s (%s), skipping alarm check", host.Name, host.IP)
-		return
+// takeAlarmStates removes the alarm states of a host and returns the resolve events of those that
+// are not OK, by metric name. The caller holds alarmMutex.
+func (sp *SmogPing) takeAlarmStates(hostKey, reason string, now time.Time) []AlarmEvent {
+	hostAlarms := sp.alarmStates[hostKey]
+	var events []AlarmEvent
+	for _, metric := range slices.Sorted(maps.Keys(hostAlarms)) {
+		if event, active := resolveEvent(hostAlarms[metric], metric, reason, now); active {
+			events = append(events, event)
+		}
 	}
+	delete(sp.alarmStates, hostKey)
+	return events
+}
 
-	sp.debugf("Checking alarms for %s (%s): ping_threshold=%d, loss_threshold=%d, jitter_threshold=%d",
-		host.Name, host.IP, host.AlarmPing, host.AlarmLoss, host.AlarmJitter)
-
-	// Check if we're within the alarm rate limit
-	hostKey := fmt.Sprintf("%s_%s", result.OrgName, host.Name)
-	sp.alarmMutex.RLock()
-	lastAlarm, exists := sp.lastAlarms[hostKey]
-	sp.alarmMutex.RUnlock()
+// resolveAlarmStates forgets the alarm states of a host that are no longer evaluated, resolving
+// those still active so their receivers can close them
+func (sp *SmogPing) resolveAlarmStates(result PingResult, hostKey, reason string) {
+	sp.alarmMutex.Lock()
+	events := sp.takeAlarmStates(hostKey, reason, time.Now())
+	sp.alarmMutex.Unlock()
 
-	if exists && time.Since(lastAlarm) < time.Duration(sp.config.AlarmRate)*time.Second {
-		// Still within alarm rate limit, skip
-		sp.debugf("Alarm rate limit active for %s (%s), last alarm: %v ago",
-			host.Name, host.IP, time.Since(lastAlarm))
-		return
+	for _, event := range events {
+		sp.triggerAlarm(result, event)
 	}
+}
 
-	var alarmReasons []string
+// clearAlarmStates forgets the alarm states of a host that is no longer monitored, resolving its
+// active alarms and the roll-up alarm of its expanded host once the last address is gone
+func (sp *SmogPing) clearAlarmStates(orgName string, host Host) {
+	host = hostWithDefaults(host, sp.currentConfig())
+	now := time.Now()
+	var events, rollupEvents []AlarmEvent
 
-	// Check ping time alarm (alarmping is in milliseconds)
-	if host.AlarmPing > 0 {
-		avgRTTMs := float64(result.AvgRTT.Nanoseconds()) / 1e6
-		if avgRTTMs > float64(host.AlarmPing) {
-			alarmReasons = append(alarmReasons, fmt.Sprintf("ping_time=%.1fms>%dms", avgRTTMs, host.AlarmPing))
-			sp.debugf("Ping time alarm triggered for %s (%s): %.1fms > %dms",
-				host.Name, host.IP, avgRTTMs, host.AlarmPing)
-		}
+	sp.alarmMutex.Lock()
+	if sp.alarmStates != nil {
+		events = sp.takeAlarmStates(alarmKey(orgName, host), "target removed", now)
 	}
 
-	// Check packet loss alarm (alarmloss is in percentage)
-	if host.AlarmLoss > 0 {
-		if result.PacketLoss > float64(host.AlarmLoss) {
-			alarmReasons = append(alarmReasons, fmt.Sprintf("packet_loss=%.1f%%>%d%%", result.PacketLoss, host.AlarmLoss))
-			sp.debugf("Packet loss alarm triggered for %s (%s): %.1f%% > %d%%",
-				host.Name, host.IP, result.PacketLoss, host.AlarmLoss)
+	// Forget the address in the roll-up of its expanded host
+	if group, exists := sp.backendGroups[backendGroupKey(orgName, host)]; exists && host.Backend != "" {
+		delete(group.Down, host.Backend)
+		if len(group.Down) == 0 {
+			if event, active := resolveEvent(&group.Alarm, "backends", "target removed", now); active {
+				rollupEvents = append(rollupEvents, event)
+			}
+			delete(sp.backendGroups, backendGroupKey(orgName, host))
 		}
 	}
+	sp.alarmMutex.Unlock()
 
-	// Check jitter alarm (alarmjitter is in milliseconds)
-	if host.AlarmJitter > 0 {
-		jitterMs := float64(result.Jitter.Nanoseconds()) / 1e6
-		if jitterMs > float64(host.AlarmJitter) {
-			alarmReasons = append(alarmReasons, fmt.Sprintf("jitter=%.1fms>%dms", jitterMs, host.AlarmJitter))
-			sp.debugf("Jitter alarm triggered for %s (%s): %.1fms > %dms",
-				host.Name, host.IP, jitterMs, host.AlarmJitter)
-		}
+	result := PingResult{Host: host, OrgName: orgName, Timestamp: now}
+	for _, event := range events {
+		sp.triggerAlarm(result, event)
 	}
 
-	// If any alarms triggered, execute alarm receiver
-	if len(alarmReasons) > 0 {
-		sp.triggerAlarm(result, alarmReasons)
-
-		// Update last alarm time
-		sp.alarmMutex.Lock()
-		sp.lastAlarms[hostKey] = time.Now()
-		sp.alarmMutex.Unlock()
-	} else {
-		sp.debugf("No alarm thresholds exceeded for %s (%s)", host.Name, host.IP)
+	// Report the roll-up alarm for the host rather than its last address
+	result.Host.Backend = ""
+	result.Host.ResolvedIP = ""
+	for _, event := range rollupEvents {
+		sp.triggerAlarm(result, event)
 	}
 }
 
-// triggerAlarm executes the alarm receiver script
-func (sp *SmogPing) triggerAlarm(result PingResult, reasons []string) {
-	host := result.Host
+// hostAddressLabel returns the address of a host for log messages, naming the family of dual-stack targets
+func hostAddressLabel(host Host) string {
+	label := host.IP
+	if hostFamily(host) == familyBoth {
+		label = fmt.Sprintf("%s IPv%d", host.IP, host.AddressFamily)
+	}
+	if host.Backend != "" {
+		label += " " + host.Backend
+	}
+	return label
+}
 
-	// Determine which alarm receiver to use
+// alarmReceiverFor returns the alarm receiver script of a host, or "" if alarms are not executed
+func (sp *SmogPing) alarmReceiverFor(host Host) string {
 	alarmReceiver := host.AlarmReceiver
 	if alarmReceiver == "" {
-		alarmReceiver = sp.config.AlarmReceiver
+		alarmReceiver = sp.currentConfig().AlarmReceiver
+	}
+	if strings.ToLower(alarmReceiver) == "none" {
+		return ""
 	}
+	return alarmReceiver
+}
 
-	if alarmReceiver == "" {
-		log.Printf("ALARM: %s (%s) - %v - No alarm receiver configured",
-			host.Name, host.IP, reasons)
+// alarmWebhookFor returns the alarm webhook URL of a host, or "" if no webhook is configured
+func (sp *SmogPing) alarmWebhookFor(host Host) string {
+	alarmWebhook := host.AlarmWebhook
+	if alarmWebhook == "" {
+		alarmWebhook = sp.currentConfig().AlarmWebhook
+	}
+	if strings.ToLower(alarmWebhook) == "none" {
+		return ""
+	}
+	return alarmWebhook
+}
+
+// triggerAlarm executes the alarm receiver script and webhook for an alarm event
+func (sp *SmogPing) triggerAlarm(result PingResult, event AlarmEvent) {
+	host := result.Host
+
+	// Determine which alarm receiver and webhook to use
+	alarmReceiver := sp.alarmReceiverFor(host)
+	alarmWebhook := sp.alarmWebhookFor(host)
+
+	if alarmReceiver == "" && alarmWebhook == "" {
+		log.Printf("ALARM %s: %s (%s) - %s %s (was %s) - %s - No alarm receiver configured",
+			event.Type, host.Name, hostAddressLabel(host), event.Metric, event.State, event.PreviousState, event.Reason)
 		// Log alarm to syslog (unless disabled)
 		if !sp.noLog {
-			sp.syslogWarning("ALARM: %s (%s) in %s - %s - No alarm receiver configured",
-				host.Name, host.IP, result.OrgName, strings.Join(reasons, ", "))
+			sp.syslogWarning("ALARM %s: %s (%s) in %s - %s %s (was %s) - %s - No alarm receiver configured",
+				event.Type, host.Name, hostAddressLabel(host), result.OrgName, event.Metric, event.State, event.PreviousState, event.Reason)
 		}
 		return
 	}
 
-	// Prepare alarm data as environment variables and command line arguments
-	reasonsStr := fmt.Sprintf("[%s]", strings.Join(reasons, ", "))
+	var notifiers []string
+	if alarmReceiver != "" {
+		notifiers = append(notifiers, alarmReceiver)
+	}
+	if alarmWebhook != "" {
+		notifiers = append(notifiers, "webhook "+webhookDisplayName(alarmWebhook))
+	}
 
-	log.Printf("ALARM: %s (%s) - %s - Executing: %s",
-		host.Name, host.IP, reasonsStr, alarmReceiver)
+	log.Printf("ALARM %s: %s (%s) - %s %s (was %s) for %s - [%s] - Executing: %s",
+		event.Type, host.Name, hostAddressLabel(host), event.Metric, event.State, event.PreviousState,
+		event.Duration.Round(time.Second), event.Reason, strings.Join(notifiers, ", "))
 
 	// Log alarm to syslog (unless disabled)
 	if !sp.noLog {
-		sp.syslogWarning("ALARM: %s (%s) in %s - %s - RTT=%.1fms LOSS=%.1f%% JITTER=%.1fms",
-			host.Name, host.IP, result.OrgName, strings.Join(reasons, ", "),
+		sp.syslogWarning("ALARM %s: %s (%s) in %s - %s %s (was %s) for %s - %s - RTT=%.1fms LOSS=%.1f%% JITTER=%.1fms",
+			event.Type, host.Name, hostAddressLabel(host), result.OrgName, event.Metric, event.State, event.PreviousState,
+			event.Duration.Round(time.Second), event.Reason,
 			float64(result.AvgRTT.Nanoseconds())/1e6, result.PacketLoss,
 			float64(result.Jitter.Nanoseconds())/1e6)
 	}
 
-	// Execute alarm receiver in background
-	go sp.executeAlarmReceiver(alarmReceiver, result, reasons)
+	// Execute alarm receiver and webhook in background
+	if alarmReceiver != "" {
+		go sp.executeAlarmReceiver(alarmReceiver, result, event)
+	}
+	if alarmWebhook != "" {
+		go sp.sendAlarmWebhook(alarmWebhook, result, event)
+	}
 }
 
 // executeAlarmReceiver runs the alarm receiver script with alarm data
-func (sp *SmogPing) executeAlarmReceiver(receiverPath string, result PingResult, reasons []string) {
+func (sp *SmogPing) executeAlarmReceiver(receiverPath string, result PingResult, event AlarmEvent) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
 	host := result.Host
+	durationSeconds := fmt.Sprintf("%d", int64(event.Duration.Seconds()))
 
 	sp.debugf("Executing alarm receiver: %s for %s (%s)", receiverPath, host.Name, host.IP)
 
@@ -2695,8 +7313,13 @@ func (sp *SmogPing) executeAlarmReceiver(receiverPath string, result PingResult,
 		fmt.Sprintf("%.1f", float64(result.AvgRTT.Nanoseconds())/1e6), // $4: RTT in ms
 		fmt.Sprintf("%.1f", result.PacketLoss),                        // $5: Packet loss %
 		fmt.Sprintf("%.1f", float64(result.Jitter.Nanoseconds())/1e6), // $6: Jitter in ms
-		strings.Join(reasons, ","),                                    // $7: Alarm reasons
-		result.Timestamp.Format(time.RFC3339),                         // $8: Timestamp
+		event.Reason,                          // $7: Alarm reason
+		result.Timestamp.Format(time.RFC3339), // $8: Timestamp
+		event.Type,                            // $9: Event type (trigger, repeat, resolve)
+		event.Metric,                          // $10: Metric (ping, loss, jitter)
+		string(event.State),                   // $11: New alarm state
+		string(event.PreviousState),           // $12: Previous alarm state
+		durationSeconds,                       // $13: Alarm duration in seconds
 	}
 
 	sp.debugf("Alarm receiver args: %v", args[1:]) // Skip the script path
@@ -2712,11 +7335,23 @@ func (sp *SmogPing) executeAlarmReceiver(receiverPath string, result PingResult,
 		fmt.Sprintf("SMOGPING_RTT=%.1f", float64(result.AvgRTT.Nanoseconds())/1e6),
 		fmt.Sprintf("SMOGPING_LOSS=%.1f", result.PacketLoss),
 		fmt.Sprintf("SMOGPING_JITTER=%.1f", float64(result.Jitter.Nanoseconds())/1e6),
-		fmt.Sprintf("SMOGPING_REASONS=%s", strings.Join(reasons, ",")),
+		fmt.Sprintf("SMOGPING_REASONS=%s", event.Reason),
 		fmt.Sprintf("SMOGPING_TIMESTAMP=%s", result.Timestamp.Format(time.RFC3339)),
 		fmt.Sprintf("SMOGPING_ALARM_PING=%d", host.AlarmPing),
 		fmt.Sprintf("SMOGPING_ALARM_LOSS=%d", host.AlarmLoss),
 		fmt.Sprintf("SMOGPING_ALARM_JITTER=%d", host.AlarmJitter),
+		fmt.Sprintf("SMOGPING_WARN_PING=%d", host.WarnPing),
+		fmt.Sprintf("SMOGPING_WARN_LOSS=%d", host.WarnLoss),
+		fmt.Sprintf("SMOGPING_WARN_JITTER=%d", host.WarnJitter),
+		fmt.Sprintf("SMOGPING_EVENT=%s", event.Type),
+		fmt.Sprintf("SMOGPING_METRIC=%s", event.Metric),
+		fmt.Sprintf("SMOGPING_STATE=%s", event.State),
+		fmt.Sprintf("SMOGPING_PREVIOUS_STATE=%s", event.PreviousState),
+		fmt.Sprintf("SMOGPING_DURATION=%s", durationSeconds),
+		fmt.Sprintf("SMOGPING_AF=%d", host.AddressFamily),
+	}
+	for _, name := range slices.Sorted(maps.Keys(host.Tags)) {
+		env = append(env, fmt.Sprintf("SMOGPING_TAG_%s=%s", strings.ToUpper(name), host.Tags[name]))
 	}
 
 	cmd.Env = append(os.Environ(), env...)
@@ -2743,3 +7378,181 @@ func (sp *SmogPing) executeAlarmReceiver(receiverPath string, result PingResult,
 		}
 	}
 }
+
+// WebhookThreshold holds the configured thresholds of one metric
+type WebhookThreshold struct {
+	Warning  int `json:"warning"`
+	Critical int `json:"critical"`
+	Clear    int `json:"clear"`
+}
+
+// WebhookMetrics holds the measured values of the data point that caused an alarm event
+type WebhookMetrics struct {
+	RTTMs       float64 `json:"rtt_ms"`
+	LossPercent float64 `json:"loss_percent"`
+	JitterMs    float64 `json:"jitter_ms"`
+}
+
+// WebhookPayload is the JSON document posted to alarm webhooks
+type WebhookPayload struct {
+	Event           string                      `json:"event"`
+	Metric          string                      `json:"metric"`
+	State           string                      `json:"state"`
+	PreviousState   string                      `json:"previous_state"`
+	DurationSeconds int64                       `json:"duration_seconds"`
+	Host            string                      `json:"host"`
+	Organization    string                      `json:"organization"`
+	IP              string                      `json:"ip"`
+	ResolvedIP      string                      `json:"resolved_ip"`
+	AddressFamily   int                         `json:"af,omitempty"`
+	Tags            map[string]string           `json:"tags,omitempty"`
+	Timestamp       string                      `json:"timestamp"`
+	Metrics         WebhookMetrics              `json:"metrics"`
+	Thresholds      map[string]WebhookThreshold `json:"thresholds"`
+	Reasons         []string                    `json:"reasons"`
+}
+
+// WebhookNotifier posts alarm events as JSON to HTTP endpoints
+type WebhookNotifier struct {
+	Headers map[string]string // Extra request headers, e.g. Authorization
+	Retries int               // Retries after the first failed attempt
+	Backoff time.Duration     // Delay before the first retry, doubled for each further retry
+	client  *http.Client
+}
+
+// NewWebhookNotifier creates a webhook notifier with a per-request timeout
+func NewWebhookNotifier(timeout time.Duration, retries int, backoff time.Duration, headers map[string]string) *WebhookNotifier {
+	return &WebhookNotifier{
+		Headers: headers,
+		Retries: retries,
+		Backoff: backoff,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// Send posts the payload to the webhook URL, retrying failed deliveries with exponential backoff.
+// Network errors, 429 and 5xx responses are retried; other responses are final.
+func (wn *WebhookNotifier) Send(ctx context.Context, webhookURL string, payload WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook payload: %w", err)
+	}
+
+	backoff := wn.Backoff
+	var lastErr error
+	for attempt := 0; attempt <= wn.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("webhook delivery cancelled after %d attempts: %w", attempt, lastErr)
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		retry, err := wn.post(ctx, webhookURL, body)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retry {
+			break
+		}
+	}
+
+	return lastErr
+}
+
+// post performs a single webhook delivery attempt and reports whether a failure is worth retrying
+func (wn *WebhookNotifier) post(ctx context.Context, webhookURL string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("invalid webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "smogping")
+	for name, value := range wn.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := wn.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook returned HTTP %d", resp.StatusCode)
+}
+
+// buildWebhookPayload converts an alarm event into the webhook JSON document
+func buildWebhookPayload(result PingResult, event AlarmEvent) WebhookPayload {
+	host := result.Host
+
+	resolvedIP := host.ResolvedIP
+	if resolvedIP == "" {
+		resolvedIP = host.IP
+	}
+
+	return WebhookPayload{
+		Event:           event.Type,
+		Metric:          event.Metric,
+		State:           string(event.State),
+		PreviousState:   string(event.PreviousState),
+		DurationSeconds: int64(event.Duration.Seconds()),
+		Host:            host.Name,
+		Organization:    result.OrgName,
+		IP:              host.IP,
+		ResolvedIP:      resolvedIP,
+		AddressFamily:   host.AddressFamily,
+		Tags:            host.Tags,
+		Timestamp:       result.Timestamp.Format(time.RFC3339),
+		Metrics: WebhookMetrics{
+			RTTMs:       float64(result.AvgRTT.Nanoseconds()) / 1e6,
+			LossPercent: result.PacketLoss,
+			JitterMs:    float64(result.Jitter.Nanoseconds()) / 1e6,
+		},
+		Thresholds: map[string]WebhookThreshold{
+			"ping":   {Warning: host.WarnPing, Critical: host.AlarmPing, Clear: host.ClearPing},
+			"loss":   {Warning: host.WarnLoss, Critical: host.AlarmLoss, Clear: host.ClearLoss},
+			"jitter": {Warning: host.WarnJitter, Critical: host.AlarmJitter, Clear: host.ClearJitter},
+		},
+		Reasons: []string{event.Reason},
+	}
+}
+
+// sendAlarmWebhook delivers an alarm event to a webhook
+func (sp *SmogPing) sendAlarmWebhook(webhookURL string, result PingResult, event AlarmEvent) {
+	host := result.Host
+	sp.configMux.RLock()
+	notifier := sp.webhookNotifier
+	sp.configMux.RUnlock()
+
+	// Bound the whole delivery including retries
+	budget := notifier.client.Timeout*time.Duration(notifier.Retries+1) + notifier.Backoff*time.Duration(1<<notifier.Retries)
+	ctx, cancel := context.WithTimeout(context.Background(), budget)
+	defer cancel()
+
+	sp.debugf("Posting alarm webhook for %s (%s) to %s", host.Name, host.IP, webhookDisplayName(webhookURL))
+
+	if err := notifier.Send(ctx, webhookURL, buildWebhookPayload(result, event)); err != nil {
+		log.Printf("ERROR: Alarm webhook failed for %s (%s) to %s: %v",
+			host.Name, host.IP, webhookDisplayName(webhookURL), err)
+		return
+	}
+
+	sp.verbosef("Alarm webhook delivered for %s (%s) to %s", host.Name, host.IP, webhookDisplayName(webhookURL))
+}
+
+// webhookDisplayName returns the host part of a webhook URL, keeping tokens in paths out of logs
+func webhookDisplayName(webhookURL string) string {
+	if parsed, err := url.Parse(webhookURL); err == nil && parsed.Host != "" {
+		return parsed.Scheme + "://" + parsed.Host
+	}
+	return "webhook"
+}
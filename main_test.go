@@ -0,0 +1,1258 @@
+// SPDX-License-Identifier: GPL-3.0
+// Copyright (C) 2025 FexTel, Inc. <info@ibscale.com>
+// Author: James Pearson <jamesp@ibscale.com>
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// webhookServer answers webhook posts with the given status codes in turn, repeating the last one
+func webhookServer(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempt := int(attempts.Add(1)) - 1
+		w.WriteHeader(statuses[min(attempt, len(statuses)-1)])
+	}))
+	t.Cleanup(server.Close)
+	return server, &attempts
+}
+
+func TestWebhookRetriesServerErrorsWithBackoff(t *testing.T) {
+	server, attempts := webhookServer(t, http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK)
+	notifier := NewWebhookNotifier(time.Second, 3, 20*time.Millisecond, nil)
+
+	start := time.Now()
+	if err := notifier.Send(context.Background(), server.URL, WebhookPayload{Event: AlarmEventTrigger}); err != nil {
+		t.Fatalf("Send() = %v, want delivery after retries", err)
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("attempts = %d, want 3", got)
+	}
+	// 20ms before the first retry, doubled to 40ms before the second
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("retries took %v, want at least 60ms of backoff", elapsed)
+	}
+}
+
+func TestWebhookGivesUpAfterRetries(t *testing.T) {
+	server, attempts := webhookServer(t, http.StatusInternalServerError)
+	notifier := NewWebhookNotifier(time.Second, 2, time.Millisecond, nil)
+
+	if err := notifier.Send(context.Background(), server.URL, WebhookPayload{}); err == nil {
+		t.Fatal("Send() = nil, want error after the retries failed")
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("attempts = %d, want 3", got)
+	}
+}
+
+func TestWebhookDoesNotRetryClientErrors(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound} {
+		server, attempts := webhookServer(t, status)
+		notifier := NewWebhookNotifier(time.Second, 3, time.Millisecond, nil)
+
+		if err := notifier.Send(context.Background(), server.URL, WebhookPayload{}); err == nil {
+			t.Errorf("HTTP %d: Send() = nil, want error", status)
+		}
+		if got := attempts.Load(); got != 1 {
+			t.Errorf("HTTP %d: attempts = %d, want 1", status, got)
+		}
+	}
+}
+
+func TestWebhookSendsHeaders(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+	}))
+	defer server.Close()
+
+	notifier := NewWebhookNotifier(time.Second, 0, 0, map[string]string{
+		"Authorization": "Bearer secret",
+		"X-Team":        "noc",
+	})
+	if err := notifier.Send(context.Background(), server.URL, WebhookPayload{}); err != nil {
+		t.Fatalf("Send() = %v", err)
+	}
+
+	got := <-headers
+	want := map[string]string{
+		"Authorization": "Bearer secret",
+		"X-Team":        "noc",
+		"Content-Type":  "application/json",
+		"User-Agent":    "smogping",
+	}
+	for name, value := range want {
+		if got.Get(name) != value {
+			t.Errorf("header %s = %q, want %q", name, got.Get(name), value)
+		}
+	}
+}
+
+func TestWebhookPayloadEvents(t *testing.T) {
+	result := PingResult{
+		Host: Host{
+			Name: "edge1", IP: "edge1.example.com", ResolvedIP: "192.0.2.10",
+			AlarmPing: 200, WarnPing: 100, ClearPing: 80, AlarmLoss: 10,
+			Tags: map[string]string{"site": "fra1"},
+		},
+		OrgName:    "Edge",
+		AvgRTT:     250 * time.Millisecond,
+		PacketLoss: 20,
+		Jitter:     5 * time.Millisecond,
+		Timestamp:  time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+	events := []AlarmEvent{
+		{Type: AlarmEventTrigger, Metric: "ping", State: AlarmStateCritical, PreviousState: AlarmStateOK,
+			Reason: "ping 250ms >= 200ms"},
+		{Type: AlarmEventRepeat, Metric: "loss", State: AlarmStateCritical, PreviousState: AlarmStateCritical,
+			Duration: 5 * time.Minute, Reason: "loss 20% >= 10%"},
+		{Type: AlarmEventResolve, Metric: "ping", State: AlarmStateOK, PreviousState: AlarmStateCritical,
+			Duration: 10 * time.Minute, Reason: "ping 70ms <= 80ms"},
+	}
+
+	for _, event := range events {
+		bodies := make(chan []byte, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body json.RawMessage
+			json.NewDecoder(r.Body).Decode(&body)
+			bodies <- body
+		}))
+
+		notifier := NewWebhookNotifier(time.Second, 0, 0, nil)
+		if err := notifier.Send(context.Background(), server.URL, buildWebhookPayload(result, event)); err != nil {
+			t.Fatalf("%s: Send() = %v", event.Type, err)
+		}
+		server.Close()
+
+		var payload map[string]any
+		if err := json.Unmarshal(<-bodies, &payload); err != nil {
+			t.Fatalf("%s: invalid JSON: %v", event.Type, err)
+		}
+
+		want := map[string]any{
+			"event":            event.Type,
+			"metric":           event.Metric,
+			"state":            string(event.State),
+			"previous_state":   string(event.PreviousState),
+			"duration_seconds": event.Duration.Seconds(),
+			"host":             "edge1",
+			"organization":     "Edge",
+			"ip":               "edge1.example.com",
+			"resolved_ip":      "192.0.2.10",
+			"timestamp":        "2025-06-01T12:00:00Z",
+		}
+		for key, value := range want {
+			if payload[key] != value {
+				t.Errorf("%s: %s = %v, want %v", event.Type, key, payload[key], value)
+			}
+		}
+
+		metrics, _ := payload["metrics"].(map[string]any)
+		if metrics["rtt_ms"] != 250.0 || metrics["loss_percent"] != 20.0 || metrics["jitter_ms"] != 5.0 {
+			t.Errorf("%s: metrics = %v", event.Type, payload["metrics"])
+		}
+		thresholds, _ := payload["thresholds"].(map[string]any)
+		ping, _ := thresholds["ping"].(map[string]any)
+		if ping["warning"] != 100.0 || ping["critical"] != 200.0 || ping["clear"] != 80.0 {
+			t.Errorf("%s: ping thresholds = %v", event.Type, thresholds["ping"])
+		}
+		for _, metric := range []string{"loss", "jitter"} {
+			if _, exists := thresholds[metric]; !exists {
+				t.Errorf("%s: thresholds missing %s", event.Type, metric)
+			}
+		}
+		reasons, _ := payload["reasons"].([]any)
+		if len(reasons) != 1 || reasons[0] != event.Reason {
+			t.Errorf("%s: reasons = %v, want [%s]", event.Type, payload["reasons"], event.Reason)
+		}
+		tags, _ := payload["tags"].(map[string]any)
+		if tags["site"] != "fra1" {
+			t.Errorf("%s: tags = %v", event.Type, payload["tags"])
+		}
+		if _, exists := payload["af"]; exists {
+			t.Errorf("%s: af set for a host without family", event.Type)
+		}
+	}
+}
+
+// dnsStub is a local UDP nameserver answering every query with reply, no response if it returns nil
+func dnsStub(t *testing.T, reply func(query dnsmessage.Message) []byte) int {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start DNS stub: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, peer, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buffer[:n]); err != nil {
+				continue
+			}
+			if response := reply(query); response != nil {
+				conn.WriteTo(response, peer)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// dnsAnswer builds a response to query with the given ID, response code and A records
+func dnsAnswer(t *testing.T, query dnsmessage.Message, id uint16, rcode dnsmessage.RCode, addresses ...string) []byte {
+	t.Helper()
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, RCode: rcode})
+	builder.StartQuestions()
+	for _, question := range query.Questions {
+		builder.Question(question)
+	}
+	builder.StartAnswers()
+	for _, address := range addresses {
+		var a [4]byte
+		copy(a[:], net.ParseIP(address).To4())
+		builder.AResource(dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Class: dnsmessage.ClassINET, TTL: 60},
+			dnsmessage.AResource{A: a})
+	}
+	response, err := builder.Finish()
+	if err != nil {
+		t.Errorf("failed to build DNS response: %v", err) // Runs in the stub goroutine, no Fatal
+	}
+	return response
+}
+
+func TestDNSProbe(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    Host
+		reply   func(t *testing.T, query dnsmessage.Message) []byte
+		success bool
+	}{
+		{
+			name: "answer",
+			host: Host{ExpectAnswer: "192.0.2.1"},
+			reply: func(t *testing.T, query dnsmessage.Message) []byte {
+				return dnsAnswer(t, query, query.ID, dnsmessage.RCodeSuccess, "192.0.2.2", "192.0.2.1")
+			},
+			success: true,
+		},
+		{
+			name: "rcode mismatch",
+			host: Host{},
+			reply: func(t *testing.T, query dnsmessage.Message) []byte {
+				return dnsAnswer(t, query, query.ID, dnsmessage.RCodeNameError)
+			},
+		},
+		{
+			name: "expected rcode",
+			host: Host{ExpectRcode: "nxdomain"},
+			reply: func(t *testing.T, query dnsmessage.Message) []byte {
+				return dnsAnswer(t, query, query.ID, dnsmessage.RCodeNameError)
+			},
+			success: true,
+		},
+		{
+			name: "id mismatch",
+			host: Host{},
+			reply: func(t *testing.T, query dnsmessage.Message) []byte {
+				return dnsAnswer(t, query, query.ID+1, dnsmessage.RCodeSuccess, "192.0.2.1")
+			},
+		},
+		{
+			name: "expectanswer mismatch",
+			host: Host{ExpectAnswer: "192.0.2.1"},
+			reply: func(t *testing.T, query dnsmessage.Message) []byte {
+				return dnsAnswer(t, query, query.ID, dnsmessage.RCodeSuccess, "192.0.2.2")
+			},
+		},
+	}
+
+	sp := &SmogPing{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			host := test.host
+			host.Name, host.Probe, host.Query = "stub", probeDNS, "www.example.com"
+			host.Port = dnsStub(t, func(query dnsmessage.Message) []byte { return test.reply(t, query) })
+
+			rtt, success := sp.sendDNSProbe(host, "127.0.0.1", "", time.Second)
+			if success != test.success {
+				t.Fatalf("sendDNSProbe() success = %v, want %v", success, test.success)
+			}
+			if success && rtt <= 0 {
+				t.Errorf("sendDNSProbe() rtt = %v, want > 0", rtt)
+			}
+		})
+	}
+}
+
+func TestDNSProbeTimeout(t *testing.T) {
+	port := dnsStub(t, func(query dnsmessage.Message) []byte { return nil })
+	host := Host{Name: "stub", Probe: probeDNS, Query: "www.example.com", Port: port}
+
+	start := time.Now()
+	if _, success := (&SmogPing{}).sendDNSProbe(host, "127.0.0.1", "", 200*time.Millisecond); success {
+		t.Fatal("sendDNSProbe() succeeded without a response")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("sendDNSProbe() gave up after %v, want the 200ms timeout", elapsed)
+	}
+}
+
+// icmpOutcome is the result an ICMP request was completed with
+type icmpOutcome struct {
+	rtt time.Duration
+	err error
+}
+
+// registerEcho registers an echo request to target on the socket and returns its sequence number
+// and the channel receiving its outcome
+func registerEcho(t *testing.T, socket *icmpSocket, target string, timeout time.Duration) (uint16, chan icmpOutcome) {
+	t.Helper()
+	outcomes := make(chan icmpOutcome, 2)
+	request := &icmpRequest{target: net.ParseIP(target), done: func(rtt time.Duration, err error) {
+		outcomes <- icmpOutcome{rtt, err}
+	}}
+	sequence, err := socket.register(request, timeout)
+	if err != nil {
+		t.Fatalf("register() = %v", err)
+	}
+	return sequence, outcomes
+}
+
+// echoReply marshals an ICMPv4 echo reply
+func echoReply(t *testing.T, messageType icmp.Type, id int, sequence uint16, token []byte) []byte {
+	t.Helper()
+	packet, err := (&icmp.Message{Type: messageType, Body: &icmp.Echo{ID: id, Seq: int(sequence), Data: token}}).Marshal(nil)
+	if err != nil {
+		t.Fatalf("failed to marshal echo reply: %v", err)
+	}
+	return packet
+}
+
+func TestICMPReplyMatching(t *testing.T) {
+	target := "192.0.2.1"
+	peer := &net.UDPAddr{IP: net.ParseIP(target)}
+
+	tests := []struct {
+		name       string
+		privileged bool
+		reply      func(socket *icmpSocket, sequence uint16) ([]byte, net.Addr)
+		matches    bool
+	}{
+		{
+			name: "reply",
+			reply: func(socket *icmpSocket, sequence uint16) ([]byte, net.Addr) {
+				return echoReply(t, ipv4.ICMPTypeEchoReply, socket.id, sequence, socket.token), peer
+			},
+			matches: true,
+		},
+		{
+			name: "kernel identifier on unprivileged socket",
+			reply: func(socket *icmpSocket, sequence uint16) ([]byte, net.Addr) {
+				return echoReply(t, ipv4.ICMPTypeEchoReply, socket.id+1, sequence, socket.token), peer
+			},
+			matches: true,
+		},
+		{
+			name:       "other identifier on raw socket",
+			privileged: true,
+			reply: func(socket *icmpSocket, sequence uint16) ([]byte, net.Addr) {
+				return echoReply(t, ipv4.ICMPTypeEchoReply, socket.id+1, sequence, socket.token), &net.IPAddr{IP: peer.IP}
+			},
+		},
+		{
+			name:       "raw socket reply",
+			privileged: true,
+			reply: func(socket *icmpSocket, sequence uint16) ([]byte, net.Addr) {
+				return echoReply(t, ipv4.ICMPTypeEchoReply, socket.id, sequence, socket.token), &net.IPAddr{IP: peer.IP}
+			},
+			matches: true,
+		},
+		{
+			name: "other sequence",
+			reply: func(socket *icmpSocket, sequence uint16) ([]byte, net.Addr) {
+				return echoReply(t, ipv4.ICMPTypeEchoReply, socket.id, sequence+1, socket.token), peer
+			},
+		},
+		{
+			name: "other token",
+			reply: func(socket *icmpSocket, sequence uint16) ([]byte, net.Addr) {
+				return echoReply(t, ipv4.ICMPTypeEchoReply, socket.id, sequence, []byte("someone")), peer
+			},
+		},
+		{
+			name: "other peer",
+			reply: func(socket *icmpSocket, sequence uint16) ([]byte, net.Addr) {
+				return echoReply(t, ipv4.ICMPTypeEchoReply, socket.id, sequence, socket.token), &net.UDPAddr{IP: net.ParseIP("192.0.2.2")}
+			},
+		},
+		{
+			name: "echo request",
+			reply: func(socket *icmpSocket, sequence uint16) ([]byte, net.Addr) {
+				return echoReply(t, ipv4.ICMPTypeEcho, socket.id, sequence, socket.token), peer
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			socket := newICMPSocket(4, "0.0.0.0")
+			socket.privileged = test.privileged
+			sequence, outcomes := registerEcho(t, socket, target, time.Minute)
+
+			packet, from := test.reply(socket, sequence)
+			socket.handleReply(packet, from, time.Now().Add(time.Millisecond))
+
+			select {
+			case outcome := <-outcomes:
+				if !test.matches {
+					t.Fatalf("reply completed the request with %v, %v", outcome.rtt, outcome.err)
+				}
+				if outcome.err != nil || outcome.rtt <= 0 {
+					t.Errorf("outcome = %v, %v, want a round-trip time", outcome.rtt, outcome.err)
+				}
+				if len(socket.pending) != 0 {
+					t.Errorf("%d requests still pending", len(socket.pending))
+				}
+			default:
+				if test.matches {
+					t.Fatal("reply did not complete the request")
+				}
+			}
+		})
+	}
+}
+
+func TestICMPTimeoutAndLateReply(t *testing.T) {
+	socket := newICMPSocket(4, "0.0.0.0")
+	sequence, outcomes := registerEcho(t, socket, "192.0.2.1", 20*time.Millisecond)
+
+	select {
+	case outcome := <-outcomes:
+		if !errors.Is(outcome.err, errICMPTimeout) {
+			t.Fatalf("outcome error = %v, want timeout", outcome.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request did not time out")
+	}
+
+	// A reply after the timeout completes nothing
+	packet := echoReply(t, ipv4.ICMPTypeEchoReply, socket.id, sequence, socket.token)
+	socket.handleReply(packet, &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}, time.Now())
+	select {
+	case outcome := <-outcomes:
+		t.Fatalf("late reply completed the request again with %v, %v", outcome.rtt, outcome.err)
+	default:
+	}
+}
+
+func TestICMPSequenceReuse(t *testing.T) {
+	socket := newICMPSocket(4, "0.0.0.0")
+	socket.sequence = 0xfffd
+
+	// Sequence numbers wrap around and skip those still in flight
+	first, _ := registerEcho(t, socket, "192.0.2.1", time.Minute)
+	second, _ := registerEcho(t, socket, "192.0.2.2", time.Minute)
+	socket.sequence = 0xfffd
+	third, thirdOutcomes := registerEcho(t, socket, "192.0.2.3", time.Minute)
+	if first != 0xfffe || second != 0xffff || third != 0 {
+		t.Fatalf("sequences = %d, %d, %d, want 65534, 65535, 0", first, second, third)
+	}
+
+	// A reply for a reused sequence number only completes the request of the same target
+	packet := echoReply(t, ipv4.ICMPTypeEchoReply, socket.id, third, socket.token)
+	socket.handleReply(packet, &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}, time.Now())
+	select {
+	case <-thirdOutcomes:
+		t.Fatal("reply from another target completed the request")
+	default:
+	}
+	socket.handleReply(packet, &net.UDPAddr{IP: net.ParseIP("192.0.2.3")}, time.Now())
+	select {
+	case outcome := <-thirdOutcomes:
+		if outcome.err != nil {
+			t.Errorf("outcome error = %v", outcome.err)
+		}
+	default:
+		t.Fatal("reply did not complete the request")
+	}
+
+	// The freed sequence number is handed out again
+	socket.sequence = 0xffff
+	if reused, _ := registerEcho(t, socket, "192.0.2.4", time.Minute); reused != 0 {
+		t.Errorf("sequence = %d, want 0 reused", reused)
+	}
+}
+
+func TestICMPEngineLoopback(t *testing.T) {
+	engine := NewICMPEngine()
+	defer engine.Close()
+
+	outcomes := make(chan icmpOutcome, 1)
+	engine.Send("127.0.0.1", "", 2*time.Second, func(rtt time.Duration, err error) {
+		outcomes <- icmpOutcome{rtt, err}
+	})
+	outcome := <-outcomes
+	if outcome.err != nil {
+		t.Skipf("ICMP not available: %v", outcome.err)
+	}
+	if outcome.rtt <= 0 {
+		t.Errorf("rtt = %v, want > 0", outcome.rtt)
+	}
+}
+
+// alarmWebhook returns a SmogPing posting alarm events to a test webhook and the channel receiving
+// their payloads
+func alarmWebhook(t *testing.T) (*SmogPing, chan WebhookPayload) {
+	t.Helper()
+	payloads := make(chan WebhookPayload, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload WebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("invalid webhook payload: %v", err)
+		}
+		payloads <- payload
+	}))
+	t.Cleanup(server.Close)
+
+	sp := &SmogPing{
+		config:          Config{AlarmWebhook: server.URL, AlarmRate: 3600},
+		alarmStates:     make(map[string]map[string]*MetricAlarm),
+		backendGroups:   make(map[string]*BackendGroup),
+		webhookNotifier: NewWebhookNotifier(time.Second, 0, 0, nil),
+		noLog:           true,
+	}
+	return sp, payloads
+}
+
+// alarmWant is an alarm payload expected by expectAlarms
+type alarmWant struct {
+	event, metric   string
+	state, previous AlarmState
+}
+
+// expectAlarms waits for one alarm payload per expected alarm and checks them by metric, as the
+// webhooks of one data point are sent concurrently
+func expectAlarms(t *testing.T, payloads chan WebhookPayload, wants ...alarmWant) {
+	t.Helper()
+	got := make(map[string]WebhookPayload)
+	for range wants {
+		select {
+		case payload := <-payloads:
+			got[payload.Metric] = payload
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %d alarms, want %d", len(got), len(wants))
+		}
+	}
+	for _, want := range wants {
+		payload := got[want.metric]
+		if payload.Event != want.event || payload.State != string(want.state) || payload.PreviousState != string(want.previous) {
+			t.Errorf("%s alarm = %s %s (was %s), want %s %s (was %s)", want.metric,
+				payload.Event, payload.State, payload.PreviousState, want.event, want.state, want.previous)
+		}
+	}
+}
+
+// expectNoAlarm checks that no further alarm payload is sent
+func expectNoAlarm(t *testing.T, payloads chan WebhookPayload) {
+	t.Helper()
+	select {
+	case payload := <-payloads:
+		t.Errorf("unexpected alarm %s %s %s", payload.Event, payload.Metric, payload.State)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAlarmTransitions(t *testing.T) {
+	sp, payloads := alarmWebhook(t)
+	host := Host{Name: "edge1", IP: "192.0.2.1", WarnLoss: 5, AlarmLoss: 20}
+	result := func(host Host, loss float64) PingResult {
+		return PingResult{Host: host, OrgName: "Edge", PacketLoss: loss, Timestamp: time.Now()}
+	}
+
+	sp.checkAlarms(result(host, 10))
+	expectAlarms(t, payloads, alarmWant{AlarmEventTrigger, "loss", AlarmStateWarning, AlarmStateOK})
+
+	sp.checkAlarms(result(host, 50))
+	expectAlarms(t, payloads, alarmWant{AlarmEventTrigger, "loss", AlarmStateCritical, AlarmStateWarning})
+
+	// Reminders wait for alarm_rate
+	sp.checkAlarms(result(host, 50))
+	expectNoAlarm(t, payloads)
+
+	sp.checkAlarms(result(host, 0))
+	expectAlarms(t, payloads, alarmWant{AlarmEventResolve, "loss", AlarmStateOK, AlarmStateCritical})
+
+	sp.checkAlarms(result(host, 0))
+	expectNoAlarm(t, payloads)
+}
+
+func TestAlarmResolvedWhenThresholdsRemoved(t *testing.T) {
+	sp, payloads := alarmWebhook(t)
+	host := Host{Name: "edge1", IP: "192.0.2.1", AlarmLoss: 20, AlarmPing: 100}
+	result := PingResult{Host: host, OrgName: "Edge", PacketLoss: 50, AvgRTT: 200 * time.Millisecond}
+
+	sp.checkAlarms(result)
+	expectAlarms(t, payloads,
+		alarmWant{AlarmEventTrigger, "ping", AlarmStateCritical, AlarmStateOK},
+		alarmWant{AlarmEventTrigger, "loss", AlarmStateCritical, AlarmStateOK})
+
+	// A reload removes the loss threshold only
+	result.Host.AlarmLoss = 0
+	sp.checkAlarms(result)
+	expectAlarms(t, payloads, alarmWant{AlarmEventResolve, "loss", AlarmStateOK, AlarmStateCritical})
+	expectNoAlarm(t, payloads)
+
+	// And then every threshold
+	result.Host.AlarmPing = 0
+	sp.checkAlarms(result)
+	expectAlarms(t, payloads, alarmWant{AlarmEventResolve, "ping", AlarmStateOK, AlarmStateCritical})
+	if len(sp.alarmStates) != 0 {
+		t.Errorf("alarm states = %v, want none", sp.alarmStates)
+	}
+}
+
+func TestAlarmResolvedWhenTargetRemoved(t *testing.T) {
+	sp, payloads := alarmWebhook(t)
+	host := Host{Name: "web", IP: "web.example.com", Backend: "192.0.2.1", AlarmLoss: 20, BackendsDown: 1, Expand: true}
+	result := PingResult{Host: host, OrgName: "Edge", PacketLoss: 100}
+
+	sp.checkAlarms(result)
+	expectAlarms(t, payloads, alarmWant{AlarmEventTrigger, "loss", AlarmStateCritical, AlarmStateOK})
+	sp.checkBackendRollup(result)
+	expectAlarms(t, payloads, alarmWant{AlarmEventTrigger, "backends", AlarmStateCritical, AlarmStateOK})
+
+	sp.clearAlarmStates("Edge", host)
+	expectAlarms(t, payloads,
+		alarmWant{AlarmEventResolve, "loss", AlarmStateOK, AlarmStateCritical},
+		alarmWant{AlarmEventResolve, "backends", AlarmStateOK, AlarmStateCritical})
+	if len(sp.alarmStates) != 0 || len(sp.backendGroups) != 0 {
+		t.Errorf("alarm states = %v, backend groups = %v, want none", sp.alarmStates, sp.backendGroups)
+	}
+
+	// A target removed while OK sends nothing
+	sp.checkAlarms(PingResult{Host: host, OrgName: "Edge"})
+	sp.clearAlarmStates("Edge", host)
+	expectNoAlarm(t, payloads)
+}
+
+// fakeInfluxWriter records the lines written to it, failing while err is set. Writes wait for
+// gate to be closed if it is set.
+type fakeInfluxWriter struct {
+	api.WriteAPIBlocking
+	gate  chan struct{}
+	mutex sync.Mutex
+	err   error
+	lines []string
+}
+
+func (w *fakeInfluxWriter) WriteRecord(ctx context.Context, lines ...string) error {
+	if w.gate != nil {
+		<-w.gate
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.lines = append(w.lines, lines...)
+	return nil
+}
+
+func TestInfluxSinkKeepsOrderBehindSpool(t *testing.T) {
+	spool, err := NewInfluxSpool(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := &fakeInfluxWriter{gate: make(chan struct{}), err: errors.New("connection refused")}
+	is := &InfluxSink{sp: &SmogPing{noLog: true}, writeAPI: writer, spool: spool, queueSignal: make(chan struct{}, 1)}
+
+	var want []string
+	flush := func(name string) {
+		is.batchPoints = append(is.batchPoints, influxdb2.NewPoint("ping", map[string]string{"n": name},
+			map[string]interface{}{"v": 1}, time.Unix(0, 0)))
+		is.flushBatchUnsafe("test")
+		want = append(want, name)
+	}
+
+	// The first batch is being written when the write queue fills up
+	flush("first")
+	batch, ok := is.nextBatch()
+	if !ok {
+		t.Fatal("no batch queued")
+	}
+	done := make(chan struct{})
+	go func() {
+		is.writeBatch(batch)
+		close(done)
+	}()
+	for i := 0; i <= influxWriteQueueSize; i++ {
+		flush(fmt.Sprintf("queued%d", i))
+	}
+	if _, ok := is.nextBatch(); ok {
+		t.Fatal("batch queued behind the spool")
+	}
+
+	// The failed write goes in front of the batches spooled meanwhile
+	close(writer.gate)
+	<-done
+	writer.mutex.Lock()
+	writer.err = nil
+	writer.mutex.Unlock()
+	is.replaySpool()
+
+	var got []string
+	for _, line := range writer.lines {
+		got = append(got, strings.TrimPrefix(strings.Fields(line)[0], "ping,n="))
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("written %v, want %v", got, want)
+	}
+	if spool.Pending() {
+		t.Error("spool not empty after replay")
+	}
+}
+
+func TestHTTPProbePhases(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	sp := &SmogPing{noLog: true}
+	probe := func(serverURL string) (HTTPPhases, bool) {
+		return sp.sendHTTPProbe(Host{Name: "web", IP: "127.0.0.1", URL: serverURL}, "127.0.0.1", "", 2*time.Second)
+	}
+
+	phases, ok := probe(plain.URL)
+	if !ok {
+		t.Fatal("probe of plain server failed")
+	}
+	if phases.Connect <= 0 || phases.TTFB <= 0 || phases.Total < phases.TTFB || phases.TLS != 0 {
+		t.Errorf("plain phases = %+v", phases)
+	}
+
+	// The handshake completes but the self-signed certificate fails verification
+	phases, ok = probe(secure.URL)
+	if ok {
+		t.Fatal("probe with untrusted certificate succeeded")
+	}
+	if phases.Connect <= 0 || phases.TLS <= 0 {
+		t.Errorf("tls phases = %+v", phases)
+	}
+}
+
+func TestFinishProbeKeepsNewestAddress(t *testing.T) {
+	schedule := &PingSchedule{
+		Host:           Host{Name: "www", IP: "www.example.com", ResolvedIP: "192.0.2.1"},
+		dataPointPings: 1,
+		pending:        make(map[int]*pendingDataPoint),
+		resolvedPoint:  -1,
+	}
+	for dataPoint := 0; dataPoint < 2; dataPoint++ {
+		schedule.pending[dataPoint] = &pendingDataPoint{samples: make([]ProbeSample, 1)}
+	}
+
+	// The data point probing the new address finishes first, the late one must not roll it back
+	schedule.finishProbe(probeJob{schedule: schedule, dataPoint: 1}, ProbeSample{TargetIP: "192.0.2.2"})
+	if got := schedule.Host.ResolvedIP; got != "192.0.2.2" {
+		t.Fatalf("ResolvedIP after newer data point = %s, want 192.0.2.2", got)
+	}
+	point, host := schedule.finishProbe(probeJob{schedule: schedule, dataPoint: 0}, ProbeSample{TargetIP: "192.0.2.1"})
+	if point == nil || host.Name != "www" {
+		t.Fatal("older data point not returned")
+	}
+	if got := schedule.Host.ResolvedIP; got != "192.0.2.2" {
+		t.Errorf("ResolvedIP after older data point = %s, want 192.0.2.2", got)
+	}
+}
+
+func TestMergeProfilesKeepsExplicitZeroValues(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "targets.toml")
+	content := `
+[profiles.pool]
+expand = true
+alarmping = 100
+alarmreceiver = "./pool-alarm.sh"
+
+[profiles.quiet]
+alarmloss = 0
+
+[organizations.Web]
+hosts = [
+  { name = "www", ip = "www.example.com", profile = "pool", expand = false, alarmping = 0, alarmreceiver = "" },
+  { name = "api", ip = "api.example.com", profile = ["pool", "quiet"], alarmloss = 5 },
+]
+`
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var targets TargetsConfig
+	if _, err := toml.DecodeFile(filename, &targets); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordDefinedKeys(filename, &targets); err != nil {
+		t.Fatal(err)
+	}
+	applyProfiles(&targets, targets.Profiles)
+
+	www := targets.Organizations["Web"].Hosts[0]
+	if www.Expand || www.AlarmPing != 0 || www.AlarmReceiver != "" {
+		t.Errorf("www = expand %v, alarmping %d, alarmreceiver %q, want the profile overridden",
+			www.Expand, www.AlarmPing, www.AlarmReceiver)
+	}
+	api := targets.Organizations["Web"].Hosts[1]
+	if !api.Expand || api.AlarmPing != 100 || api.AlarmLoss != 5 {
+		t.Errorf("api = expand %v, alarmping %d, alarmloss %d, want true, 100 and 5",
+			api.Expand, api.AlarmPing, api.AlarmLoss)
+	}
+}
+
+func TestEvaluateAlarmMetric(t *testing.T) {
+	const (
+		ok       = AlarmStateOK
+		warning  = AlarmStateWarning
+		critical = AlarmStateCritical
+	)
+	tests := []struct {
+		name                     string
+		warning, critical, clear int
+		count, window            int
+		values                   []float64
+		want                     []AlarmState // State after each value
+	}{
+		{
+			name:    "raise after n consecutive",
+			warning: 10, count: 3, window: 3,
+			values: []float64{20, 20, 5, 20, 20, 20},
+			want:   []AlarmState{ok, ok, ok, ok, ok, warning},
+		},
+		{
+			name:     "m of last n",
+			critical: 50, count: 2, window: 4,
+			values: []float64{60, 0, 0, 60, 0, 0},
+			want:   []AlarmState{ok, ok, ok, critical, critical, ok},
+		},
+		{
+			name:    "clear below the clear threshold",
+			warning: 10, critical: 20, clear: 5, count: 1, window: 1,
+			values: []float64{25, 15, 8, 4},
+			want:   []AlarmState{critical, warning, warning, ok},
+		},
+		{
+			name:    "clear at the lower threshold by default",
+			warning: 10, critical: 20, count: 1, window: 1,
+			values: []float64{25, 15, 10},
+			want:   []AlarmState{critical, warning, ok},
+		},
+		{
+			name:    "ring wraps around",
+			warning: 10, count: 2, window: 3,
+			values: []float64{20, 0, 0, 20, 0, 20},
+			want:   []AlarmState{ok, ok, ok, ok, ok, warning},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alarm := &MetricAlarm{State: AlarmStateOK}
+			for i, value := range tt.values {
+				metric := alarmMetric{name: "loss", field: "loss", unit: "%", value: value,
+					warning: tt.warning, critical: tt.critical, clear: tt.clear}
+				state, reason := evaluateAlarmMetric(alarm, metric, tt.count, tt.window)
+				if state != tt.want[i] {
+					t.Fatalf("value %d (%.0f): state %s (%s), want %s", i, value, state, reason, tt.want[i])
+				}
+				alarm.State = state
+				if len(alarm.History) > tt.window {
+					t.Fatalf("value %d: history %v longer than window %d", i, alarm.History, tt.window)
+				}
+			}
+
+			start := max(0, len(tt.values)-tt.window)
+			if fmt.Sprint(alarm.History) != fmt.Sprint(tt.values[start:]) {
+				t.Errorf("history %v, want %v", alarm.History, tt.values[start:])
+			}
+		})
+	}
+}
+
+// writeTargetFiles writes files relative to dir, creating their directories
+func writeTargetFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// targetsFile returns a targets file with one host, named after the file, and the given includes
+func targetsFile(host string, octet int, includes ...string) string {
+	content := ""
+	if len(includes) > 0 {
+		content = fmt.Sprintf("include = [%q]\n", strings.Join(includes, `", "`))
+	}
+	return content + fmt.Sprintf("[organizations.Edge]\nhosts = [{ name = %q, ip = \"192.0.2.%d\" }]\n", host, octet)
+}
+
+// loadedTargets returns the names of the hosts and the files, relative to dir, of loaded targets
+func loadedTargets(t *testing.T, dir string, targets TargetsConfig) (hosts, files []string) {
+	t.Helper()
+	for _, host := range targets.Organizations["Edge"].Hosts {
+		hosts = append(hosts, host.Name)
+	}
+	for _, file := range targets.Files {
+		absFile, _ := filepath.Abs(file)
+		rel, err := filepath.Rel(dir, absFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, filepath.ToSlash(rel))
+	}
+	return hosts, files
+}
+
+func TestLoadIncludes(t *testing.T) {
+	tests := []struct {
+		name      string
+		files     map[string]string
+		wantHosts []string
+		wantFiles []string
+	}{
+		{
+			name: "glob",
+			files: map[string]string{
+				"targets.toml":  targetsFile("main", 1, "conf.d/*.toml"),
+				"conf.d/b.toml": targetsFile("b", 3),
+				"conf.d/a.toml": targetsFile("a", 2),
+				"conf.d/c.txt":  targetsFile("c", 4),
+			},
+			wantHosts: []string{"main", "a", "b"},
+			wantFiles: []string{"targets.toml", "conf.d/a.toml", "conf.d/b.toml"},
+		},
+		{
+			name: "directory",
+			files: map[string]string{
+				"targets.toml":  targetsFile("main", 1, "conf.d"),
+				"conf.d/b.toml": targetsFile("b", 3),
+				"conf.d/a.toml": targetsFile("a", 2),
+				"conf.d/c.txt":  targetsFile("c", 4),
+			},
+			wantHosts: []string{"main", "a", "b"},
+			wantFiles: []string{"targets.toml", "conf.d/a.toml", "conf.d/b.toml"},
+		},
+		{
+			name: "nested relative to the including file",
+			files: map[string]string{
+				"targets.toml": targetsFile("main", 1, "sub/a.toml"),
+				"sub/a.toml":   targetsFile("a", 2, "b.toml"),
+				"sub/b.toml":   targetsFile("b", 3),
+			},
+			wantHosts: []string{"main", "a", "b"},
+			wantFiles: []string{"targets.toml", "sub/a.toml", "sub/b.toml"},
+		},
+		{
+			name: "cycle",
+			files: map[string]string{
+				"targets.toml": targetsFile("main", 1, "a.toml"),
+				"a.toml":       targetsFile("a", 2, "b.toml"),
+				"b.toml":       targetsFile("b", 3, "a.toml"),
+			},
+			wantHosts: []string{"main", "a", "b"},
+			wantFiles: []string{"targets.toml", "a.toml", "b.toml"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTargetFiles(t, dir, tt.files)
+
+			sp := &SmogPing{targetsFile: filepath.Join(dir, "targets.toml"), noLog: true}
+			applyConfigDefaults(&sp.config)
+			var targets TargetsConfig
+			if err := sp.loadTargetsFiles(&targets); err != nil {
+				t.Fatal(err)
+			}
+
+			hosts, files := loadedTargets(t, dir, targets)
+			if fmt.Sprint(hosts) != fmt.Sprint(tt.wantHosts) {
+				t.Errorf("hosts %v, want %v", hosts, tt.wantHosts)
+			}
+			if fmt.Sprint(files) != fmt.Sprint(tt.wantFiles) {
+				t.Errorf("files %v, want %v", files, tt.wantFiles)
+			}
+			if len(targets.FailedFiles) > 0 {
+				t.Errorf("failed files %v", targets.FailedFiles)
+			}
+		})
+	}
+}
+
+func TestIncludesResolveAlikeOnStartupAndReload(t *testing.T) {
+	dir := t.TempDir()
+	writeTargetFiles(t, dir, map[string]string{
+		"targets.toml":   targetsFile("main", 1, "sub/a.toml"),
+		"sub/a.toml":     targetsFile("a", 2, "../shared/*.toml"),
+		"shared/b.toml":  targetsFile("b", 3),
+		"shared/c.toml":  targetsFile("c", 4),
+		"sub/other.toml": targetsFile("other", 5),
+	})
+
+	// A relative targets file path, includes are relative to the file including them
+	t.Chdir(dir)
+	sp := &SmogPing{targetsFile: "targets.toml", config: Config{DataPointPings: 10, DataPointTime: 30}, noLog: true}
+	applyConfigDefaults(&sp.config)
+	if err := sp.loadTargets(); err != nil {
+		t.Fatal(err)
+	}
+	startHosts, startFiles := loadedTargets(t, dir, sp.targets)
+
+	reloaded := TargetsConfig{Organizations: make(map[string]Organization)}
+	if err := sp.reloadTargets(&reloaded); err != nil {
+		t.Fatal(err)
+	}
+	reloadHosts, reloadFiles := loadedTargets(t, dir, reloaded)
+
+	wantHosts := []string{"main", "a", "b", "c"}
+	if fmt.Sprint(startHosts) != fmt.Sprint(wantHosts) {
+		t.Errorf("startup hosts %v, want %v", startHosts, wantHosts)
+	}
+	if fmt.Sprint(reloadHosts) != fmt.Sprint(startHosts) || fmt.Sprint(reloadFiles) != fmt.Sprint(startFiles) {
+		t.Errorf("reload loaded %v from %v, startup %v from %v", reloadHosts, reloadFiles, startHosts, startFiles)
+	}
+	if fmt.Sprint(reloaded.IncludePatterns) != fmt.Sprint(sp.targets.IncludePatterns) {
+		t.Errorf("reload patterns %v, startup %v", reloaded.IncludePatterns, sp.targets.IncludePatterns)
+	}
+}
+
+// checkFiles writes a config.toml and a targets.toml and returns their paths. Unless valid is set
+// the targets have an error on line 7 and a warning on line 1.
+func checkFiles(t *testing.T, valid bool) (configFile, targetsFile string) {
+	t.Helper()
+	profile, alarmLoss := "", 500 // Unused profile and an out of range threshold
+	if valid {
+		profile, alarmLoss = `, profile = "core"`, 50
+	}
+
+	dir := t.TempDir()
+	writeTargetFiles(t, dir, map[string]string{
+		"config.toml": `influx_url = "http://127.0.0.1:8086"
+influx_token = "token"
+influx_org = "org"
+influx_bucket = "bucket"
+data_point_pings = 10
+data_point_time = 30
+ping_timeout = 1
+max_concurrent_pings = 50
+`,
+		"targets.toml": fmt.Sprintf(`[profiles.core]
+alarmping = 100
+
+[organizations.Edge]
+hosts = [
+  { name = "rtr1", ip = "192.0.2.1"%s },
+  { name = "rtr2", ip = "192.0.2.2", alarmloss = %d },
+]
+`, profile, alarmLoss),
+	})
+	return filepath.Join(dir, "config.toml"), filepath.Join(dir, "targets.toml")
+}
+
+func TestCheckText(t *testing.T) {
+	configFile, targetsFile := checkFiles(t, false)
+	var out strings.Builder
+	sp := &SmogPing{}
+	if code := sp.runCheck([]string{"-config", configFile, "-targets", targetsFile}, &out); code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+
+	for _, want := range []string{
+		targetsFile + ":7: error: organizations.Edge.hosts[1].alarmloss = 500 - ",
+		targetsFile + ":1: warning: profiles.core - Profile 'core' is not used by any host",
+		"Configuration is invalid (errors: 1, warnings: 1)",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestCheckJSON(t *testing.T) {
+	configFile, targetsFile := checkFiles(t, false)
+	var out strings.Builder
+	sp := &SmogPing{}
+	if code := sp.runCheck([]string{"-config", configFile, "-targets", targetsFile, "-json"}, &out); code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+
+	var report map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(out.String()), &report); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, out.String())
+	}
+	for _, key := range []string{"valid", "files", "targets", "errors", "warnings", "hosts"} {
+		if _, exists := report[key]; !exists {
+			t.Errorf("report has no %q key", key)
+		}
+	}
+
+	var parsed CheckReport
+	if err := json.Unmarshal([]byte(out.String()), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Valid || parsed.Targets != 2 || len(parsed.Hosts) != 2 {
+		t.Errorf("valid %v, targets %d, hosts %d, want false, 2 and 2", parsed.Valid, parsed.Targets, len(parsed.Hosts))
+	}
+	if fmt.Sprint(parsed.Files) != fmt.Sprint([]string{configFile, targetsFile}) {
+		t.Errorf("files %v", parsed.Files)
+	}
+	wantError := CheckIssue{File: targetsFile, Line: 7, Field: "organizations.Edge.hosts[1].alarmloss"}
+	if len(parsed.Errors) != 1 || parsed.Errors[0].File != wantError.File || parsed.Errors[0].Line != wantError.Line ||
+		parsed.Errors[0].Field != wantError.Field || parsed.Errors[0].Value != float64(500) {
+		t.Errorf("errors %+v, want %+v with value 500", parsed.Errors, wantError)
+	}
+	if len(parsed.Warnings) != 1 || parsed.Warnings[0].File != targetsFile || parsed.Warnings[0].Line != 1 ||
+		parsed.Warnings[0].Field != "profiles.core" {
+		t.Errorf("warnings %+v, want profiles.core on line 1", parsed.Warnings)
+	}
+	if host := parsed.Hosts[1]; host.Name != "rtr2" || host.Line != 7 || host.File != targetsFile {
+		t.Errorf("host %+v, want rtr2 on line 7", host)
+	}
+}
+
+func TestCheckValid(t *testing.T) {
+	configFile, targetsFile := checkFiles(t, true)
+	var out strings.Builder
+	sp := &SmogPing{}
+	if code := sp.runCheck([]string{"-config", configFile, "-targets", targetsFile}, &out); code != 0 {
+		t.Errorf("exit code %d, want 0:\n%s", code, out.String())
+	}
+}
+
+func TestTOMLKeyLines(t *testing.T) {
+	content := `# Comment
+include = ["a.toml"]
+
+[profiles.core]
+alarmping = 100
+
+[organizations.Edge]
+hosts = [
+  { name = "rtr1", ip = "192.0.2.1" },
+  { name = "rtr2",
+    alarmloss = 5 },
+]
+
+[[organizations.Core.hosts]]
+name = "core1"
+`
+	lines := tomlKeyLines(content)
+	for key, want := range map[string]int{
+		"include":                               2,
+		"profiles.core":                         4,
+		"profiles.core.alarmping":               5,
+		"organizations.Edge.hosts[0]":           9,
+		"organizations.Edge.hosts[1].name":      10,
+		"organizations.Edge.hosts[1].alarmloss": 11,
+		"organizations.Edge.hosts.alarmloss":    11,
+		"organizations.Core.hosts[0].name":      15,
+	} {
+		if got := lines[key]; got != want {
+			t.Errorf("line of %s = %d, want %d", key, got, want)
+		}
+	}
+}
+
+// milliseconds returns samples given in milliseconds as durations
+func milliseconds(values ...float64) []time.Duration {
+	rtts := make([]time.Duration, len(values))
+	for i, value := range values {
+		rtts[i] = time.Duration(value * float64(time.Millisecond))
+	}
+	return rtts
+}
+
+func TestRTTPercentile(t *testing.T) {
+	tests := []struct {
+		name       string
+		rtts       []time.Duration
+		percentile float64
+		want       float64
+	}{
+		{"median of odd count", milliseconds(10, 20, 30), 50, 20},
+		{"median of even count", milliseconds(10, 20, 30, 40), 50, 25},
+		{"p90 of even count", milliseconds(10, 20, 30, 40), 90, 37},
+		{"p95 of odd count", milliseconds(10, 20, 30, 40, 50), 95, 48},
+		{"single sample", milliseconds(12.5), 95, 12.5},
+		{"p0", milliseconds(10, 20, 30), 0, 10},
+		{"p100", milliseconds(10, 20, 30), 100, 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rttPercentile(tt.rtts, tt.percentile); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("p%.0f = %v, want %v", tt.percentile, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRTTFields(t *testing.T) {
+	sp := &SmogPing{config: Config{RTTStats: []string{"min", "max", "median"}, RTTPercentiles: []int{90, 100}, RTTSamples: true}}
+
+	fields := sp.rttFields(milliseconds(10, 20, 30, 40))
+	want := map[string]interface{}{
+		"rtt_min": 10.0, "rtt_max": 40.0, "rtt_median": 25.0, "rtt_p90": 37.0, "rtt_p100": 40.0,
+		"rtt_1": 10.0, "rtt_2": 20.0, "rtt_3": 30.0, "rtt_4": 40.0,
+	}
+	if len(fields) != len(want) {
+		t.Errorf("fields %v, want %v", fields, want)
+	}
+	for name, value := range want {
+		if got, ok := fields[name].(float64); !ok || math.Abs(got-value.(float64)) > 1e-9 {
+			t.Errorf("%s = %v, want %v", name, fields[name], value)
+		}
+	}
+
+	// A data point without successful pings has no distribution
+	if fields := sp.rttFields(nil); len(fields) != 0 {
+		t.Errorf("fields without samples %v, want none", fields)
+	}
+}